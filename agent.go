@@ -27,6 +27,7 @@ var completionChannel chan bool
 var apiStreamChannel chan string
 var streamRunning bool
 var logList *list.List
+var exitCode int
 
 func handleErrors() {
 
@@ -109,15 +110,45 @@ Done:
 	time.Sleep(100 * time.Millisecond)
 
 	log.Println("No more jobs to run; exiting.")
+
+	os.Exit(exitCode)
 }
 
 func run() {
+	if config.CLIConfig.TestDirectory != "" {
+		if !agent.RunScriptTests(config.CLIConfig.TestDirectory, config.CLIConfig.TestReportPath, errorChannel) {
+			exitCode = 1
+		}
+
+		completionChannel <- true
+		return
+	}
+
+	// Backups read the database without opening it for the Agent
+	if config.CLIConfig.IsBackup {
+		if !agent.RunBackup(configFile, config.CLIConfig.BackupFile, errorChannel) {
+			exitCode = 1
+		}
+
+		completionChannel <- true
+		return
+	}
+
 	if err := database.Init(configFile, errorChannel); err != nil {
 		errorChannel <- gotelemetry.NewLogError("Initialization error: %s", err)
 		completionChannel <- true
 		return
 	}
 
+	if config.CLIConfig.DataCommand != config.DataCommands.None {
+		if !agent.RunDataCommand(config.CLIConfig, errorChannel) {
+			exitCode = 1
+		}
+
+		completionChannel <- true
+		return
+	}
+
 	if err := database.MergeDatabaseWithConfigFile(configFile); err != nil {
 		errorChannel <- gotelemetry.NewLogError("Initialization error: %s", err)
 		completionChannel <- true
@@ -144,6 +175,12 @@ func run() {
 		agent.ProcessNotificationRequest(configFile, errorChannel, completionChannel, config.CLIConfig.NotificationChannel, config.CLIConfig.NotificationFlow, config.CLIConfig.Notification)
 	} else if config.CLIConfig.OAuthCommand != config.OAuthCommands.None {
 		oauth.RunCommand(config.CLIConfig, errorChannel, completionChannel)
+	} else if config.CLIConfig.IsREPL {
+		if err := job.RunREPL(configFile, errorChannel, config.CLIConfig.REPLJobID); err != nil {
+			errorChannel <- gotelemetry.NewLogError("REPL error: %s", err)
+		}
+
+		completionChannel <- true
 	} else {
 
 		serverListening, err := routes.Init(configFile, errorChannel)
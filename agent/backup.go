@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/telemetryapp/gotelemetry"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"github.com/telemetryapp/gotelemetry_agent/agent/database"
+)
+
+// RunBackup writes a copy of the database to a file, or to the standard output if
+// no file is given. When another process, such as a running Agent, has the database
+// open, the copy is downloaded from the API of the Agent instead. Files are only
+// put in place once they are complete. Returns whether the backup succeeded
+func RunBackup(cfg config.Interface, output string, errorChannel chan error) bool {
+	var w io.Writer = os.Stdout
+	var file *os.File
+
+	if len(output) > 0 && output != "-" {
+		var err error
+
+		if file, err = os.Create(output + ".part"); err != nil {
+			errorChannel <- err
+			return false
+		}
+
+		defer os.Remove(output + ".part")
+		defer file.Close()
+
+		w = file
+	}
+
+	written, err := database.BackupFile(cfg.DatabasePath(), w)
+
+	if _, inUse := err.(*database.InUseError); inUse {
+		errorChannel <- gotelemetry.NewLogError("%s. Downloading the backup from the running Agent.", err)
+
+		written, err = backupFromAgent(cfg, w)
+	}
+
+	if err == nil && file != nil {
+		if err = file.Close(); err == nil {
+			err = os.Rename(file.Name(), output)
+		}
+	}
+
+	if err != nil {
+		errorChannel <- err
+		return false
+	}
+
+	errorChannel <- gotelemetry.NewLogError("Backed up %d bytes of the database %s.", written, cfg.DatabasePath())
+
+	return true
+}
+
+// backupFromAgent downloads a backup from the API of an Agent that runs with the
+// same configuration
+func backupFromAgent(cfg config.Interface, w io.Writer) (int64, error) {
+	authKey := cfg.AuthKey()
+
+	if len(authKey) == 0 {
+		return 0, fmt.Errorf("An authentication key is needed to download the backup. Set it in the configuration file or with --auth_key")
+	}
+
+	listen := cfg.Listen()
+	if len(listen) == 0 {
+		listen = ":9800"
+	}
+
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(host) == 0 {
+		host = "localhost"
+	}
+
+	scheme := "http"
+	if len(cfg.CertFile()) > 0 && len(cfg.KeyFile()) > 0 {
+		scheme = "https"
+	}
+
+	request, err := http.NewRequest("GET", fmt.Sprintf("%s://%s/database/backup", scheme, net.JoinHostPort(host, port)), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	request.Header.Set("Authorization", authKey)
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("The Agent responded to the backup request with %s", response.Status)
+	}
+
+	written, err := io.Copy(w, response.Body)
+
+	// A response cut short is not a backup
+	if err == nil && response.ContentLength >= 0 && written != response.ContentLength {
+		err = fmt.Errorf("The backup ended after %d of %d bytes", written, response.ContentLength)
+	}
+
+	return written, err
+}
@@ -0,0 +1,241 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ArgSchema describes one of the key/value arguments of a job. The type is one of
+// `string`, `number`, `integer`, `boolean`, `list`, `table` or `any` (the default)
+type ArgSchema struct {
+	Type     string        `toml:"type"     json:"type,omitempty"`
+	Required bool          `toml:"required" json:"required,omitempty"`
+	Default  interface{}   `toml:"default"  json:"default,omitempty"`
+	Enum     []interface{} `toml:"enum"     json:"enum,omitempty"`
+}
+
+// ArgsSchema maps the names of the arguments of a job to their description
+type ArgsSchema map[string]ArgSchema
+
+// Merge returns a schema with the arguments of both schemas. Those declared in
+// other take precedence
+func (s ArgsSchema) Merge(other ArgsSchema) ArgsSchema {
+	result := ArgsSchema{}
+
+	for name, arg := range s {
+		result[name] = arg
+	}
+
+	for name, arg := range other {
+		result[name] = arg
+	}
+
+	return result
+}
+
+// Validate checks that the types of the schema are known, and that its defaults and
+// enumerated values are of the right type
+func (s ArgsSchema) Validate() error {
+	for _, name := range s.names() {
+		arg := s[name]
+
+		if !argTypes[arg.Type] {
+			return fmt.Errorf("Unknown type `%s` for the argument `%s`", arg.Type, name)
+		}
+
+		if arg.Default != nil {
+			if _, err := convertArg(arg.Type, arg.Default); err != nil {
+				return fmt.Errorf("The default of the argument `%s` %s", name, err)
+			}
+		}
+
+		for _, value := range arg.Enum {
+			if _, err := convertArg(arg.Type, value); err != nil {
+				return fmt.Errorf("The allowed values of the argument `%s` %s", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Apply validates a set of arguments against the schema, and returns them converted
+// to the declared types, with defaults filled in. Arguments that the schema doesn't
+// declare are passed through unchanged
+func (s ArgsSchema) Apply(args map[string]interface{}) (map[string]interface{}, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+
+	result := map[string]interface{}{}
+
+	for name, value := range args {
+		result[name] = value
+	}
+
+	problems := []string{}
+
+	for _, name := range s.names() {
+		arg := s[name]
+		value := result[name]
+
+		if value == nil {
+			if arg.Default == nil {
+				if arg.Required {
+					problems = append(problems, fmt.Sprintf("`%s` is required", name))
+				}
+
+				continue
+			}
+
+			value = arg.Default
+		}
+
+		converted, err := convertArg(arg.Type, value)
+
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("`%s` %s", name, err))
+			continue
+		}
+
+		if len(arg.Enum) > 0 && !arg.allows(converted) {
+			allowed := []string{}
+
+			for _, value := range arg.Enum {
+				allowed = append(allowed, fmt.Sprint(value))
+			}
+
+			problems = append(problems, fmt.Sprintf("`%s` must be one of %s", name, strings.Join(allowed, ", ")))
+			continue
+		}
+
+		result[name] = converted
+	}
+
+	if len(problems) > 0 {
+		return nil, errors.New("Invalid arguments: " + strings.Join(problems, "; "))
+	}
+
+	return result, nil
+}
+
+func (s ArgsSchema) names() []string {
+	names := make([]string, 0, len(s))
+
+	for name := range s {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func (a ArgSchema) allows(value interface{}) bool {
+	for _, allowed := range a.Enum {
+		if converted, err := convertArg(a.Type, allowed); err == nil && reflect.DeepEqual(converted, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The types that arguments can be declared with
+var argTypes = map[string]bool{
+	"":        true,
+	"any":     true,
+	"string":  true,
+	"number":  true,
+	"integer": true,
+	"boolean": true,
+	"list":    true,
+	"table":   true,
+}
+
+// convertArg converts a value to the given type. Strings are accepted for numbers
+// and booleans, as values from the environment or headers are always strings
+func convertArg(argType string, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	switch argType {
+	case "", "any":
+		return MapTemplate(value), nil
+
+	case "string":
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+
+		return nil, errors.New("must be a string")
+
+	case "number":
+		if n, ok := argNumber(value); ok {
+			return n, nil
+		}
+
+		return nil, errors.New("must be a number")
+
+	case "integer":
+		if n, ok := argNumber(value); ok && n == math.Trunc(n) {
+			return int64(n), nil
+		}
+
+		return nil, errors.New("must be an integer")
+
+	case "boolean":
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+
+		case string:
+			if b, err := strconv.ParseBool(v); err == nil {
+				return b, nil
+			}
+		}
+
+		return nil, errors.New("must be a boolean")
+
+	case "list":
+		if list, ok := MapTemplate(value).([]interface{}); ok {
+			return list, nil
+		}
+
+		return nil, errors.New("must be a list")
+
+	case "table":
+		if table, ok := MapTemplate(value).(map[string]interface{}); ok {
+			return table, nil
+		}
+
+		return nil, errors.New("must be a table")
+	}
+
+	return nil, fmt.Errorf("has an unknown type `%s`", argType)
+}
+
+func argNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+
+	case int64:
+		return float64(v), true
+
+	case float64:
+		return v, true
+
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return n, err == nil
+	}
+
+	return 0, false
+}
@@ -23,6 +23,20 @@ var OAuthCommands = struct {
 	Exchange: "exchange",
 }
 
+// DataCommand is set to the type of command that will be executed by agent.RunDataCommand
+type DataCommand string
+
+// DataCommands are the states that a data command can be set to
+var DataCommands = struct {
+	None   DataCommand
+	Export DataCommand
+	Import DataCommand
+}{
+	None:   "",
+	Export: "export",
+	Import: "import",
+}
+
 // CLIConfigType manages the various settings that are initialized at Agent launch
 type CLIConfigType struct {
 	APIURL              string
@@ -52,6 +66,19 @@ type CLIConfigType struct {
 	OAuthCode           string
 	OAuthVerifier       string
 	OAuthRealmID        string
+	TestDirectory       string
+	TestReportPath      string
+	IsREPL              bool
+	REPLJobID           string
+	DataCommand         DataCommand
+	DataFile            string
+	DataFormat          string
+	DataPattern         string
+	DataSince           string
+	DataUntil           string
+	DataOnly            string
+	IsBackup            bool
+	BackupFile          string
 }
 
 // CLIConfig is accessed throughout the Agent to check startup configurations
@@ -115,6 +142,32 @@ func Init(version string) {
 	oauthExchange.Flag("verifier", "The verifier code received from the provider").Short('e').StringVar(&CLIConfig.OAuthVerifier)
 	oauthExchange.Flag("realm", "The realm ID received from the provider").Short('r').StringVar(&CLIConfig.OAuthRealmID)
 
+	test := app.Command("test", "Run the scripts in a directory against their `.test.json` fixtures and exit. No external services are contacted.")
+	test.Arg("directory", "The directory that contains the scripts and fixtures.").Required().StringVar(&CLIConfig.TestDirectory)
+	test.Flag("junit", "Also write the results as a JUnit XML report to the given path.").StringVar(&CLIConfig.TestReportPath)
+
+	repl := app.Command("repl", "Open an interactive Lua session with the Agent's libraries, OAuth entries and database.")
+	repl.Flag("job", "Preload `args` from the job with the given ID and resolve files relative to its script.").StringVar(&CLIConfig.REPLJobID)
+
+	data := app.Command("data", "Export or import the series and counters of the database.")
+
+	dataExport := data.Command("export", "Write series and counters as CSV or NDJSON and exit.")
+	dataExport.Flag("output", "The file to write to. Defaults to the standard output.").Short('o').StringVar(&CLIConfig.DataFile)
+	dataExport.Flag("format", "`csv` or `ndjson`. Defaults to the extension of the output file, or `ndjson`.").Short('f').EnumVar(&CLIConfig.DataFormat, "csv", "ndjson")
+	dataExport.Flag("pattern", "Export only the series and counters whose names match the pattern, such as `servers.*`.").StringVar(&CLIConfig.DataPattern)
+	dataExport.Flag("since", "Export only the samples from this time on, as a Unix timestamp, an RFC 3339 date or a duration such as `7d`.").StringVar(&CLIConfig.DataSince)
+	dataExport.Flag("until", "Export only the samples up to this time, as a Unix timestamp, an RFC 3339 date or a duration such as `1d`.").StringVar(&CLIConfig.DataUntil)
+	dataExport.Flag("only", "Export only the `series` or only the `counters`.").EnumVar(&CLIConfig.DataOnly, "series", "counters")
+
+	dataImport := data.Command("import", "Read series and counters written by `data export` and exit.")
+	dataImport.Arg("file", "The file to read from. Defaults to the standard input.").StringVar(&CLIConfig.DataFile)
+	dataImport.Flag("format", "`csv` or `ndjson`. Defaults to the extension of the file, or `ndjson`.").Short('f').EnumVar(&CLIConfig.DataFormat, "csv", "ndjson")
+
+	db := app.Command("db", "Maintain the database file.")
+
+	dbBackup := db.Command("backup", "Write a consistent copy of the database and exit. While the Agent runs, the copy is downloaded from its API.")
+	dbBackup.Arg("file", "The file to write to. Defaults to the standard output.").StringVar(&CLIConfig.BackupFile)
+
 	run := app.Command("run", "Runs the jobs scheduled in the configuration file provided.").Default()
 
 	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
@@ -133,6 +186,21 @@ func Init(version string) {
 	case oauthExchange.FullCommand():
 		CLIConfig.OAuthCommand = OAuthCommands.Exchange
 
+	case test.FullCommand():
+		// The directory is set by the argument
+
+	case repl.FullCommand():
+		CLIConfig.IsREPL = true
+
+	case dataExport.FullCommand():
+		CLIConfig.DataCommand = DataCommands.Export
+
+	case dataImport.FullCommand():
+		CLIConfig.DataCommand = DataCommands.Import
+
+	case dbBackup.FullCommand():
+		CLIConfig.IsBackup = true
+
 	case run.FullCommand():
 	default:
 		// Do nothing, runs normally
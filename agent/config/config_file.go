@@ -29,6 +29,7 @@ type Job struct {
 	Exec       string      `toml:"exec"        json:"exec"`
 	Script     string      `toml:"script"      json:"script"`
 	Args       interface{} `toml:"args"        json:"args"`
+	ArgsSchema ArgsSchema  `toml:"args_schema" json:"args_schema,omitempty"`
 	Template   interface{} `toml:"template"    json:"template"`
 	Variant    string      `toml:"variant"     json:"variant"`
 	Expiration interface{} `toml:"expiration"  json:"expiration"`
@@ -58,8 +59,25 @@ type ServerConfig struct {
 
 // DataConfig handles the configuration info for the Agent's internal database
 type DataConfig struct {
-	DataLocation string `toml:"path"`
-	TTL          string `toml:"ttl"`
+	DataLocation string            `toml:"path"`
+	TTL          string            `toml:"ttl"`
+	Rollups      []RollupConfig    `toml:"rollups"`
+	Retention    []RetentionConfig `toml:"retention"`
+	Compaction   string            `toml:"compaction"`
+}
+
+// RetentionConfig keeps the series whose names match a pattern, such as
+// `servers.*`, for a given time instead of the TTL of the database
+type RetentionConfig struct {
+	Pattern string `toml:"pattern"`
+	TTL     string `toml:"ttl"`
+}
+
+// RollupConfig describes a tier of pre-aggregated series data, such as 1-minute
+// summaries that are kept for 30 days
+type RollupConfig struct {
+	Interval string `toml:"interval"`
+	TTL      string `toml:"ttl"`
 }
 
 // ListenerConfig handles configuration info for the Agent's internal API
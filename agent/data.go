@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/telemetryapp/gotelemetry"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"github.com/telemetryapp/gotelemetry_agent/agent/database"
+)
+
+// dataFormat returns the format given on the command line, or the one of the
+// extension of the file, which defaults to NDJSON
+func dataFormat(cfg config.CLIConfigType) string {
+	if len(cfg.DataFormat) > 0 {
+		return cfg.DataFormat
+	}
+
+	if strings.ToLower(filepath.Ext(cfg.DataFile)) == ".csv" {
+		return database.FormatCSV
+	}
+
+	return database.FormatNDJSON
+}
+
+// RunDataCommand exports or imports the series and counters of the database, as
+// set by the `data` command line commands. Exports are written to the standard
+// output unless a file is given, which keeps them apart from the log. Returns
+// whether the command succeeded
+func RunDataCommand(cfg config.CLIConfigType, errorChannel chan error) bool {
+	switch cfg.DataCommand {
+	case config.DataCommands.Export:
+		options := database.ExportOptions{
+			Pattern:  cfg.DataPattern,
+			Series:   cfg.DataOnly != "counters",
+			Counters: cfg.DataOnly != "series",
+		}
+
+		var err error
+
+		if options.Since, err = database.ParseTime(cfg.DataSince); err != nil {
+			errorChannel <- err
+			return false
+		}
+
+		if options.Until, err = database.ParseTime(cfg.DataUntil); err != nil {
+			errorChannel <- err
+			return false
+		}
+
+		var w io.Writer = os.Stdout
+
+		if len(cfg.DataFile) > 0 {
+			file, err := os.Create(cfg.DataFile)
+
+			if err != nil {
+				errorChannel <- err
+				return false
+			}
+
+			defer file.Close()
+
+			w = file
+		}
+
+		stats, err := database.Export(w, dataFormat(cfg), options)
+
+		if err != nil {
+			errorChannel <- err
+			return false
+		}
+
+		errorChannel <- gotelemetry.NewLogError("Exported %d samples of %d series and %d counters.", stats.Samples, stats.Series, stats.Counters)
+
+	case config.DataCommands.Import:
+		var r io.Reader = os.Stdin
+
+		if len(cfg.DataFile) > 0 && cfg.DataFile != "-" {
+			file, err := os.Open(cfg.DataFile)
+
+			if err != nil {
+				errorChannel <- err
+				return false
+			}
+
+			defer file.Close()
+
+			r = file
+		}
+
+		stats, err := database.Import(r, dataFormat(cfg))
+
+		errorChannel <- gotelemetry.NewLogError("Imported %d samples of %d series and %d counters. %d samples were already in the database.", stats.Samples, stats.Series, stats.Counters, stats.Skipped)
+
+		if err != nil {
+			errorChannel <- err
+			return false
+		}
+	}
+
+	return true
+}
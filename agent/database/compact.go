@@ -0,0 +1,278 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Compactions commit the copy of the database every this many bytes, so that
+// large databases aren't copied in a single transaction held in memory
+const compactionTxSize = 64 * 1024 * 1024
+
+// ErrBackupInProgress is returned by Compact while a backup is being written, as
+// the compaction would wait for it and hold up every other use of the database
+var ErrBackupInProgress = errors.New("A backup is in progress. Compact the database once it is over")
+
+// CompactionResult reports the size of the database file before and after a
+// compaction, in bytes
+type CompactionResult struct {
+	Before    int64  `json:"before"`
+	After     int64  `json:"after"`
+	Reclaimed int64  `json:"reclaimed"`
+	Duration  string `json:"duration"`
+}
+
+// Backup writes a consistent snapshot of the database to w while it stays in use.
+// If started isn't nil, it is called with the size of the snapshot before it is
+// written
+func Backup(w io.Writer, started func(size int64)) (int64, error) {
+	atomic.AddInt32(&manager.backups, 1)
+	defer atomic.AddInt32(&manager.backups, -1)
+
+	return backup(manager.view, w, started)
+}
+
+// BackupFile writes a snapshot of a database file that isn't open in this process.
+// It returns an *InUseError if another process, such as a running Agent, has the
+// file open
+func BackupFile(location string, w io.Writer) (int64, error) {
+	if _, err := os.Stat(location); err != nil {
+		return 0, err
+	}
+
+	conn, err := openDatabase(location, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+
+	defer conn.Close()
+
+	return backup(conn.View, w, nil)
+}
+
+func backup(view func(func(*bolt.Tx) error) error, w io.Writer, started func(size int64)) (int64, error) {
+	var written int64
+
+	err := view(func(tx *bolt.Tx) error {
+		if started != nil {
+			started(tx.Size())
+		}
+
+		var err error
+		written, err = tx.WriteTo(w)
+
+		return err
+	})
+
+	return written, err
+}
+
+// Compact rewrites the database into a fresh file, which leaves out the pages that
+// were freed since the file grew, and swaps it in place of the current one. Other
+// uses of the database wait until the compaction is over. The current file is kept
+// if anything fails before the swap. It returns ErrBackupInProgress instead of
+// waiting for a backup to finish
+func Compact() (CompactionResult, error) {
+	return manager.compact()
+}
+
+func (m *Manager) compact() (CompactionResult, error) {
+	result := CompactionResult{}
+	start := time.Now()
+
+	if atomic.LoadInt32(&m.backups) > 0 {
+		return result, ErrBackupInProgress
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	before, err := os.Stat(m.path)
+	if err != nil {
+		return result, err
+	}
+
+	result.Before = before.Size()
+
+	compactPath := m.path + ".compact"
+	os.Remove(compactPath)
+
+	dst, err := openDatabase(compactPath, nil)
+	if err != nil {
+		return result, err
+	}
+
+	if err = copyDatabase(m.conn, dst); err != nil {
+		dst.Close()
+		os.Remove(compactPath)
+
+		return result, err
+	}
+
+	if err = dst.Close(); err != nil {
+		os.Remove(compactPath)
+
+		return result, err
+	}
+
+	if err = m.conn.Close(); err != nil {
+		os.Remove(compactPath)
+
+		return result, err
+	}
+
+	// Reopen the current file if the new one can't take its place
+	if err = os.Rename(compactPath, m.path); err != nil {
+		os.Remove(compactPath)
+
+		conn, openErr := openDatabase(m.path, nil)
+		if openErr != nil {
+			return result, fmt.Errorf("%s, and the database could not be reopened: %s", err, openErr)
+		}
+
+		m.conn = conn
+
+		return result, err
+	}
+
+	if m.conn, err = openDatabase(m.path, nil); err != nil {
+		return result, fmt.Errorf("The compacted database could not be opened: %s", err)
+	}
+
+	after, err := os.Stat(m.path)
+	if err != nil {
+		return result, err
+	}
+
+	result.After = after.Size()
+	result.Reclaimed = result.Before - result.After
+	result.Duration = time.Since(start).String()
+
+	m.Logf("Compacted the database from %d to %d bytes, reclaiming %d bytes in %s", result.Before, result.After, result.Reclaimed, result.Duration)
+
+	return result, nil
+}
+
+// databaseCopier copies buckets into a database, committing its transaction as it
+// grows
+type databaseCopier struct {
+	dst  *bolt.DB
+	tx   *bolt.Tx
+	size int
+}
+
+// bucket returns the bucket at a path of nested bucket names, creating it if needed
+func (c *databaseCopier) bucket(path [][]byte) (*bolt.Bucket, error) {
+	bucket, err := c.tx.CreateBucketIfNotExists(path[0])
+
+	for _, name := range path[1:] {
+		if err != nil {
+			return nil, err
+		}
+
+		bucket, err = bucket.CreateBucketIfNotExists(name)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys are copied in order, so pages can be filled up
+	bucket.FillPercent = 1
+
+	return bucket, nil
+}
+
+func (c *databaseCopier) commitIfFull() error {
+	if c.size < compactionTxSize {
+		return nil
+	}
+
+	if err := c.tx.Commit(); err != nil {
+		return err
+	}
+
+	tx, err := c.dst.Begin(true)
+	if err != nil {
+		return err
+	}
+
+	c.tx = tx
+	c.size = 0
+
+	return nil
+}
+
+// copyBucket copies the keys, nested buckets and sequence of a bucket
+func (c *databaseCopier) copyBucket(src *bolt.Bucket, path [][]byte) error {
+	if _, err := c.bucket(path); err != nil {
+		return err
+	}
+
+	err := src.ForEach(func(k, v []byte) error {
+		if err := c.commitIfFull(); err != nil {
+			return err
+		}
+
+		// Nested buckets have no value
+		if v == nil {
+			return c.copyBucket(src.Bucket(k), append(path[:len(path):len(path)], k))
+		}
+
+		dst, err := c.bucket(path)
+		if err != nil {
+			return err
+		}
+
+		c.size += len(k) + len(v)
+
+		return dst.Put(k, v)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	dst, err := c.bucket(path)
+	if err != nil {
+		return err
+	}
+
+	return dst.SetSequence(src.Sequence())
+}
+
+// copyDatabase copies every bucket of src into dst
+func copyDatabase(src, dst *bolt.DB) error {
+	tx, err := dst.Begin(true)
+	if err != nil {
+		return err
+	}
+
+	c := &databaseCopier{dst: dst, tx: tx}
+
+	// The copied keys and values point into src until they are committed, so the
+	// last commit happens before its transaction ends
+	err = src.View(func(srcTx *bolt.Tx) error {
+		err := srcTx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			return c.copyBucket(b, [][]byte{name})
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return c.tx.Commit()
+	})
+
+	if err != nil {
+		c.tx.Rollback()
+	}
+
+	return err
+}
@@ -0,0 +1,156 @@
+package database
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+)
+
+func TestDatabaseCompaction(t *testing.T) {
+	defer openTestDatabase(t, config.DataConfig{})()
+
+	series, _, err := GetSeries("compacted")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := series.SetLabels(map[string]string{"kind": "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	timestamps := make([]*time.Time, 20000)
+	values := make([]float64, 20000)
+
+	for i := range timestamps {
+		ts := time.Unix(1000000001+int64(i), 0)
+		timestamps[i] = &ts
+		values[i] = float64(i + 1)
+	}
+
+	if err := series.PushMany(timestamps, values); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := series.TrimCount(2); err != nil {
+		t.Fatal(err)
+	}
+
+	counter, _, err := GetCounter("compacted")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := counter.SetValue(3); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.After >= result.Before || result.Reclaimed != result.Before-result.After {
+		t.Errorf("Compaction went from %d to %d bytes", result.Before, result.After)
+	}
+
+	backup := &bytes.Buffer{}
+
+	if size, err := Backup(backup, nil); err != nil || size != int64(backup.Len()) {
+		t.Errorf("Backup wrote %d bytes out of %d: %v", backup.Len(), size, err)
+	}
+
+	// The compacted database keeps the data and takes new samples
+	ts := time.Unix(1000020001, 0)
+
+	if err := series.Push(&ts, 20001); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := series.ItemsBetween(time.Time{}, time.Time{}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for index, value := range []float64{19999, 20000, 20001} {
+		if index >= len(items) || items[index].(map[string]interface{})["value"] != value {
+			t.Errorf("Expected item %d to be %v, got %v", index+1, value, items)
+		}
+	}
+
+	if labels, err := series.Labels(); err != nil || labels["kind"] != "test" {
+		t.Errorf("Expected the labels to be kept, got %v (%v)", labels, err)
+	}
+
+	if counter, err = LookupCounter("compacted"); err != nil || counter == nil || counter.GetValue() != 3 {
+		t.Errorf("Expected the counter to be kept, got %v (%v)", counter, err)
+	}
+}
+
+// blockingWriter holds up the first write until it is released
+type blockingWriter struct {
+	writing chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.writing)
+		<-w.release
+	})
+
+	return len(p), nil
+}
+
+func TestCompactionDuringBackup(t *testing.T) {
+	defer openTestDatabase(t, config.DataConfig{})()
+
+	series, _, err := GetSeries("backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &blockingWriter{writing: make(chan struct{}), release: make(chan struct{})}
+	backupDone := make(chan error)
+
+	go func() {
+		_, err := Backup(w, nil)
+		backupDone <- err
+	}()
+
+	<-w.writing
+
+	compacted := make(chan error)
+
+	go func() {
+		_, err := Compact()
+		compacted <- err
+	}()
+
+	select {
+	case err := <-compacted:
+		if err != ErrBackupInProgress {
+			t.Errorf("Expected the compaction to be skipped during the backup, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The compaction waited for the backup")
+	}
+
+	// The database can still be read while the backup is written
+	if _, err := series.ItemsBetween(time.Time{}, time.Time{}, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	close(w.release)
+
+	if err := <-backupDone; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Compact(); err != nil {
+		t.Errorf("Expected the compaction to run after the backup, got %v", err)
+	}
+}
@@ -19,7 +19,7 @@ type Counter struct {
 func GetCounter(name string) (*Counter, bool, error) {
 	isCreated := false
 
-	err := manager.conn.Update(func(tx *bolt.Tx) error {
+	err := manager.update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("_counters"))
 
 		val := bucket.Get([]byte(name))
@@ -44,8 +44,12 @@ func GetCounter(name string) (*Counter, bool, error) {
 	return counter, isCreated, nil
 }
 
+// fatal reports an error, unless the database was opened without an error channel,
+// such as the temporary databases of script tests, which get the error returned
 func (c *Counter) fatal(err error) {
-	manager.errorChannel <- fmt.Errorf("Counter %s -> %s", c.Name, err)
+	if manager.errorChannel != nil {
+		manager.errorChannel <- fmt.Errorf("Counter %s -> %s", c.Name, err)
+	}
 }
 
 func (c *Counter) log(format string, data ...interface{}) {
@@ -60,7 +64,7 @@ func (c *Counter) debug(format string, data ...interface{}) {
 func (c *Counter) GetValue() int64 {
 
 	var value string
-	err := manager.conn.View(func(tx *bolt.Tx) error {
+	err := manager.view(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("_counters"))
 		value = string(bucket.Get([]byte(c.Name)))
 
@@ -80,9 +84,9 @@ func (c *Counter) GetValue() int64 {
 }
 
 // SetValue takes an integer and overrides the previous value of the counter
-func (c *Counter) SetValue(newValue int64) {
+func (c *Counter) SetValue(newValue int64) error {
 
-	err := manager.conn.Update(func(tx *bolt.Tx) error {
+	err := manager.update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("_counters"))
 
 		err := bucket.Put([]byte(c.Name), []byte(strconv.FormatInt(newValue, 10)))
@@ -94,12 +98,16 @@ func (c *Counter) SetValue(newValue int64) {
 		c.fatal(err)
 	}
 
+	return err
 }
 
-// Increment takes a signed integer and adds that value to the counter
-func (c *Counter) Increment(delta int64) {
+// Increment takes a signed integer, adds that value to the counter and returns
+// the new value
+func (c *Counter) Increment(delta int64) (int64, error) {
+
+	var incremenetedVal int64
 
-	err := manager.conn.Update(func(tx *bolt.Tx) error {
+	err := manager.update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("_counters"))
 
 		val := string(bucket.Get([]byte(c.Name)))
@@ -109,7 +117,7 @@ func (c *Counter) Increment(delta int64) {
 			return err
 		}
 
-		incremenetedVal := valueInt + delta
+		incremenetedVal = valueInt + delta
 
 		err = bucket.Put([]byte(c.Name), []byte(strconv.FormatInt(incremenetedVal, 10)))
 
@@ -120,4 +128,41 @@ func (c *Counter) Increment(delta int64) {
 		c.fatal(err)
 	}
 
+	return incremenetedVal, err
+}
+
+// LookupCounter returns a counter if it exists, or nil otherwise. Unlike GetCounter,
+// it never creates the counter
+func LookupCounter(name string) (*Counter, error) {
+	var counter *Counter
+
+	err := manager.view(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("_counters")).Get([]byte(name)) != nil {
+			counter = &Counter{Name: name}
+		}
+
+		return nil
+	})
+
+	return counter, err
+}
+
+// ListCounters returns the value of every counter, by name
+func ListCounters() (map[string]int64, error) {
+	counters := map[string]int64{}
+
+	err := manager.view(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("_counters")).ForEach(func(name, value []byte) error {
+			valueInt, err := strconv.ParseInt(string(value), 10, 64)
+			if err != nil {
+				return err
+			}
+
+			counters[string(name)] = valueInt
+
+			return nil
+		})
+	})
+
+	return counters, err
 }
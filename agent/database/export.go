@@ -0,0 +1,683 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+)
+
+// The formats that series and counters are exported to and imported from
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// The types of the records of an export
+const (
+	recordSeries  = "series"
+	recordCounter = "counter"
+)
+
+// Exports and imports read and write this many entries per transaction, so that
+// large series are never held in memory and transactions stay short
+const dataChunkSize = 10000
+
+var csvHeader = []string{"type", "name", "ts", "value"}
+
+// ExportOptions selects what is exported. Patterns match the names of series and
+// counters as in the retention patterns, and the bounds of the time range are
+// included. A zero bound leaves that side of the range open
+type ExportOptions struct {
+	Pattern  string
+	Since    time.Time
+	Until    time.Time
+	Series   bool
+	Counters bool
+}
+
+// DataStats counts the series, samples and counters of an export or import.
+// Skipped counts the imported samples that were already in the database, and
+// Unsummarized the ones that are too old for the rollups to include
+type DataStats struct {
+	Series       int `json:"series"`
+	Samples      int `json:"samples"`
+	Counters     int `json:"counters"`
+	Skipped      int `json:"skipped"`
+	Unsummarized int `json:"unsummarized,omitempty"`
+}
+
+func (s *DataStats) add(other DataStats) {
+	s.Series += other.Series
+	s.Samples += other.Samples
+	s.Counters += other.Counters
+	s.Skipped += other.Skipped
+	s.Unsummarized += other.Unsummarized
+}
+
+// importedSeries tracks a series during an import
+type importedSeries struct {
+	// The last sequence of the series before the import, as only the samples up
+	// to it are checked for duplicates. Samples repeated within the import are kept
+	sequence uint64
+
+	// The bounds of its rollups before the import, as returned by rollupBounds
+	floor     int64
+	compacted int64
+
+	// The rollup time of the earliest sample imported into periods that have been
+	// compacted
+	earliest int64
+}
+
+// dataRecord is a sample of a series, or the value of a counter, with its
+// timestamp and value written as they are exported
+type dataRecord struct {
+	Type  string      `json:"type"`
+	Name  string      `json:"name"`
+	TS    json.Number `json:"ts,omitempty"`
+	Value recordValue `json:"value"`
+}
+
+// recordValue is the value of a record as it is written. JSON has no numbers for
+// NaN and the infinities, so they are written as the strings "NaN", "+Inf" and
+// "-Inf" instead
+type recordValue string
+
+func (v recordValue) MarshalJSON() ([]byte, error) {
+	if value, err := strconv.ParseFloat(string(v), 64); err == nil && (math.IsNaN(value) || math.IsInf(value, 0)) {
+		return json.Marshal(string(v))
+	}
+
+	return json.Marshal(json.Number(v))
+}
+
+func (v *recordValue) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var value string
+
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+
+		*v = recordValue(value)
+
+		return nil
+	}
+
+	var value json.Number
+
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	*v = recordValue(value)
+
+	return nil
+}
+
+// ValidateFormat returns an error unless the format is one that data can be
+// exported to and imported from
+func ValidateFormat(format string) error {
+	if format != FormatCSV && format != FormatNDJSON {
+		return fmt.Errorf("Unknown format `%s`. Data can be exported as `%s` or `%s`", format, FormatCSV, FormatNDJSON)
+	}
+
+	return nil
+}
+
+// ParseTime reads a bound of a time range, which is either a Unix timestamp that
+// can have a fraction of a second, an RFC 3339 date, or a duration such as `7d`
+// that is counted back from now. An empty string returns the zero time
+func ParseTime(value string) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+
+	if ns, err := parseTimestamp(value); err == nil {
+		return time.Unix(0, ns), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+
+	if duration, err := config.ParseTimeInterval(value); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+
+	return time.Time{}, fmt.Errorf("Invalid time `%s`. Use a Unix timestamp, an RFC 3339 date or a duration such as `7d`", value)
+}
+
+// formatTimestamp writes a time in nanoseconds as seconds, with as many decimals
+// as needed to keep every nanosecond
+func formatTimestamp(ns int64) string {
+	sign := ""
+	abs := uint64(ns)
+
+	if ns < 0 {
+		sign = "-"
+		abs = uint64(-ns)
+	}
+
+	seconds := strconv.FormatUint(abs/uint64(time.Second), 10)
+	fraction := strings.TrimRight(fmt.Sprintf("%09d", abs%uint64(time.Second)), "0")
+
+	if len(fraction) == 0 {
+		return sign + seconds
+	}
+
+	return sign + seconds + "." + fraction
+}
+
+// parseTimestamp reads a time in seconds, with up to nine decimals, without going
+// through a float so that no nanosecond is lost
+func parseTimestamp(value string) (int64, error) {
+	negative := strings.HasPrefix(value, "-")
+	digits := strings.TrimPrefix(value, "-")
+
+	parts := strings.SplitN(digits, ".", 2)
+
+	seconds, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid timestamp `%s`", value)
+	}
+
+	var fraction uint64
+
+	if len(parts) == 2 {
+		if len(parts[1]) == 0 || len(parts[1]) > 9 {
+			return 0, fmt.Errorf("Invalid timestamp `%s`", value)
+		}
+
+		if fraction, err = strconv.ParseUint(parts[1]+strings.Repeat("0", 9-len(parts[1])), 10, 64); err != nil {
+			return 0, fmt.Errorf("Invalid timestamp `%s`", value)
+		}
+	}
+
+	if seconds > math.MaxInt64/uint64(time.Second)-1 {
+		return 0, fmt.Errorf("Timestamp `%s` is out of range", value)
+	}
+
+	ns := int64(seconds*uint64(time.Second) + fraction)
+
+	if negative {
+		return -ns, nil
+	}
+
+	return ns, nil
+}
+
+// recordWriter writes the records of an export in one of the formats
+type recordWriter interface {
+	write(record dataRecord) error
+	flush() error
+}
+
+type csvRecordWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvRecordWriter) write(record dataRecord) error {
+	return c.w.Write([]string{record.Type, record.Name, string(record.TS), string(record.Value)})
+}
+
+func (c *csvRecordWriter) flush() error {
+	c.w.Flush()
+
+	return c.w.Error()
+}
+
+type ndjsonRecordWriter struct {
+	w *bufio.Writer
+}
+
+func (n *ndjsonRecordWriter) write(record dataRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if _, err = n.w.Write(line); err != nil {
+		return err
+	}
+
+	return n.w.WriteByte('\n')
+}
+
+func (n *ndjsonRecordWriter) flush() error {
+	return n.w.Flush()
+}
+
+func matchName(pattern, name string) bool {
+	if len(pattern) == 0 {
+		return true
+	}
+
+	matched, _ := path.Match(pattern, name)
+
+	return matched
+}
+
+// Export writes the series and counters selected by the options to w. Each series
+// is read a chunk at a time, and each chunk is written once its transaction is
+// closed, so that slow readers don't keep the database busy
+func Export(w io.Writer, format string, options ExportOptions) (DataStats, error) {
+	stats := DataStats{}
+
+	if err := ValidateFormat(format); err != nil {
+		return stats, err
+	}
+
+	if _, err := path.Match(options.Pattern, ""); err != nil {
+		return stats, fmt.Errorf("Invalid pattern `%s`: %s", options.Pattern, err)
+	}
+
+	var writer recordWriter
+
+	if format == FormatCSV {
+		csvWriter := csv.NewWriter(w)
+
+		if err := csvWriter.Write(csvHeader); err != nil {
+			return stats, err
+		}
+
+		writer = &csvRecordWriter{w: csvWriter}
+	} else {
+		writer = &ndjsonRecordWriter{w: bufio.NewWriter(w)}
+	}
+
+	if options.Series {
+		names := []string{}
+
+		err := manager.view(func(tx *bolt.Tx) error {
+			return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				if name[0] != '_' && matchName(options.Pattern, string(name)) {
+					names = append(names, string(name))
+				}
+
+				return nil
+			})
+		})
+
+		if err != nil {
+			return stats, err
+		}
+
+		for _, name := range names {
+			samples, err := exportSeries(writer, name, options)
+			if err != nil {
+				return stats, err
+			}
+
+			stats.Series++
+			stats.Samples += samples
+		}
+	}
+
+	if options.Counters {
+		records := []dataRecord{}
+
+		err := manager.view(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("_counters")).ForEach(func(name, value []byte) error {
+				if matchName(options.Pattern, string(name)) {
+					records = append(records, dataRecord{Type: recordCounter, Name: string(name), Value: recordValue(value)})
+				}
+
+				return nil
+			})
+		})
+
+		if err != nil {
+			return stats, err
+		}
+
+		for _, record := range records {
+			if err := writer.write(record); err != nil {
+				return stats, err
+			}
+		}
+
+		stats.Counters = len(records)
+	}
+
+	return stats, writer.flush()
+}
+
+// exportSeries writes the samples of a series within the time range of the options
+func exportSeries(writer recordWriter, name string, options ExportOptions) (int, error) {
+	var last []byte
+	count := 0
+
+	for {
+		records := make([]dataRecord, 0, dataChunkSize)
+		done := false
+
+		err := manager.view(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte(name))
+
+			// The series was removed since the export started
+			if bucket == nil {
+				done = true
+				return nil
+			}
+
+			cursor := bucket.Cursor()
+
+			var k, v []byte
+
+			if last != nil {
+				if k, v = cursor.Seek(last); bytes.Equal(k, last) {
+					k, v = cursor.Next()
+				}
+			} else if options.Since.IsZero() {
+				k, v = cursor.First()
+			} else {
+				k, v = cursor.Seek(seriesTimeKey(options.Since.UnixNano()))
+			}
+
+			for ; k != nil && len(records) < dataChunkSize; k, v = cursor.Next() {
+				ns, err := seriesKeyTime(k)
+				if err != nil {
+					return err
+				}
+
+				if !options.Until.IsZero() && ns > options.Until.UnixNano() {
+					break
+				}
+
+				value, err := decodeSeriesValue(v)
+				if err != nil {
+					return err
+				}
+
+				records = append(records, dataRecord{
+					Type:  recordSeries,
+					Name:  name,
+					TS:    json.Number(formatTimestamp(ns)),
+					Value: recordValue(strconv.FormatFloat(value, 'g', -1, 64)),
+				})
+
+				last = append(last[:0], k...)
+			}
+
+			done = len(records) < dataChunkSize
+
+			return nil
+		})
+
+		if err != nil {
+			return count, err
+		}
+
+		for _, record := range records {
+			if err := writer.write(record); err != nil {
+				return count, err
+			}
+		}
+
+		count += len(records)
+
+		if done {
+			return count, nil
+		}
+	}
+}
+
+// importEntry is a record of an import once it has been validated
+type importEntry struct {
+	series  bool
+	name    string
+	ns      int64
+	value   float64
+	counter int64
+}
+
+func parseRecord(record dataRecord) (importEntry, error) {
+	entry := importEntry{name: record.Name}
+
+	switch record.Type {
+	case recordSeries:
+		if err := validateSeriesName(record.Name); err != nil {
+			return entry, err
+		}
+
+		ns, err := parseTimestamp(string(record.TS))
+		if err != nil {
+			return entry, err
+		}
+
+		value, err := strconv.ParseFloat(string(record.Value), 64)
+		if err != nil {
+			return entry, fmt.Errorf("Invalid value `%s`", record.Value)
+		}
+
+		entry.series = true
+		entry.ns = ns
+		entry.value = value
+
+	case recordCounter:
+		if len(record.Name) == 0 {
+			return entry, fmt.Errorf("Counters must have a name")
+		}
+
+		value, err := strconv.ParseInt(string(record.Value), 10, 64)
+		if err != nil {
+			return entry, fmt.Errorf("Invalid counter value `%s`", record.Value)
+		}
+
+		entry.counter = value
+
+	default:
+		return entry, fmt.Errorf("Unknown record type `%s`. Records are either `%s` or `%s`", record.Type, recordSeries, recordCounter)
+	}
+
+	return entry, nil
+}
+
+// Import reads series samples and counter values from r, as written by Export.
+// Series are created as needed, samples that were already in the database are
+// skipped, and counters are set to the imported value. Records are written in
+// batches, and the ones before an invalid record are imported
+func Import(r io.Reader, format string) (DataStats, error) {
+	stats := DataStats{}
+
+	if err := ValidateFormat(format); err != nil {
+		return stats, err
+	}
+
+	imported := map[string]*importedSeries{}
+	batch := make([]importEntry, 0, dataChunkSize)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		// Records are only counted once their transaction is committed
+		added := DataStats{}
+
+		err := manager.update(func(tx *bolt.Tx) error {
+			for _, entry := range batch {
+				if !entry.series {
+					if err := tx.Bucket([]byte("_counters")).Put([]byte(entry.name), []byte(strconv.FormatInt(entry.counter, 10))); err != nil {
+						return err
+					}
+
+					added.Counters++
+					continue
+				}
+
+				bucket, err := tx.CreateBucketIfNotExists([]byte(entry.name))
+				if err != nil {
+					return err
+				}
+
+				series := imported[entry.name]
+				if series == nil {
+					series = &importedSeries{sequence: bucket.Sequence(), earliest: math.MaxInt64}
+					series.floor, series.compacted = manager.rollupBounds(tx, []byte(entry.name))
+					imported[entry.name] = series
+					added.Series++
+				}
+
+				if hasSeriesEntry(bucket, entry.ns, entry.value, series.sequence) {
+					added.Skipped++
+					continue
+				}
+
+				if err = putSeriesEntry(bucket, entry.ns, entry.value); err != nil {
+					return err
+				}
+
+				added.Samples++
+
+				if ns := rollupTime(entry.ns); ns < series.compacted {
+					if ns < series.floor {
+						added.Unsummarized++
+					} else if ns < series.earliest {
+						series.earliest = ns
+					}
+				}
+			}
+
+			return nil
+		})
+
+		if err == nil {
+			stats.add(added)
+		}
+
+		batch = batch[:0]
+
+		return err
+	}
+
+	add := func(record dataRecord, line int) error {
+		entry, err := parseRecord(record)
+		if err != nil {
+			return fmt.Errorf("Line %d: %s", line, err)
+		}
+
+		batch = append(batch, entry)
+
+		if len(batch) == dataChunkSize {
+			return flush()
+		}
+
+		return nil
+	}
+
+	var err error
+
+	if format == FormatCSV {
+		err = readCSVRecords(r, add)
+	} else {
+		err = readNDJSONRecords(r, add)
+	}
+
+	// Write the records that were read before the error, if any
+	if flushErr := flush(); err == nil {
+		err = flushErr
+	}
+
+	// Periods that were already compacted are summarized again with the new samples
+	rewindErr := manager.update(func(tx *bolt.Tx) error {
+		for name, series := range imported {
+			if series.earliest == math.MaxInt64 {
+				continue
+			}
+
+			if err := manager.rewindRollups(tx, []byte(name), series.earliest, series.floor); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err == nil {
+		err = rewindErr
+	}
+
+	return stats, err
+}
+
+func readCSVRecords(r io.Reader, add func(record dataRecord, line int) error) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = len(csvHeader)
+
+	for line := 1; ; line++ {
+		fields, err := reader.Read()
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// The header is optional
+		if line == 1 && fields[0] == csvHeader[0] {
+			continue
+		}
+
+		if err = add(dataRecord{Type: fields[0], Name: fields[1], TS: json.Number(fields[2]), Value: recordValue(fields[3])}, line); err != nil {
+			return err
+		}
+	}
+}
+
+func readNDJSONRecords(r io.Reader, add func(record dataRecord, line int) error) error {
+	scanner := bufio.NewScanner(r)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		record := dataRecord{}
+
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.UseNumber()
+
+		if err := decoder.Decode(&record); err != nil {
+			return fmt.Errorf("Line %d: %s", line, err)
+		}
+
+		if err := add(record, line); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// hasSeriesEntry tells whether a series has a sample with a given time and value,
+// among the samples up to a sequence number
+func hasSeriesEntry(bucket *bolt.Bucket, ns int64, value float64, sequence uint64) bool {
+	prefix := seriesTimeKey(ns)
+	encoded := encodeSeriesValue(value)
+
+	cursor := bucket.Cursor()
+
+	for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+		if binary.BigEndian.Uint64(k[seriesTimeLength:]) <= sequence && bytes.Equal(v, encoded) {
+			return true
+		}
+	}
+
+	return false
+}
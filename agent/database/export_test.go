@@ -0,0 +1,215 @@
+package database
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+)
+
+func TestDataExport(t *testing.T) {
+	for _, format := range []string{FormatCSV, FormatNDJSON} {
+		done := openTestDatabase(t, config.DataConfig{})
+
+		series, _, err := GetSeries("exported")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, item := range []struct {
+			ns    int64
+			value float64
+		}{{1000000000250000000, 1.5}, {1000000001000000000, 2}, {1000000001000000000, 2}, {1000000002000000000, 3}} {
+			ts := time.Unix(0, item.ns)
+
+			if err := series.Push(&ts, item.value); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		counter, _, err := GetCounter("exported")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := counter.SetValue(7); err != nil {
+			t.Fatal(err)
+		}
+
+		buffer := &bytes.Buffer{}
+
+		stats, err := Export(buffer, format, ExportOptions{Pattern: "exported", Until: time.Unix(1000000001, 0), Series: true, Counters: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stats.Samples != 3 || stats.Counters != 1 {
+			t.Errorf("Export as %s wrote %d samples and %d counters", format, stats.Samples, stats.Counters)
+		}
+
+		done()
+
+		done = openTestDatabase(t, config.DataConfig{})
+
+		data := buffer.String()
+
+		// Importing twice only adds the samples once
+		for i := 0; i < 2; i++ {
+			if _, err := Import(strings.NewReader(data), format); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		series, err = LookupSeries("exported")
+		if err != nil || series == nil {
+			t.Fatalf("Import as %s didn't create the series: %v", format, err)
+		}
+
+		items, err := series.ItemsBetween(time.Time{}, time.Time{}, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []map[string]interface{}{
+			{"ts": int64(1000000000), "ts_nanos": 250000000, "value": 1.5},
+			{"ts": int64(1000000001), "value": 2.0},
+			{"ts": int64(1000000001), "value": 2.0},
+		}
+
+		if len(items) != len(expected) {
+			t.Errorf("Import as %s: expected %d items, got %v", format, len(expected), items)
+		} else {
+			for index, item := range expected {
+				actual := items[index].(map[string]interface{})
+
+				if actual["ts"] != item["ts"] || actual["ts_nanos"] != item["ts_nanos"] || actual["value"] != item["value"] {
+					t.Errorf("Import as %s: expected item %d to be %v, got %v", format, index+1, item, actual)
+				}
+			}
+		}
+
+		if counter, err = LookupCounter("exported"); err != nil || counter == nil || counter.GetValue() != 7 {
+			t.Errorf("Import as %s: expected the counter to be 7, got %v (%v)", format, counter, err)
+		}
+
+		if _, err := Import(strings.NewReader(data+"series,exported,soon,1\n"), FormatCSV); err == nil {
+			t.Error("Importing an invalid timestamp should fail")
+		}
+
+		done()
+	}
+}
+
+func TestDataExportNonFinite(t *testing.T) {
+	for _, format := range []string{FormatCSV, FormatNDJSON} {
+		done := openTestDatabase(t, config.DataConfig{})
+
+		series, _, err := GetSeries("exported")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		values := []float64{math.NaN(), math.Inf(1), math.Inf(-1), 1}
+
+		for index, value := range values {
+			ts := time.Unix(1000000000+int64(index), 0)
+
+			if err := series.Push(&ts, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		buffer := &bytes.Buffer{}
+
+		if stats, err := Export(buffer, format, ExportOptions{Series: true}); err != nil || stats.Samples != len(values) {
+			t.Fatalf("Export as %s: expected %d samples, got %+v (%v)", format, len(values), stats, err)
+		}
+
+		if format == FormatNDJSON && !strings.Contains(buffer.String(), `"value":"NaN"`) {
+			t.Errorf("Expected NaN to be exported as a string, got %s", buffer.String())
+		}
+
+		done()
+
+		done = openTestDatabase(t, config.DataConfig{})
+
+		if _, err := Import(buffer, format); err != nil {
+			t.Fatalf("Import as %s: %s", format, err)
+		}
+
+		items, err := series.ItemsBetween(time.Time{}, time.Time{}, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(items) != len(values) {
+			t.Fatalf("Import as %s: expected %d items, got %v", format, len(values), items)
+		}
+
+		for index, value := range values {
+			actual := items[index].(map[string]interface{})["value"].(float64)
+
+			if actual != value && !(math.IsNaN(value) && math.IsNaN(actual)) {
+				t.Errorf("Import as %s: expected item %d to be %v, got %v", format, index+1, value, actual)
+			}
+		}
+
+		done()
+	}
+}
+
+func TestImportRollups(t *testing.T) {
+	defer openTestDatabase(t, config.DataConfig{Rollups: []config.RollupConfig{{Interval: "1m"}}})()
+
+	series, _, err := GetSeries("imported")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two minutes of samples every 30 seconds, starting on the minute
+	for i := 0; i < 4; i++ {
+		ts := time.Unix(1000000200+int64(i)*30, 0)
+
+		if err := series.Push(&ts, float64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manager.compactRollups()
+
+	// The first sample goes into a compacted period, and the second is older than
+	// the samples the series held, so the rollups can't include it
+	stats, err := Import(strings.NewReader("series,imported,1000000215,100\nseries,imported,1000000140,50\n"), FormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Samples != 2 || stats.Unsummarized != 1 {
+		t.Errorf("Expected 2 samples with 1 unsummarized, got %+v", stats)
+	}
+
+	manager.compactRollups()
+
+	// Only the rollups are left to aggregate
+	if err := series.TrimCount(0); err != nil {
+		t.Fatal(err)
+	}
+
+	end := time.Unix(1000000320, 0)
+
+	result, err := series.Aggregate(Sum, 60, 3, &end)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []float64{0, 103, 3}
+
+	for index, value := range expected {
+		if actual := result.([]interface{})[index].(map[string]interface{})["value"]; actual != value {
+			t.Errorf("Expected period %d to sum to %v, got %v", index+1, value, actual)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package database
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// seriesPoint is an entry of a series, with its timestamp in nanoseconds
+type seriesPoint struct {
+	ns    int64
+	value float64
+}
+
+// The names of the FunctionType functions, as used by the API
+var functionNames = map[string]FunctionType{
+	"sum":    Sum,
+	"avg":    Avg,
+	"min":    Min,
+	"max":    Max,
+	"count":  Count,
+	"stddev": StdDev,
+	"median": Median,
+	"p50":    Median,
+	"p90":    P90,
+	"p95":    P95,
+	"p99":    P99,
+	"rate":   Rate,
+	"delta":  Delta,
+	"last":   Last,
+}
+
+// ParseFunction returns the FunctionType function with a given name, such as `avg`
+// or `p95`, regardless of case
+func ParseFunction(name string) (FunctionType, error) {
+	if functionType, ok := functionNames[strings.ToLower(name)]; ok {
+		return functionType, nil
+	}
+
+	return None, fmt.Errorf("Unknown function `%s`", name)
+}
+
+// The percentiles computed by the FunctionType functions that have one
+var percentiles = map[FunctionType]float64{
+	Median: 50,
+	P90:    90,
+	P95:    95,
+	P99:    99,
+}
+
+// computeFunction calculates a FunctionType over points in time order. Empty sets
+// of points compute to zero
+func computeFunction(functionType FunctionType, points []seriesPoint) (float64, error) {
+	if p, ok := percentiles[functionType]; ok {
+		if len(points) == 0 {
+			return 0.0, nil
+		}
+
+		return percentile(points, p), nil
+	}
+
+	summary := seriesSummary{}
+
+	for _, p := range points {
+		summary.add(p)
+	}
+
+	return summary.compute(functionType)
+}
+
+// seriesSummary holds what every FunctionType except the percentiles needs, so
+// that it can be computed over a period without its points. Summaries of
+// consecutive periods can be merged
+type seriesSummary struct {
+	count float64
+	sum   float64
+	min   float64
+	max   float64
+
+	// The mean and the sum of squared differences from it, kept with Welford's
+	// method for the standard deviation
+	mean float64
+	m2   float64
+
+	first    seriesPoint
+	last     seriesPoint
+	increase float64
+}
+
+func pointSummary(p seriesPoint) seriesSummary {
+	return seriesSummary{count: 1, sum: p.value, min: p.value, max: p.value, mean: p.value, first: p, last: p}
+}
+
+// add includes a point that comes after those already in the summary
+func (s *seriesSummary) add(p seriesPoint) {
+	s.merge(pointSummary(p))
+}
+
+// merge includes the summary of a period that comes after the one of s
+func (s *seriesSummary) merge(o seriesSummary) {
+	if o.count == 0 {
+		return
+	}
+
+	if s.count == 0 {
+		*s = o
+		return
+	}
+
+	count := s.count + o.count
+	delta := o.mean - s.mean
+
+	s.m2 += o.m2 + delta*delta*s.count*o.count/count
+	s.mean += delta * o.count / count
+	s.count = count
+	s.sum += o.sum
+	s.min = math.Min(s.min, o.min)
+	s.max = math.Max(s.max, o.max)
+	s.increase += o.increase + growth(s.last.value, o.first.value)
+	s.last = o.last
+}
+
+func (s seriesSummary) compute(functionType FunctionType) (float64, error) {
+	// Do not compute if there are not any items
+	if s.count < 1 {
+		return 0.0, nil
+	}
+
+	switch functionType {
+	case Sum:
+		return s.sum, nil
+	case Avg:
+		return s.sum / s.count, nil
+	case Min:
+		return s.min, nil
+	case Max:
+		return s.max, nil
+	case Count:
+		return s.count, nil
+	case StdDev:
+		// Standard deviation formula requires at least two values
+		if s.count < 2 {
+			return 0.0, nil
+		}
+		return math.Sqrt(s.m2 / (s.count - 1)), nil
+	case Rate:
+		// A rate requires two values some time apart
+		if s.last.ns == s.first.ns {
+			return 0.0, nil
+		}
+		return s.increase / (float64(s.last.ns-s.first.ns) / float64(time.Second)), nil
+	case Delta:
+		return s.last.value - s.first.value, nil
+	case Last:
+		return s.last.value, nil
+	default:
+		return 0.0, fmt.Errorf("Unknown operation %d", functionType)
+	}
+}
+
+// computePeriod calculates a FunctionType over a period of width nanoseconds whose
+// samples are summarized by s. Rates and deltas also count the change from previous,
+// the last sample before the period if there is one, so that a counter sampled once
+// per period still grows, and rates are per second of the whole period
+func (s seriesSummary) computePeriod(functionType FunctionType, previous *seriesPoint, width int64) (float64, error) {
+	if functionType != Rate && functionType != Delta {
+		return s.compute(functionType)
+	}
+
+	if s.count < 1 {
+		return 0.0, nil
+	}
+
+	first := s.first.value
+	increase := s.increase
+
+	if previous != nil {
+		first = previous.value
+		increase += growth(previous.value, s.first.value)
+	}
+
+	if functionType == Delta {
+		return s.last.value - first, nil
+	}
+
+	return increase / (float64(width) / float64(time.Second)), nil
+}
+
+// percentile interpolates between the two values closest to the rank of p
+func percentile(points []seriesPoint, p float64) float64 {
+	values := make([]float64, len(points))
+
+	for i, point := range points {
+		values[i] = point.value
+	}
+
+	sort.Float64s(values)
+
+	rank := p / 100 * float64(len(values)-1)
+	lower := math.Floor(rank)
+	upper := math.Ceil(rank)
+
+	return values[int(lower)] + (values[int(upper)]-values[int(lower)])*(rank-lower)
+}
+
+// growth is how much a monotonically increasing value, such as a request counter,
+// grew from one sample to the next. A value lower than the one before it means
+// that the counter was reset, and counts as growth from zero
+func growth(previous, next float64) float64 {
+	if next >= previous {
+		return next - previous
+	}
+
+	return next
+}
@@ -13,7 +13,7 @@ func GetAllJobs() ([]config.Job, error) {
 
 	var jobsArray []config.Job
 
-	err := manager.conn.View(func(tx *bolt.Tx) error {
+	err := manager.view(func(tx *bolt.Tx) error {
 		cursor := tx.Bucket([]byte("_jobs")).Cursor()
 
 		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
@@ -39,7 +39,7 @@ func WriteJob(job config.Job) error {
 		return err
 	}
 
-	err = manager.conn.Update(func(tx *bolt.Tx) error {
+	err = manager.update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("_jobs"))
 		err2 := bucket.Put([]byte(job.ID), jobMarshal)
 		return err2
@@ -50,7 +50,7 @@ func WriteJob(job config.Job) error {
 
 // DeleteJob finds a job by its ID and removes it from the database
 func DeleteJob(jobID string) error {
-	err := manager.conn.Update(func(tx *bolt.Tx) error {
+	err := manager.update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("_jobs"))
 
 		// Run a get command first to ensure that the key exists
@@ -68,7 +68,7 @@ func DeleteJob(jobID string) error {
 
 // WriteScript writes a job's associated Lua source code keyed by the job ID
 func WriteScript(jobID, scriptSource string) error {
-	err := manager.conn.Update(func(tx *bolt.Tx) error {
+	err := manager.update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("_scripts"))
 		err := bucket.Put([]byte(jobID), []byte(scriptSource))
 		return err
@@ -81,7 +81,7 @@ func WriteScript(jobID, scriptSource string) error {
 func GetScript(jobID string) string {
 	var scriptSource string
 
-	manager.conn.View(func(tx *bolt.Tx) error {
+	manager.view(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("_scripts"))
 
 		val := bucket.Get([]byte(jobID))
@@ -98,7 +98,7 @@ func GetScript(jobID string) string {
 
 // DeleteScript searches by job ID for a Lua source code string and deletes the entry. Returns an error if not found
 func DeleteScript(jobID string) error {
-	err := manager.conn.Update(func(tx *bolt.Tx) error {
+	err := manager.update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("_scripts"))
 
 		// Run a get command first to ensure that the key exists
@@ -0,0 +1,224 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var labelNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SeriesGroup is the aggregate of the series that share the values of some labels
+type SeriesGroup struct {
+	Labels map[string]string `json:"labels"`
+	Series []string          `json:"series"`
+	Items  []interface{}     `json:"items"`
+}
+
+func validateLabels(labels map[string]string) error {
+	for name := range labels {
+		if !labelNameRegex.MatchString(name) {
+			return fmt.Errorf("Invalid label name `%s`. Label names must start with a letter or underscore and can only contain letters, underscores, and digits.", name)
+		}
+	}
+
+	return nil
+}
+
+func seriesLabels(tx *bolt.Tx, name string) (map[string]string, error) {
+	labels := map[string]string{}
+
+	if meta := tx.Bucket([]byte(metadataBucket)).Bucket([]byte(name)); meta != nil {
+		if v := meta.Get([]byte("labels")); v != nil {
+			if err := json.Unmarshal(v, &labels); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return labels, nil
+}
+
+// Labels returns the key/value labels of the series
+func (s *Series) Labels() (map[string]string, error) {
+	var labels map[string]string
+
+	err := manager.view(func(tx *bolt.Tx) error {
+		var err error
+		labels, err = seriesLabels(tx, s.Name)
+
+		return err
+	})
+
+	return labels, err
+}
+
+// SetLabels replaces the labels of the series. An empty set removes them
+func (s *Series) SetLabels(labels map[string]string) error {
+	if err := validateLabels(labels); err != nil {
+		return err
+	}
+
+	return manager.update(func(tx *bolt.Tx) error {
+		if len(labels) == 0 {
+			if meta := tx.Bucket([]byte(metadataBucket)).Bucket([]byte(s.Name)); meta != nil {
+				return meta.Delete([]byte("labels"))
+			}
+
+			return nil
+		}
+
+		meta, err := tx.Bucket([]byte(metadataBucket)).CreateBucketIfNotExists([]byte(s.Name))
+		if err != nil {
+			return err
+		}
+
+		encoded, err := json.Marshal(labels)
+		if err != nil {
+			return err
+		}
+
+		return meta.Put([]byte("labels"), encoded)
+	})
+}
+
+// SelectSeries returns the series that have all of the labels of the selector,
+// with one of the given values for each. The series are sorted by name
+func SelectSeries(selector map[string][]string) ([]*Series, error) {
+	result := []*Series{}
+
+	err := manager.view(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if name[0] == '_' {
+				return nil
+			}
+
+			labels, err := seriesLabels(tx, string(name))
+			if err != nil {
+				return err
+			}
+
+			if matchLabels(labels, selector) {
+				result = append(result, &Series{Name: string(name)})
+			}
+
+			return nil
+		})
+	})
+
+	return result, err
+}
+
+func matchLabels(labels map[string]string, selector map[string][]string) bool {
+	for name, values := range selector {
+		value, ok := labels[name]
+		if !ok {
+			return false
+		}
+
+		matched := false
+
+		for _, v := range values {
+			if v == value {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// AggregateGroups aggregates each series like Aggregate, then groups the series by
+// the values of the labels in by, and combines the values of each period across
+// the series of a group with the combine function. Series without one of the labels
+// are grouped as if its value was empty. Series without samples in a period are
+// left out of its combined value
+func AggregateGroups(series []*Series, by []string, functionType, combine FunctionType, aggregateInterval int, aggregateCount int, endTimePtr *time.Time) ([]SeriesGroup, error) {
+	type group struct {
+		SeriesGroup
+		results [][]aggregatedPeriod
+	}
+
+	groups := map[string]*group{}
+	keys := []string{}
+
+	for _, s := range series {
+		labels, err := s.Labels()
+		if err != nil {
+			return nil, err
+		}
+
+		groupLabels := map[string]string{}
+		values := []string{}
+
+		for _, name := range by {
+			if value, ok := labels[name]; ok {
+				groupLabels[name] = value
+			}
+
+			values = append(values, labels[name])
+		}
+
+		encodedValues, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+
+		key := string(encodedValues)
+
+		if groups[key] == nil {
+			groups[key] = &group{SeriesGroup: SeriesGroup{Labels: groupLabels, Series: []string{}}}
+			keys = append(keys, key)
+		}
+
+		periods, err := s.aggregate(functionType, aggregateInterval, aggregateCount, endTimePtr)
+		if err != nil {
+			return nil, err
+		}
+
+		groups[key].Series = append(groups[key].Series, s.Name)
+		groups[key].results = append(groups[key].results, periods)
+	}
+
+	sort.Strings(keys)
+
+	result := []SeriesGroup{}
+
+	for _, key := range keys {
+		g := groups[key]
+		g.Items = []interface{}{}
+
+		for i := 0; i < aggregateCount; i++ {
+			var ts interface{}
+			points := []seriesPoint{}
+
+			for _, periods := range g.results {
+				ts = periods[i].ts
+
+				if periods[i].samples {
+					points = append(points, seriesPoint{value: periods[i].value})
+				}
+			}
+
+			value, err := computeFunction(combine, points)
+			if err != nil {
+				return nil, err
+			}
+
+			g.Items = append(g.Items, map[string]interface{}{"ts": ts, "value": value})
+		}
+
+		result = append(result, g.SeriesGroup)
+	}
+
+	return result, nil
+}
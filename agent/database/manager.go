@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
-	"strconv"
 	"sync"
 	"time"
 
@@ -18,10 +17,25 @@ import (
 type Manager struct {
 	path           string
 	ttl            time.Duration
+	ttlString      string
+	retentionRules []retentionRule
 	errorChannel   chan error
 	conn           *bolt.DB
 	mutex          sync.RWMutex
 	cleanupRunning bool
+	rollups        []rollupTier
+	rollupRunning  bool
+
+	// The cleanup job runs as often as the shortest retention
+	cleanupTicker   *time.Ticker
+	cleanupInterval time.Duration
+	cleanupMutex    sync.Mutex
+
+	// The number of backups being written, which compactions don't wait for
+	backups int32
+
+	// Closed by Close to stop the background jobs
+	stop chan struct{}
 }
 
 var manager *Manager
@@ -30,18 +44,22 @@ var manager *Manager
 func Init(configFile config.Interface, errorChannel chan error) error {
 	location := configFile.DatabasePath()
 
-	conn, err := bolt.Open(location, 0644, nil)
+	conn, err := openDatabase(location, nil)
 
 	if err != nil {
 		return err
 	}
 
 	manager = &Manager{
+		path:         location,
 		errorChannel: errorChannel,
 		conn:         conn,
 		mutex:        sync.RWMutex{},
+		stop:         make(chan struct{}),
 	}
 
+	stop := manager.stop
+
 	// Create default buckets
 	err = conn.Update(func(tx *bolt.Tx) error {
 
@@ -65,9 +83,55 @@ func Init(configFile config.Interface, errorChannel chan error) error {
 			return err
 		}
 
+		if _, err = tx.CreateBucketIfNotExists([]byte(rollupsBucket)); err != nil {
+			return err
+		}
+
+		if _, err = tx.CreateBucketIfNotExists([]byte(metadataBucket)); err != nil {
+			return err
+		}
+
 		return nil
 	})
 
+	if err != nil {
+		return err
+	}
+
+	if err = manager.migrateSeries(); err != nil {
+		return err
+	}
+
+	if manager.rollups, err = parseRollupTiers(configFile.DataConfig().Rollups); err != nil {
+		return err
+	}
+
+	if len(manager.rollups) > 0 {
+		// Run once initially
+		manager.compactRollups()
+
+		// Compact the periods of the finest tier as they end
+		ticker := time.NewTicker(manager.rollups[0].interval)
+		go func() {
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+					if manager.rollupRunning {
+						log.Printf("The rollup compactor is already running. Skipping execution.")
+						continue
+					}
+					manager.rollupRunning = true
+					manager.compactRollups()
+					manager.rollupRunning = false
+				}
+			}
+		}()
+	}
+
 	ttlString := configFile.DatabaseTTL()
 	if len(ttlString) == 0 {
 		if ttlString = GetConfigParam("ttl"); len(ttlString) > 0 {
@@ -82,40 +146,153 @@ func Init(configFile config.Interface, errorChannel chan error) error {
 			return err
 		}
 		manager.ttl = ttl
+		manager.ttlString = ttlString
+	} else {
+		manager.ttl = 0
+	}
+
+	if manager.retentionRules, err = parseRetentionRules(configFile.DataConfig().Retention); err != nil {
+		return err
+	}
 
-		// The cleanup job should run at least once every 24 hours
-		timeInterval := ttl
-		oneDayInterval, _ := config.ParseTimeInterval("24h")
-		if timeInterval > oneDayInterval {
-			timeInterval = oneDayInterval
+	// The cleanup job should run at least once every 24 hours, and as often as
+	// the shortest TTL. It runs even without any TTL, as scripts can set the
+	// retention of their series
+	timeInterval, _ := config.ParseTimeInterval("24h")
+	if manager.ttl > 0 && manager.ttl < timeInterval {
+		timeInterval = manager.ttl
+	}
+
+	for _, rule := range manager.retentionRules {
+		if ttl, _ := config.ParseTimeInterval(rule.ttl); ttl < timeInterval {
+			timeInterval = ttl
 		}
+	}
 
-		// Run once initially
-		manager.databaseCleanup()
+	if ttl := manager.shortestSeriesRetention(); ttl > 0 && ttl < timeInterval {
+		timeInterval = ttl
+	}
 
-		// Begin the database trim routine
-		ticker := time.NewTicker(timeInterval)
+	if compaction := configFile.DataConfig().Compaction; len(compaction) > 0 {
+		interval, err := config.ParseTimeInterval(compaction)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("Invalid compaction interval `%s`", compaction)
+		}
+
+		// Compactions are scheduled only, as they hold up every other use of the
+		// database while they run
+		ticker := time.NewTicker(interval)
 		go func() {
+			defer ticker.Stop()
+
 			for {
 				select {
+				case <-stop:
+					return
 				case <-ticker.C:
-					if manager.cleanupRunning {
-						log.Printf("The database cleanup process is already running. Skipping execution.")
-						continue
+					if _, err := Compact(); err == ErrBackupInProgress {
+						manager.Logf("Skipping the scheduled compaction: %s", err)
+					} else if err != nil {
+						manager.Errorf("Compaction Error: %s", err)
 					}
-					manager.cleanupRunning = true
-					manager.databaseCleanup()
-					manager.cleanupRunning = false
 				}
 			}
 		}()
-	} else {
-		manager.ttl = 0
 	}
 
+	// Run once initially
+	manager.databaseCleanup()
+
+	// Begin the database trim routine
+	ticker := time.NewTicker(timeInterval)
+	manager.cleanupTicker = ticker
+	manager.cleanupInterval = timeInterval
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if manager.cleanupRunning {
+					log.Printf("The database cleanup process is already running. Skipping execution.")
+					continue
+				}
+				manager.cleanupRunning = true
+				manager.databaseCleanup()
+				manager.cleanupRunning = false
+			}
+		}
+	}()
+
 	return err
 }
 
+// Close stops the background jobs and closes the database file. The database must
+// be initialized again before it can be used
+func Close() error {
+	if manager == nil {
+		return nil
+	}
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if manager.stop != nil {
+		close(manager.stop)
+		manager.stop = nil
+	}
+
+	return manager.conn.Close()
+}
+
+// InUseError is returned when another process, such as a running Agent, has a
+// database open
+type InUseError struct {
+	Path string
+}
+
+func (e *InUseError) Error() string {
+	return fmt.Sprintf("The database %s is in use by another process", e.Path)
+}
+
+// openDatabase opens a database file, failing instead of waiting when another
+// process has it open
+func openDatabase(location string, options *bolt.Options) (*bolt.DB, error) {
+	if options == nil {
+		options = &bolt.Options{}
+	}
+
+	options.Timeout = 5 * time.Second
+
+	conn, err := bolt.Open(location, 0644, options)
+
+	if err == bolt.ErrTimeout {
+		return nil, &InUseError{Path: location}
+	}
+
+	return conn, err
+}
+
+// view runs a read-only transaction. Transactions hold a read lock on the manager
+// so that the connection isn't swapped by a compaction while they run
+func (m *Manager) view(fn func(*bolt.Tx) error) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.conn.View(fn)
+}
+
+// update runs a read-write transaction, like view
+func (m *Manager) update(fn func(*bolt.Tx) error) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.conn.Update(fn)
+}
+
 // Logf sends a formatted string to the agent's global log. It works like log.Logf
 func (m *Manager) Logf(format string, v ...interface{}) {
 	if m.errorChannel != nil {
@@ -137,12 +314,24 @@ func (m *Manager) Errorf(format string, v ...interface{}) {
 	}
 }
 
+// scheduleCleanup makes the cleanup job run at least as often as a retention
+func (m *Manager) scheduleCleanup(ttl time.Duration) {
+	m.cleanupMutex.Lock()
+	defer m.cleanupMutex.Unlock()
+
+	if m.cleanupTicker == nil || ttl <= 0 || ttl >= m.cleanupInterval {
+		return
+	}
+
+	m.cleanupInterval = ttl
+	m.cleanupTicker.Reset(ttl)
+}
+
 func (m *Manager) databaseCleanup() {
 
-	since := time.Now().Add(-m.ttl)
-	max := []byte(strconv.FormatInt(since.Unix(), 10))
+	now := time.Now()
 
-	err := m.conn.Update(func(tx *bolt.Tx) error {
+	err := m.update(func(tx *bolt.Tx) error {
 
 		err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
 
@@ -150,6 +339,15 @@ func (m *Manager) databaseCleanup() {
 				return nil
 			}
 
+			// Series without a retention are kept forever
+			retention := m.retention(tx, string(name))
+			if retention.Seconds == 0 {
+				return nil
+			}
+
+			since := now.Add(-time.Duration(retention.Seconds) * time.Second)
+			max := seriesTimeKey(since.UnixNano())
+
 			cursor := b.Cursor()
 
 			// Start by finding the closest value to our trim target
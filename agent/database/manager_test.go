@@ -0,0 +1,39 @@
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+)
+
+// testDatabasePath returns the path of a database file in a temporary directory,
+// and a function that closes the database and removes the directory
+func testDatabasePath(t *testing.T) (string, func()) {
+	directory, err := ioutil.TempDir("", "agent-database-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filepath.Join(directory, "agent.db"), func() {
+		Close()
+		os.RemoveAll(directory)
+	}
+}
+
+// openTestDatabase opens a database in a temporary directory with the given data
+// configuration, and returns a function that closes and removes it
+func openTestDatabase(t *testing.T, data config.DataConfig) func() {
+	path, done := testDatabasePath(t)
+
+	data.DataLocation = path
+
+	if err := Init(&config.File{Data: data}, make(chan error, 99999)); err != nil {
+		done()
+		t.Fatal(err)
+	}
+
+	return done
+}
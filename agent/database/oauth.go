@@ -22,7 +22,7 @@ func WriteOAuthToken(key string, token interface{}) error {
 		return err
 	}
 
-	err = manager.conn.Update(func(tx *bolt.Tx) error {
+	err = manager.update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("_oauth"))
 
 		err2 := bucket.Put([]byte(key), data)
@@ -41,7 +41,7 @@ func ReadOAuthToken(key string, dest interface{}) error {
 		return errors.New("Invalid key")
 	}
 
-	err := manager.conn.View(func(tx *bolt.Tx) error {
+	err := manager.view(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("_oauth"))
 
 		val := bucket.Get([]byte(key))
@@ -0,0 +1,168 @@
+package database
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+)
+
+// The metadata of each series is kept in a bucket of its own within `_metadata`
+const metadataBucket = "_metadata"
+
+// The sources of a retention, from the highest precedence to the lowest
+const (
+	RetentionSeries  = "series"
+	RetentionPattern = "pattern"
+	RetentionDefault = "default"
+	RetentionNone    = "none"
+)
+
+// Retention describes how long the samples of a series are kept, and where that
+// comes from: the series itself, a pattern of the configuration file or the
+// database's TTL
+type Retention struct {
+	TTL     string `json:"ttl,omitempty"`
+	Seconds int64  `json:"seconds,omitempty"`
+	Source  string `json:"source"`
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// retentionRule keeps the samples of the series whose names match a pattern for
+// a given time
+type retentionRule struct {
+	pattern string
+	ttl     string
+}
+
+// parseRetentionRules reads the retention patterns of the configuration, which
+// are matched in order
+func parseRetentionRules(retentions []config.RetentionConfig) ([]retentionRule, error) {
+	rules := []retentionRule{}
+
+	for _, retention := range retentions {
+		if _, err := path.Match(retention.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid retention pattern `%s`: %s", retention.Pattern, err)
+		}
+
+		if ttl, err := config.ParseTimeInterval(retention.TTL); err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("Invalid TTL `%s` for the retention pattern `%s`", retention.TTL, retention.Pattern)
+		}
+
+		rules = append(rules, retentionRule{pattern: retention.Pattern, ttl: retention.TTL})
+	}
+
+	return rules, nil
+}
+
+func newRetention(ttl, source, pattern string) Retention {
+	duration, _ := config.ParseTimeInterval(ttl)
+
+	return Retention{TTL: ttl, Seconds: int64(duration / time.Second), Source: source, Pattern: pattern}
+}
+
+// retention finds the retention of a series
+func (m *Manager) retention(tx *bolt.Tx, name string) Retention {
+	if meta := tx.Bucket([]byte(metadataBucket)).Bucket([]byte(name)); meta != nil {
+		if ttl := meta.Get([]byte("retention")); ttl != nil {
+			return newRetention(string(ttl), RetentionSeries, "")
+		}
+	}
+
+	for _, rule := range m.retentionRules {
+		if matched, _ := path.Match(rule.pattern, name); matched {
+			return newRetention(rule.ttl, RetentionPattern, rule.pattern)
+		}
+	}
+
+	if m.ttl > 0 {
+		return newRetention(m.ttlString, RetentionDefault, "")
+	}
+
+	return Retention{Source: RetentionNone}
+}
+
+// Retention returns how long the samples of the series are kept
+func (s *Series) Retention() (Retention, error) {
+	var retention Retention
+
+	err := manager.view(func(tx *bolt.Tx) error {
+		retention = manager.retention(tx, s.Name)
+
+		return nil
+	})
+
+	return retention, err
+}
+
+// SetRetention keeps the samples of the series for a given time, such as `30d`,
+// regardless of the retention patterns and TTL of the database. An empty string
+// removes the series' own retention. Samples older than the new retention are
+// removed right away
+func (s *Series) SetRetention(ttl string) error {
+	var duration time.Duration
+
+	if len(ttl) > 0 {
+		var err error
+
+		if duration, err = config.ParseTimeInterval(ttl); err != nil {
+			return err
+		}
+
+		if duration <= 0 {
+			return fmt.Errorf("Invalid retention %s: it must be longer than zero", ttl)
+		}
+	}
+
+	err := manager.update(func(tx *bolt.Tx) error {
+		if len(ttl) == 0 {
+			if meta := tx.Bucket([]byte(metadataBucket)).Bucket([]byte(s.Name)); meta != nil {
+				return meta.Delete([]byte("retention"))
+			}
+
+			return nil
+		}
+
+		meta, err := tx.Bucket([]byte(metadataBucket)).CreateBucketIfNotExists([]byte(s.Name))
+		if err != nil {
+			return err
+		}
+
+		return meta.Put([]byte("retention"), []byte(ttl))
+	})
+
+	if err != nil || duration == 0 {
+		return err
+	}
+
+	manager.scheduleCleanup(duration)
+
+	return s.TrimSince(time.Now().Add(-duration))
+}
+
+// shortestSeriesRetention returns the shortest retention that a series has been
+// given with SetRetention, or zero if there is none
+func (m *Manager) shortestSeriesRetention() time.Duration {
+	var shortest time.Duration
+
+	m.view(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(metadataBucket)).ForEach(func(name, v []byte) error {
+			meta := tx.Bucket([]byte(metadataBucket)).Bucket(name)
+			if meta == nil {
+				return nil
+			}
+
+			if ttl := meta.Get([]byte("retention")); ttl != nil {
+				if duration, err := config.ParseTimeInterval(string(ttl)); err == nil && duration > 0 && (shortest == 0 || duration < shortest) {
+					shortest = duration
+				}
+			}
+
+			return nil
+		})
+	})
+
+	return shortest
+}
@@ -0,0 +1,98 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+)
+
+func TestSeriesRetention(t *testing.T) {
+	path, done := testDatabasePath(t)
+	defer done()
+
+	cfg := &config.File{Data: config.DataConfig{DataLocation: path, TTL: "1w", Retention: []config.RetentionConfig{
+		{Pattern: "servers.*", TTL: "2d"},
+	}}}
+
+	if err := Init(cfg, make(chan error, 99999)); err != nil {
+		t.Fatal(err)
+	}
+
+	days := func(n int) *time.Time {
+		ts := time.Now().Add(-time.Duration(n) * 24 * time.Hour)
+		return &ts
+	}
+
+	push := func(name string, ages ...int) *Series {
+		series, _, err := GetSeries(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for index, age := range ages {
+			if err := series.Push(days(age), float64(index+1)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return series
+	}
+
+	count := func(series *Series) int {
+		items, err := series.ItemsBetween(time.Time{}, time.Time{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return len(items)
+	}
+
+	web := push("servers.web", 3, 1)
+	other := push("other", 10, 1)
+	kept := push("kept", 40, 10)
+
+	// Setting a retention removes the older samples right away
+	if err := kept.SetRetention("30d"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := count(kept); n != 1 {
+		t.Errorf("Expected 1 sample after setting the retention, got %d", n)
+	}
+
+	if err := kept.SetRetention("soon"); err == nil {
+		t.Errorf("An invalid retention should fail")
+	}
+
+	// The database is cleaned up when it is opened
+	Close()
+
+	if err := Init(cfg, make(chan error, 99999)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[*Series]Retention{
+		web:   {TTL: "2d", Seconds: 172800, Source: RetentionPattern, Pattern: "servers.*"},
+		other: {TTL: "1w", Seconds: 604800, Source: RetentionDefault},
+		kept:  {TTL: "30d", Seconds: 2592000, Source: RetentionSeries},
+	}
+
+	for series, retention := range expected {
+		if n := count(series); n != 1 {
+			t.Errorf("Expected 1 sample in %s, got %d", series.Name, n)
+		}
+
+		if actual, err := series.Retention(); err != nil || actual != retention {
+			t.Errorf("Expected the retention of %s to be %+v, got %+v (%v)", series.Name, retention, actual, err)
+		}
+	}
+
+	if err := kept.SetRetention(""); err != nil {
+		t.Fatal(err)
+	}
+
+	if retention, _ := kept.Retention(); retention.Source != RetentionDefault {
+		t.Errorf("Removing the retention of a series should fall back to the default, got %+v", retention)
+	}
+}
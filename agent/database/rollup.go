@@ -0,0 +1,467 @@
+package database
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+)
+
+// Rollups are kept in the `_rollups` bucket, with a bucket for each series that
+// holds a bucket for each tier, named by its interval in seconds. Their entries are
+// keyed by the start of their period and hold its summary. The series buckets also
+// record how far each tier has been compacted, under `compacted:<interval>`
+const rollupsBucket = "_rollups"
+
+// Like aggregate periods, the period of a rollup starting at S holds the samples
+// taken after the second S, up to and including the second at which it ends. Times
+// of samples are moved back by this offset to find the period they belong to
+const rollupOffset = int64(time.Second)
+
+// The number of float64 fields of an encoded seriesSummary
+const rollupSummaryFields = 11
+
+// rollupTier is a level of pre-aggregated series data
+type rollupTier struct {
+	interval time.Duration
+	ttl      time.Duration
+}
+
+func (t rollupTier) name() []byte {
+	return []byte(strconv.FormatInt(int64(t.interval/time.Second), 10))
+}
+
+func (t rollupTier) compactedKey() []byte {
+	return []byte("compacted:" + string(t.name()))
+}
+
+// parseRollupTiers reads the tiers from the configuration, from the finest to the
+// coarsest. Each tier is compacted from the one before it, so its interval must be
+// a multiple of the previous one
+func parseRollupTiers(rollups []config.RollupConfig) ([]rollupTier, error) {
+	tiers := []rollupTier{}
+
+	for _, rollup := range rollups {
+		interval, err := config.ParseTimeInterval(rollup.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid rollup interval `%s`: %s", rollup.Interval, err)
+		}
+
+		if interval < time.Second || interval%time.Second != 0 {
+			return nil, fmt.Errorf("Invalid rollup interval `%s`: rollups must be a whole number of seconds", rollup.Interval)
+		}
+
+		tier := rollupTier{interval: interval}
+
+		if len(rollup.TTL) > 0 {
+			if tier.ttl, err = config.ParseTimeInterval(rollup.TTL); err != nil {
+				return nil, fmt.Errorf("Invalid rollup TTL `%s`: %s", rollup.TTL, err)
+			}
+		}
+
+		tiers = append(tiers, tier)
+	}
+
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].interval < tiers[j].interval })
+
+	for i := 1; i < len(tiers); i++ {
+		if tiers[i].interval%tiers[i-1].interval != 0 {
+			return nil, fmt.Errorf("The rollup interval %s is not a multiple of %s", tiers[i].interval, tiers[i-1].interval)
+		}
+	}
+
+	return tiers, nil
+}
+
+// rollupTierFor returns the coarsest tier whose periods add up to the given
+// interval, in seconds, or nil if the function can't be computed from summaries
+func (m *Manager) rollupTierFor(functionType FunctionType, interval int64) *rollupTier {
+	if _, ok := percentiles[functionType]; ok {
+		return nil
+	}
+
+	for i := len(m.rollups) - 1; i >= 0; i-- {
+		if tierInterval := int64(m.rollups[i].interval / time.Second); interval%tierInterval == 0 {
+			return &m.rollups[i]
+		}
+	}
+
+	return nil
+}
+
+// compactRollups brings the rollups of every series up to date, and removes the
+// periods that are older than the TTL of their tier
+func (m *Manager) compactRollups() {
+	names := [][]byte{}
+
+	m.view(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if name[0] != '_' {
+				names = append(names, append([]byte{}, name...))
+			}
+
+			return nil
+		})
+	})
+
+	now := time.Now()
+
+	for _, name := range names {
+		if err := m.compactSeries(name, now); err != nil {
+			m.Errorf("Rollup Error for the series %s: %s", name, err)
+		}
+	}
+}
+
+// compactSeries writes the summaries of the periods that ended since the series
+// was last compacted. Pushes and imports into periods that have been compacted
+// rewind it with rewindRollups, so that they are summarized again
+func (m *Manager) compactSeries(name []byte, now time.Time) error {
+	return m.update(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(name)
+		if raw == nil {
+			return nil
+		}
+
+		seriesRollups, err := tx.Bucket([]byte(rollupsBucket)).CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+
+		// Tiers can only be compacted up to the end of the periods that the tier
+		// before them has compacted
+		sourceUntil := rollupTime(now.UnixNano())
+
+		var source *bolt.Bucket
+
+		for _, tier := range m.rollups {
+			bucket, err := seriesRollups.CreateBucketIfNotExists(tier.name())
+			if err != nil {
+				return err
+			}
+
+			interval := int64(tier.interval)
+			until := floorTime(sourceUntil, interval)
+
+			from, ok := rollupCompacted(seriesRollups, tier)
+
+			if !ok {
+				// Start with the period of the first sample
+				firstBucket := raw
+
+				if source != nil {
+					firstBucket = source
+				}
+
+				k, _ := firstBucket.Cursor().First()
+
+				if k == nil {
+					sourceUntil = math.MinInt64
+					source = bucket
+					continue
+				}
+
+				first, err := entryTime(k)
+				if err != nil {
+					return err
+				}
+
+				from = floorTime(rollupTime(first), interval)
+			}
+
+			if from < until {
+				summaries := map[int64]*seriesSummary{}
+				starts := []int64{}
+
+				include := func(ns int64, summary seriesSummary) {
+					start := floorTime(ns, interval)
+
+					if summaries[start] == nil {
+						summaries[start] = &seriesSummary{}
+						starts = append(starts, start)
+					}
+
+					summaries[start].merge(summary)
+				}
+
+				if source == nil {
+					err = forEachRawPoint(raw, from+rollupOffset, until+rollupOffset, func(p seriesPoint) {
+						include(rollupTime(p.ns), pointSummary(p))
+					})
+				} else {
+					err = forEachRollup(source, from, until, include)
+				}
+
+				if err != nil {
+					return err
+				}
+
+				for _, start := range starts {
+					if err = bucket.Put(seriesTimeKey(start), encodeSeriesSummary(*summaries[start])); err != nil {
+						return err
+					}
+				}
+
+				if err = seriesRollups.Put(tier.compactedKey(), seriesTimeKey(until)); err != nil {
+					return err
+				}
+			} else {
+				until = from
+			}
+
+			sourceUntil = until
+			source = bucket
+		}
+
+		// Periods are only removed once the tiers after them have been compacted
+		for _, tier := range m.rollups {
+			if tier.ttl > 0 {
+				if err = trimRollups(seriesRollups.Bucket(tier.name()), now.Add(-tier.ttl).UnixNano()); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// rollupBounds returns, for a series about to receive older samples, the time from
+// which its rollups can be summarized again and the time up to which its first tier
+// has been compacted. Summaries are only recomputed from the first period of the
+// coarsest tier that starts after the first sample of the series, as periods before
+// it may have lost samples to retention and are only known from their rollups. Both
+// are times of rollup periods, which samples are compared to with rollupTime
+func (m *Manager) rollupBounds(tx *bolt.Tx, name []byte) (int64, int64) {
+	floor, compacted := int64(math.MaxInt64), int64(math.MaxInt64)
+
+	if len(m.rollups) == 0 {
+		return floor, compacted
+	}
+
+	seriesRollups := tx.Bucket([]byte(rollupsBucket)).Bucket(name)
+	if seriesRollups == nil {
+		return floor, compacted
+	}
+
+	if marker, ok := rollupCompacted(seriesRollups, m.rollups[0]); ok {
+		compacted = marker
+	}
+
+	if raw := tx.Bucket(name); raw != nil {
+		if k, _ := raw.Cursor().First(); k != nil {
+			if first, err := entryTime(k); err == nil {
+				interval := int64(m.rollups[len(m.rollups)-1].interval)
+
+				first = rollupTime(first)
+
+				if floor = floorTime(first, interval); floor < first {
+					floor += interval
+				}
+			}
+		}
+	}
+
+	return floor, compacted
+}
+
+// rewindRollups moves the compaction of every tier of a series back to the period
+// of the coarsest tier that holds the earliest of a set of new samples, but not
+// before floor, so that the next compaction summarizes those periods again
+func (m *Manager) rewindRollups(tx *bolt.Tx, name []byte, earliest, floor int64) error {
+	if len(m.rollups) == 0 {
+		return nil
+	}
+
+	seriesRollups := tx.Bucket([]byte(rollupsBucket)).Bucket(name)
+	if seriesRollups == nil {
+		return nil
+	}
+
+	to := floorTime(earliest, int64(m.rollups[len(m.rollups)-1].interval))
+
+	if to < floor {
+		to = floor
+	}
+
+	for _, tier := range m.rollups {
+		if compacted, ok := rollupCompacted(seriesRollups, tier); ok && compacted > to {
+			if err := seriesRollups.Put(tier.compactedKey(), seriesTimeKey(to)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// rollupCompacted returns the time up to which a tier has been compacted
+func rollupCompacted(seriesRollups *bolt.Bucket, tier rollupTier) (int64, bool) {
+	v := seriesRollups.Get(tier.compactedKey())
+
+	if len(v) != seriesTimeLength {
+		return 0, false
+	}
+
+	return int64(binary.BigEndian.Uint64(v) ^ seriesSignBit), true
+}
+
+func forEachRawPoint(raw *bolt.Bucket, from, until int64, fn func(seriesPoint)) error {
+	c := raw.Cursor()
+
+	for k, v := c.Seek(seriesTimeKey(from)); k != nil; k, v = c.Next() {
+		ns, err := seriesKeyTime(k)
+		if err != nil {
+			return err
+		}
+
+		if ns >= until {
+			break
+		}
+
+		value, err := decodeSeriesValue(v)
+		if err != nil {
+			return err
+		}
+
+		fn(seriesPoint{ns: ns, value: value})
+	}
+
+	return nil
+}
+
+// forEachRollup calls fn with the summaries of the periods of a tier that start
+// between from and until, excluding until
+func forEachRollup(bucket *bolt.Bucket, from, until int64, fn func(int64, seriesSummary)) error {
+	c := bucket.Cursor()
+
+	for k, v := c.Seek(seriesTimeKey(from)); k != nil; k, v = c.Next() {
+		start, err := entryTime(k)
+		if err != nil {
+			return err
+		}
+
+		if start >= until {
+			break
+		}
+
+		summary, err := decodeSeriesSummary(v)
+		if err != nil {
+			return err
+		}
+
+		fn(start, summary)
+	}
+
+	return nil
+}
+
+// trimRollups removes the periods of a tier that started before a given time
+func trimRollups(bucket *bolt.Bucket, before int64) error {
+	keys := [][]byte{}
+
+	c := bucket.Cursor()
+
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		start, err := entryTime(k)
+		if err != nil {
+			return err
+		}
+
+		if start >= before {
+			break
+		}
+
+		keys = append(keys, k)
+	}
+
+	for _, k := range keys {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// entryTime returns the time of a series entry or of a rollup period, whose keys
+// have no sequence number
+func entryTime(key []byte) (int64, error) {
+	if len(key) < seriesTimeLength {
+		return 0, fmt.Errorf("Invalid series key of %d bytes", len(key))
+	}
+
+	return int64(binary.BigEndian.Uint64(key) ^ seriesSignBit), nil
+}
+
+// rollupTime returns the time of the rollup periods that a sample taken at ns
+// belongs to
+func rollupTime(ns int64) int64 {
+	return ns - rollupOffset
+}
+
+// floorTime rounds a time in nanoseconds down to a multiple of interval
+func floorTime(ns, interval int64) int64 {
+	if ns == math.MinInt64 {
+		return ns
+	}
+
+	remainder := ns % interval
+
+	if remainder < 0 {
+		remainder += interval
+	}
+
+	return ns - remainder
+}
+
+func encodeSeriesSummary(s seriesSummary) []byte {
+	fields := []uint64{
+		math.Float64bits(s.count),
+		math.Float64bits(s.sum),
+		math.Float64bits(s.min),
+		math.Float64bits(s.max),
+		math.Float64bits(s.mean),
+		math.Float64bits(s.m2),
+		uint64(s.first.ns),
+		math.Float64bits(s.first.value),
+		uint64(s.last.ns),
+		math.Float64bits(s.last.value),
+		math.Float64bits(s.increase),
+	}
+
+	b := make([]byte, rollupSummaryFields*8)
+
+	for i, field := range fields {
+		binary.BigEndian.PutUint64(b[i*8:], field)
+	}
+
+	return b
+}
+
+func decodeSeriesSummary(b []byte) (seriesSummary, error) {
+	if len(b) != rollupSummaryFields*8 {
+		return seriesSummary{}, fmt.Errorf("Invalid rollup of %d bytes", len(b))
+	}
+
+	field := func(i int) uint64 {
+		return binary.BigEndian.Uint64(b[i*8:])
+	}
+
+	return seriesSummary{
+		count:    math.Float64frombits(field(0)),
+		sum:      math.Float64frombits(field(1)),
+		min:      math.Float64frombits(field(2)),
+		max:      math.Float64frombits(field(3)),
+		mean:     math.Float64frombits(field(4)),
+		m2:       math.Float64frombits(field(5)),
+		first:    seriesPoint{ns: int64(field(6)), value: math.Float64frombits(field(7))},
+		last:     seriesPoint{ns: int64(field(8)), value: math.Float64frombits(field(9))},
+		increase: math.Float64frombits(field(10)),
+	}, nil
+}
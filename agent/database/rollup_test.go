@@ -0,0 +1,215 @@
+package database
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+)
+
+// aggregateValues returns the values of an aggregation of a series
+func aggregateValues(t *testing.T, series *Series, functionType FunctionType, interval, count int, end *time.Time) []float64 {
+	result, err := series.Aggregate(functionType, interval, count, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := []float64{}
+
+	for _, item := range result.([]interface{}) {
+		values = append(values, item.(map[string]interface{})["value"].(float64))
+	}
+
+	return values
+}
+
+// equalValues compares aggregated values, allowing for rounding
+func equalValues(expected, actual []float64) bool {
+	if len(expected) != len(actual) {
+		return false
+	}
+
+	for index := range expected {
+		if math.Abs(expected[index]-actual[index]) > 1e-9 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestSeriesRollups(t *testing.T) {
+	path, done := testDatabasePath(t)
+	defer done()
+
+	cfg := &config.File{Data: config.DataConfig{DataLocation: path, Rollups: []config.RollupConfig{
+		{Interval: "1h"},
+		{Interval: "1m", TTL: "1w"},
+	}}}
+
+	if err := Init(cfg, make(chan error, 99999)); err != nil {
+		t.Fatal(err)
+	}
+
+	series, _, err := GetSeries("rollups")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two hours of samples every 30 seconds, starting on the hour
+	start := int64(999997200)
+	timestamps := make([]*time.Time, 240)
+	values := make([]float64, 240)
+
+	for i := range timestamps {
+		ts := time.Unix(start+int64(i)*30, 0)
+		timestamps[i] = &ts
+		values[i] = float64(i)
+	}
+
+	if err := series.PushMany(timestamps, values); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rollups are compacted when the database is opened
+	Close()
+
+	if err := Init(cfg, make(chan error, 99999)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the rollups are left to aggregate
+	if err := series.TrimCount(0); err != nil {
+		t.Fatal(err)
+	}
+
+	at := func(seconds int64) *time.Time {
+		ts := time.Unix(start+seconds, 0)
+		return &ts
+	}
+
+	tests := []struct {
+		name         string
+		functionType FunctionType
+		interval     int
+		count        int
+		end          *time.Time
+		expected     []float64
+	}{
+		{"Hours", Sum, 3600, 2, at(7200), []float64{7260, 21420}},
+		{"Expired tier", Count, 60, 2, at(120), []float64{0, 0}},
+		{"Rate", Rate, 7200, 1, at(7200), []float64{239.0 / 7200}},
+		{"Percentiles use raw samples", Median, 3600, 1, at(3600), []float64{0}},
+	}
+
+	for _, test := range tests {
+		if actual := aggregateValues(t, series, test.functionType, test.interval, test.count, test.end); !equalValues(test.expected, actual) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, actual)
+		}
+	}
+
+	// Recent samples haven't been compacted yet
+	if err := series.Push(nil, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if actual := aggregateValues(t, series, Sum, 60, 2, nil); !equalValues([]float64{0, 5}, actual) {
+		t.Errorf("Recent samples: expected [0 5], got %v", actual)
+	}
+}
+
+func TestSeriesRollupsMatchRawSamples(t *testing.T) {
+	defer openTestDatabase(t, config.DataConfig{Rollups: []config.RollupConfig{{Interval: "1m"}, {Interval: "1h"}}})()
+
+	series, _, err := GetSeries("rollups")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two hours of samples every 30 seconds, starting on the hour, with a reset
+	// of the counter halfway
+	start := int64(999997200)
+	timestamps := make([]*time.Time, 240)
+	values := make([]float64, 240)
+
+	for i := range timestamps {
+		ts := time.Unix(start+int64(i)*30, 0)
+		timestamps[i] = &ts
+		values[i] = float64(i % 120)
+	}
+
+	if err := series.PushMany(timestamps, values); err != nil {
+		t.Fatal(err)
+	}
+
+	end := time.Unix(start+7200, 0)
+
+	tests := []struct {
+		functionType FunctionType
+		interval     int
+		count        int
+	}{
+		{Sum, 3600, 2}, {Count, 3600, 2}, {Avg, 3600, 2}, {Min, 3600, 2}, {Max, 3600, 2}, {StdDev, 3600, 2},
+		{Rate, 3600, 2}, {Delta, 3600, 2}, {Last, 3600, 2}, {Sum, 60, 120}, {Rate, 60, 120}, {Delta, 600, 12},
+	}
+
+	raw := make([][]float64, len(tests))
+
+	// The samples haven't been compacted since the database was opened
+	for index, test := range tests {
+		raw[index] = aggregateValues(t, series, test.functionType, test.interval, test.count, &end)
+	}
+
+	manager.compactRollups()
+
+	for index, test := range tests {
+		if actual := aggregateValues(t, series, test.functionType, test.interval, test.count, &end); !equalValues(raw[index], actual) {
+			t.Errorf("Function %d over %d seconds: the raw samples give %v, and the rollups %v", test.functionType, test.interval, raw[index], actual)
+		}
+	}
+}
+
+func TestSeriesRollupsBackdatedPush(t *testing.T) {
+	defer openTestDatabase(t, config.DataConfig{Rollups: []config.RollupConfig{{Interval: "1m"}, {Interval: "1h"}}})()
+
+	series, _, err := GetSeries("backdated")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An hour of samples every 30 seconds, starting on the hour
+	start := int64(999997200)
+
+	for i := 0; i < 120; i++ {
+		ts := time.Unix(start+int64(i)*30, 0)
+
+		if err := series.Push(&ts, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manager.compactRollups()
+
+	// A sample pushed into a period that has already been compacted
+	ts := time.Unix(start+1815, 0)
+
+	if err := series.Push(&ts, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	manager.compactRollups()
+
+	// The samples after the first second of the hour, and the backdated one
+	end := time.Unix(start+3600, 0)
+
+	if actual := aggregateValues(t, series, Sum, 3600, 1, &end); !equalValues([]float64{219}, actual) {
+		t.Errorf("Hours: expected [219], got %v", actual)
+	}
+
+	minutes := aggregateValues(t, series, Sum, 60, 60, &end)
+
+	if actual := minutes[30]; actual != 102 {
+		t.Errorf("Minutes: expected the backdated sample in minute 31, got %v", minutes)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"math"
 	"regexp"
-	"strconv"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -23,6 +22,13 @@ const (
 	Max
 	Count
 	StdDev
+	Median
+	P90
+	P95
+	P99
+	Rate
+	Delta
+	Last
 )
 
 // Series tracks the name of the series and is used to append Lua functions
@@ -50,7 +56,7 @@ func GetSeries(name string) (*Series, bool, error) {
 	}
 
 	// Get the requested key
-	err = manager.conn.Update(func(tx *bolt.Tx) error {
+	err = manager.update(func(tx *bolt.Tx) error {
 
 		if tx.Bucket([]byte(name)) == nil {
 			_, err = tx.CreateBucket([]byte(name))
@@ -74,24 +80,63 @@ func GetSeries(name string) (*Series, bool, error) {
 	return series, isCreated, nil
 }
 
+// bucket returns the bucket of the series, which may have been dropped since the
+// series was created
+func (s *Series) bucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	if bucket := tx.Bucket([]byte(s.Name)); bucket != nil {
+		return bucket, nil
+	}
+
+	return nil, fmt.Errorf("Series not found: %s", s.Name)
+}
+
 // Push adds a value to a given point of the series based on timestamp.
 // The position will default to the current time if time is not provided
 func (s *Series) Push(timestamp *time.Time, value float64) error {
-	err := manager.conn.Update(func(tx *bolt.Tx) error {
+	return s.PushMany([]*time.Time{timestamp}, []float64{value})
+}
 
-		if timestamp == nil {
-			timestamp = &time.Time{}
-			*timestamp = time.Now()
-		}
+// PushMany inserts several timestamp/value pairs into a series in one transaction.
+// A nil timestamp stands for the current time
+func (s *Series) PushMany(timestamps []*time.Time, values []float64) error {
+	if len(timestamps) != len(values) {
+		return fmt.Errorf("Expected as many timestamps as values, got %d and %d", len(timestamps), len(values))
+	}
+
+	now := time.Now()
 
+	err := manager.update(func(tx *bolt.Tx) error {
 		seriesBucket, err := tx.CreateBucketIfNotExists([]byte(s.Name))
 		if err != nil {
 			return err
 		}
 
-		err = seriesBucket.Put([]byte(strconv.FormatInt(timestamp.Unix(), 10)), []byte(strconv.FormatFloat(value, 'E', -1, 64)))
+		floor, compacted := manager.rollupBounds(tx, []byte(s.Name))
+		earliest := int64(math.MaxInt64)
 
-		return err
+		for index, timestamp := range timestamps {
+			if timestamp == nil {
+				timestamp = &now
+			}
+
+			ns := timestamp.UnixNano()
+
+			if err = putSeriesEntry(seriesBucket, ns, values[index]); err != nil {
+				return err
+			}
+
+			if ns := rollupTime(ns); ns < compacted && ns >= floor && ns < earliest {
+				earliest = ns
+			}
+		}
+
+		// Backdated samples go into periods that may have been compacted already,
+		// which are summarized again by the next compaction
+		if earliest == math.MaxInt64 {
+			return nil
+		}
+
+		return manager.rewindRollups(tx, []byte(s.Name), earliest, floor)
 	})
 
 	return err
@@ -102,21 +147,22 @@ func (s *Series) Last() (map[string]interface{}, error) {
 
 	var output map[string]interface{}
 
-	err := manager.conn.View(func(tx *bolt.Tx) error {
-		key, val := tx.Bucket([]byte(s.Name)).Cursor().Last()
-		value, err := strconv.ParseFloat(string(val), 64)
+	err := manager.view(func(tx *bolt.Tx) error {
+		bucket, err := s.bucket(tx)
 		if err != nil {
 			return err
 		}
 
-		ts, err := strconv.ParseInt(string(key), 10, 64)
-		if err != nil {
-			return err
+		key, val := bucket.Cursor().Last()
+
+		// An empty series has no last item
+		if key == nil {
+			return nil
 		}
 
-		output = map[string]interface{}{
-			"ts":    ts,
-			"value": value,
+		output, err = seriesItem(key, val)
+		if err != nil {
+			return err
 		}
 
 		return nil
@@ -130,23 +176,22 @@ func (s *Series) Pop() (map[string]interface{}, error) {
 
 	var output map[string]interface{}
 
-	err := manager.conn.Update(func(tx *bolt.Tx) error {
-		cursor := tx.Bucket([]byte(s.Name)).Cursor()
-		key, val := cursor.Last()
-
-		value, err := strconv.ParseFloat(string(val), 64)
+	err := manager.update(func(tx *bolt.Tx) error {
+		bucket, err := s.bucket(tx)
 		if err != nil {
 			return err
 		}
 
-		ts, err := strconv.ParseInt(string(key), 10, 64)
-		if err != nil {
-			return err
+		cursor := bucket.Cursor()
+		key, val := cursor.Last()
+
+		if key == nil {
+			return nil
 		}
 
-		output = map[string]interface{}{
-			"ts":    ts,
-			"value": value,
+		output, err = seriesItem(key, val)
+		if err != nil {
+			return err
 		}
 
 		err = cursor.Delete()
@@ -164,94 +209,59 @@ func (s *Series) Pop() (map[string]interface{}, error) {
 // start and end time into a single floating point value
 func (s *Series) Compute(functionType FunctionType, start, end *time.Time) (float64, error) {
 
-	min := []byte(strconv.FormatInt(start.Unix(), 10))
-	max := []byte(strconv.FormatInt(end.Unix(), 10))
+	var points []seriesPoint
 
-	var resultArray []float64
-
-	err := manager.conn.View(func(tx *bolt.Tx) error {
-		c := tx.Bucket([]byte(s.Name)).Cursor()
+	err := manager.view(func(tx *bolt.Tx) error {
+		bucket, err := s.bucket(tx)
+		if err != nil {
+			return err
+		}
 
-		// Iterate over the min/max range
-		for k, v := c.Seek(min); k != nil && bytes.Compare(k, max) <= 0; k, v = c.Next() {
-			valueFloat, err := strconv.ParseFloat(string(v), 64)
-			if err != nil {
-				return err
-			}
-			resultArray = append(resultArray, valueFloat)
+		c := bucket.Cursor()
 
-		}
+		points, err = seriesPoints(c, start.UnixNano(), end.UnixNano())
 
-		return nil
+		return err
 	})
 
 	if err != nil {
 		return 0.0, err
 	}
 
-	// Do not compute if there are not any items
-	count := float64(len(resultArray))
-	if count < 1 {
-		return 0.0, nil
-	}
-
-	var minValue float64
-	var maxValue float64
-	var sum float64
+	return computeFunction(functionType, points)
+}
 
-	for i, v := range resultArray {
-		if i == 0 {
-			maxValue = v
-			minValue = v
-		}
+// Aggregate performs an aggregation over the contents of the series, first grouping
+// data by a given time period, then computing an operation of your choosing over each group
+func (s *Series) Aggregate(functionType FunctionType, aggregateInterval int, aggregateCount int, endTimePtr *time.Time) (interface{}, error) {
+	periods, err := s.aggregate(functionType, aggregateInterval, aggregateCount, endTimePtr)
+	if err != nil {
+		return nil, err
+	}
 
-		sum += v
-		if v > maxValue {
-			maxValue = v
-		}
+	output := []interface{}{}
 
-		if v < minValue {
-			minValue = v
-		}
+	for _, period := range periods {
+		output = append(output, map[string]interface{}{"ts": period.ts, "value": period.value})
 	}
 
-	avg := (sum / count)
-
-	switch functionType {
-	case Sum:
-		return sum, nil
-	case Avg:
-		return avg, nil
-	case Min:
-		return minValue, nil
-	case Max:
-		return maxValue, nil
-	case Count:
-		return count, nil
-	case StdDev:
-		// Standard deviation formula requires at least two values
-		if count < 2 {
-			return 0.0, nil
-		}
-		var StdDevSum float64
-		for _, v := range resultArray {
-			StdDevSum += math.Pow((v - avg), 2)
-		}
-		return math.Sqrt(StdDevSum / (count - 1)), nil
-	default:
-		return 0.0, fmt.Errorf("Unknown operation %d", functionType)
-	}
+	return interface{}(output), nil
+}
 
+// aggregatedPeriod is a period of an aggregation, with whether the series had any
+// samples in it
+type aggregatedPeriod struct {
+	ts      int64
+	value   float64
+	samples bool
 }
 
-// Aggregate performs an aggregation over the contents of the series, first grouping
-// data by a given time period, then computing an operation of your choosing over each group
-func (s *Series) Aggregate(functionType FunctionType, aggregateInterval int, aggregateCount int, endTimePtr *time.Time) (interface{}, error) {
+func (s *Series) aggregate(functionType FunctionType, aggregateInterval int, aggregateCount int, endTimePtr *time.Time) ([]aggregatedPeriod, error) {
 
 	interval := int64(aggregateInterval)
 	count := int64(aggregateCount)
 
-	output := []interface{}{}
+	output := []aggregatedPeriod{}
 
 	var startTime int64
 	var endTime int64
@@ -264,83 +274,99 @@ func (s *Series) Aggregate(functionType FunctionType, aggregateInterval int, agg
 
 	startTime = endTime - (interval * count)
 
-	err := manager.conn.View(func(tx *bolt.Tx) error {
-		c := tx.Bucket([]byte(s.Name)).Cursor()
+	tier := manager.rollupTierFor(functionType, interval)
+
+	err := manager.view(func(tx *bolt.Tx) error {
+		bucket, err := s.bucket(tx)
+		if err != nil {
+			return err
+		}
+
+		c := bucket.Cursor()
+
+		// Periods that have been compacted are read from the coarsest rollup tier
+		// that fits the interval, and the rest from the raw samples
+		var rollups *bolt.Bucket
+		var compacted int64
+
+		if tier != nil {
+			if seriesRollups := tx.Bucket([]byte(rollupsBucket)).Bucket([]byte(s.Name)); seriesRollups != nil {
+				var ok bool
+
+				if compacted, ok = rollupCompacted(seriesRollups, *tier); ok {
+					rollups = seriesRollups.Bucket(tier.name())
+				}
+			}
+		}
+
+		// Rates and deltas start from the last sample before each period
+		previous, err := previousPoint(c, rollups, (startTime+1)*int64(time.Second))
+		if err != nil {
+			return err
+		}
 
 		for i := 0; i < aggregateCount; i++ {
 
-			// Offset the min by 1 so that we are not counting the rollover in each iteration
-			min := []byte(strconv.FormatInt(startTime+1, 10))
+			// Offset the min by 1 so that we are not counting the rollover in each
+			// iteration. Samples count towards the second that they were taken in
+			min := (startTime + 1) * int64(time.Second)
+			bucketStart := startTime * int64(time.Second)
 			startTime += interval
-			max := []byte(strconv.FormatInt(startTime, 10))
+			bucketEnd := startTime * int64(time.Second)
+			max := bucketEnd + int64(time.Second) - 1
+
+			var value float64
 
-			var resultArray []float64
+			summary := seriesSummary{}
+			rawMin := min
+
+			if rollups != nil {
+				tierInterval := int64(tier.interval)
+
+				rollupsEnd := bucketEnd
+				if compacted < rollupsEnd {
+					rollupsEnd = compacted
+				}
 
-			// Iterate over the min/max range
-			for k, v := c.Seek(min); k != nil && bytes.Compare(k, max) <= 0; k, v = c.Next() {
-				valueFloat, err := strconv.ParseFloat(string(v), 64)
+				// The periods that end within the interval. Intervals that aren't
+				// aligned with the tier are rounded to its periods
+				err := forEachRollup(rollups, bucketStart-tierInterval+1, rollupsEnd-tierInterval+1, func(start int64, period seriesSummary) {
+					summary.merge(period)
+				})
 				if err != nil {
 					return err
 				}
-				resultArray = append(resultArray, valueFloat)
+
+				if compacted+rollupOffset > rawMin {
+					rawMin = compacted + rollupOffset
+				}
 			}
 
-			var value float64
+			points, err := seriesPoints(c, rawMin, max)
+			if err != nil {
+				return err
+			}
+
+			if _, ok := percentiles[functionType]; ok {
+				if value, err = computeFunction(functionType, points); err != nil {
+					return err
+				}
+			} else {
+				for _, p := range points {
+					summary.add(p)
+				}
 
-			// Only aggregate if there are items in the array
-			count := float64(len(resultArray))
-			if count > 0 {
-				var minValue float64
-				var maxValue float64
-				var sum float64
-
-				for i, v := range resultArray {
-					if i == 0 {
-						maxValue = v
-						minValue = v
-					}
-
-					sum += v
-					if v > maxValue {
-						maxValue = v
-					}
-
-					if v < minValue {
-						minValue = v
-					}
+				if value, err = summary.computePeriod(functionType, previous, bucketEnd-bucketStart); err != nil {
+					return err
 				}
 
-				avg := (sum / count)
-
-				switch functionType {
-				case Sum:
-					value = sum
-				case Avg:
-					value = avg
-				case Min:
-					value = minValue
-				case Max:
-					value = maxValue
-				case Count:
-					value = count
-				case StdDev:
-					// Standard deviation formula requies at least two values
-					if count > 1 {
-						var StdDevSum float64
-						for _, v := range resultArray {
-							StdDevSum += math.Pow((v - avg), 2)
-						}
-						value = math.Sqrt(StdDevSum / (count - 1))
-					} else {
-						value = 0.0
-					}
-				default:
-					return fmt.Errorf("Unknown operation %d", functionType)
+				if summary.count > 0 {
+					last := summary.last
+					previous = &last
 				}
-			} else {
-				value = 0.0
 			}
-			output = append(output, map[string]interface{}{"ts": startTime, "value": value})
+
+			output = append(output, aggregatedPeriod{ts: startTime, value: value, samples: summary.count > 0 || len(points) > 0})
 		}
 		return nil
 	})
@@ -349,32 +375,109 @@ func (s *Series) Aggregate(functionType FunctionType, aggregateInterval int, agg
 		return nil, err
 	}
 
-	return interface{}(output), nil
+	return output, nil
+}
+
+// previousPoint returns the last sample before ns, from the raw entries of a series
+// or, once those have expired, from its rollups, or nil if there is none
+func previousPoint(c *bolt.Cursor, rollups *bolt.Bucket, ns int64) (*seriesPoint, error) {
+	k, v := c.Seek(seriesTimeKey(ns))
+
+	if k == nil {
+		k, v = c.Last()
+	} else {
+		k, v = c.Prev()
+	}
+
+	if k != nil {
+		entryNs, err := seriesKeyTime(k)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := decodeSeriesValue(v)
+		if err != nil {
+			return nil, err
+		}
+
+		return &seriesPoint{ns: entryNs, value: value}, nil
+	}
+
+	if rollups == nil {
+		return nil, nil
+	}
+
+	rc := rollups.Cursor()
+
+	if k, v = rc.Seek(seriesTimeKey(ns)); k == nil {
+		k, v = rc.Last()
+	} else {
+		k, v = rc.Prev()
+	}
+
+	for ; k != nil; k, v = rc.Prev() {
+		summary, err := decodeSeriesSummary(v)
+		if err != nil {
+			return nil, err
+		}
+
+		// A period that isn't aligned with ns can end after it
+		if summary.count > 0 && summary.last.ns < ns {
+			return &summary.last, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// seriesPoints returns the entries between min and max, inclusive, as nanoseconds
+func seriesPoints(c *bolt.Cursor, min, max int64) ([]seriesPoint, error) {
+	var points []seriesPoint
+
+	for k, v := c.Seek(seriesTimeKey(min)); k != nil; k, v = c.Next() {
+		ns, err := seriesKeyTime(k)
+		if err != nil {
+			return nil, err
+		}
+
+		if ns > max {
+			break
+		}
+
+		value, err := decodeSeriesValue(v)
+		if err != nil {
+			return nil, err
+		}
+
+		points = append(points, seriesPoint{ns: ns, value: value})
+	}
+
+	return points, nil
 }
 
 // Items returns a given number returns a map of timestamp/value pairs
 func (s *Series) Items(count int) (interface{}, error) {
 	items := []interface{}{}
 
-	err := manager.conn.View(func(tx *bolt.Tx) error {
-		cursor := tx.Bucket([]byte(s.Name)).Cursor()
+	err := manager.view(func(tx *bolt.Tx) error {
+		bucket, err := s.bucket(tx)
+		if err != nil {
+			return err
+		}
+
+		cursor := bucket.Cursor()
 
 		key, val := cursor.Last()
 
 		for i := 1; i <= count; i++ {
 
 			if key != nil {
-				value, err := strconv.ParseFloat(string(val), 64)
+				item, err := seriesItem(key, val)
 				if err != nil {
 					return err
 				}
 
-				ts, err := strconv.ParseInt(string(key), 10, 64)
-				if err != nil {
-					return err
-				}
-
-				items = append(items, map[string]interface{}{"ts": ts, "value": value})
+				items = append(items, item)
 			}
 
 			key, val = cursor.Prev()
@@ -394,10 +497,15 @@ func (s *Series) Items(count int) (interface{}, error) {
 
 // TrimSince keeps series items since a given datetime and deletes all other entries
 func (s *Series) TrimSince(since time.Time) error {
-	max := []byte(strconv.FormatInt(since.Unix(), 10))
+	max := seriesTimeKey(since.UnixNano())
+
+	err := manager.update(func(tx *bolt.Tx) error {
+		bucket, err := s.bucket(tx)
+		if err != nil {
+			return err
+		}
 
-	err := manager.conn.Update(func(tx *bolt.Tx) error {
-		cursor := tx.Bucket([]byte(s.Name)).Cursor()
+		cursor := bucket.Cursor()
 
 		// Start by finding the closest value to our trim target
 		cursor.Seek(max)
@@ -422,8 +530,13 @@ func (s *Series) TrimSince(since time.Time) error {
 // TrimCount keeps a given number of series items and removes all other entries
 func (s *Series) TrimCount(count int) error {
 
-	err := manager.conn.Update(func(tx *bolt.Tx) error {
-		cursor := tx.Bucket([]byte(s.Name)).Cursor()
+	err := manager.update(func(tx *bolt.Tx) error {
+		bucket, err := s.bucket(tx)
+		if err != nil {
+			return err
+		}
+
+		cursor := bucket.Cursor()
 
 		k, _ := cursor.Last()
 
@@ -450,6 +563,128 @@ func (s *Series) TrimCount(count int) error {
 	return err
 }
 
+// ItemsBetween returns the timestamp/value pairs of the series between start and
+// end, inclusive, oldest first. A zero start or end leaves that side of the range
+// open. If count is positive, only the most recent count items are returned
+func (s *Series) ItemsBetween(start, end time.Time, count int) ([]interface{}, error) {
+	items := []interface{}{}
+
+	err := manager.view(func(tx *bolt.Tx) error {
+		bucket, err := s.bucket(tx)
+		if err != nil {
+			return err
+		}
+
+		cursor := bucket.Cursor()
+
+		var key, val []byte
+
+		// Step back from the first item past the end of the range
+		if end.IsZero() {
+			key, val = cursor.Last()
+		} else if key, _ = cursor.Seek(seriesTimeKey(end.UnixNano() + 1)); key == nil {
+			key, val = cursor.Last()
+		} else {
+			key, val = cursor.Prev()
+		}
+
+		for ; key != nil && (count <= 0 || len(items) < count); key, val = cursor.Prev() {
+			ns, err := seriesKeyTime(key)
+			if err != nil {
+				return err
+			}
+
+			if !start.IsZero() && ns < start.UnixNano() {
+				break
+			}
+
+			item, err := seriesItem(key, val)
+			if err != nil {
+				return err
+			}
+
+			items = append(items, item)
+		}
+
+		return nil
+	})
+
+	// Reverse the array since we pushed to it backwards
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+
+	return items, err
+}
+
+// Drop deletes the series along with its labels, retention and rollups
+func (s *Series) Drop() error {
+	return manager.update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(s.Name)); err != nil {
+			return err
+		}
+
+		for _, bucket := range []string{metadataBucket, rollupsBucket} {
+			if err := tx.Bucket([]byte(bucket)).DeleteBucket([]byte(s.Name)); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// LookupSeries returns a series if it exists, or nil otherwise. Unlike GetSeries,
+// it never creates the series
+func LookupSeries(name string) (*Series, error) {
+	if validateSeriesName(name) != nil {
+		return nil, nil
+	}
+
+	var series *Series
+
+	err := manager.view(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(name)) != nil {
+			series = &Series{Name: name}
+		}
+
+		return nil
+	})
+
+	return series, err
+}
+
+// SeriesInfo describes a series of the database
+type SeriesInfo struct {
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels"`
+	Retention Retention         `json:"retention"`
+}
+
+// ListSeries returns the name, labels and retention of every series, sorted by name
+func ListSeries() ([]SeriesInfo, error) {
+	res := []SeriesInfo{}
+
+	err := manager.view(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if bytes.HasPrefix(name, []byte("_")) {
+				return nil
+			}
+
+			labels, err := seriesLabels(tx, string(name))
+			if err != nil {
+				return err
+			}
+
+			res = append(res, SeriesInfo{Name: string(name), Labels: labels, Retention: manager.retention(tx, string(name))})
+
+			return nil
+		})
+	})
+
+	return res, err
+}
+
 // FindSeries takes a search string and returns an array of all bucket names that match the query
 // % is to be used on the left or right of the search string to declare it as a prefix or suffix
 func FindSeries(searchString string) ([]string, error) {
@@ -468,7 +703,7 @@ func FindSeries(searchString string) ([]string, error) {
 		searchSuffix = true
 	}
 
-	err := manager.conn.View(func(tx *bolt.Tx) error {
+	err := manager.view(func(tx *bolt.Tx) error {
 		err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
 
 			if bytes.HasPrefix(name, []byte("_")) {
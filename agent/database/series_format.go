@@ -0,0 +1,223 @@
+package database
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Series entries are keyed by their timestamp in nanoseconds, written big-endian
+// with the sign bit flipped so that keys sort in time order, followed by a sequence
+// number so that samples with the same timestamp don't overwrite each other.
+// Values are float64s, also written big-endian
+const (
+	seriesTimeLength  = 8
+	seriesKeyLength   = seriesTimeLength + 8
+	seriesValueLength = 8
+	seriesSignBit     = 1 << 63
+)
+
+// The version of the series format, as stored under `series_format` in `_config`.
+// Databases without it key their entries by decimal Unix timestamps, with the
+// values written as text
+const seriesFormatVersion = "2"
+
+// seriesTimeKey returns the part of the keys of the entries at a given time, in
+// nanoseconds, which is also the key to seek to for entries from that time on
+func seriesTimeKey(ns int64) []byte {
+	key := make([]byte, seriesTimeLength)
+	binary.BigEndian.PutUint64(key, uint64(ns)^seriesSignBit)
+
+	return key
+}
+
+func seriesKey(ns int64, sequence uint64) []byte {
+	key := make([]byte, seriesKeyLength)
+	binary.BigEndian.PutUint64(key, uint64(ns)^seriesSignBit)
+	binary.BigEndian.PutUint64(key[seriesTimeLength:], sequence)
+
+	return key
+}
+
+func seriesKeyTime(key []byte) (int64, error) {
+	if len(key) != seriesKeyLength {
+		return 0, fmt.Errorf("Invalid series key of %d bytes", len(key))
+	}
+
+	return int64(binary.BigEndian.Uint64(key) ^ seriesSignBit), nil
+}
+
+func encodeSeriesValue(value float64) []byte {
+	b := make([]byte, seriesValueLength)
+	binary.BigEndian.PutUint64(b, math.Float64bits(value))
+
+	return b
+}
+
+func decodeSeriesValue(b []byte) (float64, error) {
+	if len(b) != seriesValueLength {
+		return 0, fmt.Errorf("Invalid series value of %d bytes", len(b))
+	}
+
+	return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+}
+
+// seriesItem returns an entry as an item with its time in whole seconds, as `ts`,
+// and its value. Entries that aren't on a whole second also have `ts_nanos`, the
+// nanoseconds since `ts`
+func seriesItem(key, val []byte) (map[string]interface{}, error) {
+	ns, err := seriesKeyTime(key)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := decodeSeriesValue(val)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := time.Unix(0, ns)
+	item := map[string]interface{}{"ts": ts.Unix(), "value": value}
+
+	if ts.Nanosecond() > 0 {
+		item["ts_nanos"] = ts.Nanosecond()
+	}
+
+	return item, nil
+}
+
+// putSeriesEntry adds an entry to the bucket of a series
+func putSeriesEntry(bucket *bolt.Bucket, ns int64, value float64) error {
+	sequence, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(seriesKey(ns, sequence), encodeSeriesValue(value))
+}
+
+// migrateSeries rewrites the entries of the series of a database that predates the
+// current format. It runs when the database is opened, until every series has been
+// migrated. Each series is migrated in a transaction of its own, so that large
+// databases aren't rewritten all at once, and series that were migrated before an
+// interruption are skipped
+func (m *Manager) migrateSeries() error {
+	names := [][]byte{}
+	current := false
+
+	err := m.view(func(tx *bolt.Tx) error {
+		if string(tx.Bucket([]byte("_config")).Get([]byte("series_format"))) == seriesFormatVersion {
+			current = true
+			return nil
+		}
+
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if name[0] != '_' {
+				names = append(names, append([]byte{}, name...))
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil || current {
+		return err
+	}
+
+	migrated := 0
+
+	for _, name := range names {
+		err := m.update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(name)
+
+			if bucket == nil || !oldSeriesFormat(bucket) {
+				return nil
+			}
+
+			type entry struct {
+				ns    int64
+				value float64
+			}
+
+			entries := []entry{}
+
+			err := bucket.ForEach(func(k, v []byte) error {
+				ts, err := strconv.ParseInt(string(k), 10, 64)
+				if err != nil {
+					return fmt.Errorf("Unable to migrate the series `%s`: invalid timestamp %q", name, k)
+				}
+
+				value, err := strconv.ParseFloat(string(v), 64)
+				if err != nil {
+					return fmt.Errorf("Unable to migrate the series `%s`: invalid value %q", name, v)
+				}
+
+				entries = append(entries, entry{ns: ts * int64(time.Second), value: value})
+
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+
+			// The old keys sort differently, so the bucket is rebuilt instead of
+			// being updated in place
+			if err = tx.DeleteBucket(name); err != nil {
+				return err
+			}
+
+			if bucket, err = tx.CreateBucket(name); err != nil {
+				return err
+			}
+
+			for _, e := range entries {
+				if err = putSeriesEntry(bucket, e.ns, e.value); err != nil {
+					return err
+				}
+			}
+
+			migrated++
+
+			return nil
+		})
+
+		if err != nil {
+			if migrated > 0 {
+				m.Logf("Migrated %d series to the current storage format before failing", migrated)
+			}
+
+			return err
+		}
+	}
+
+	// The format is only recorded once every series has been migrated
+	err = m.update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("_config")).Put([]byte("series_format"), []byte(seriesFormatVersion))
+	})
+
+	if err == nil && migrated > 0 {
+		m.Logf("Migrated %d series to the current storage format", migrated)
+	}
+
+	return err
+}
+
+// oldSeriesFormat returns whether the entries of a series are keyed by decimal Unix
+// timestamps. Keys in the current format are never decimal numbers, since their
+// sequence numbers start with zero bytes
+func oldSeriesFormat(bucket *bolt.Bucket) bool {
+	k, _ := bucket.Cursor().First()
+
+	if k == nil {
+		return false
+	}
+
+	_, err := strconv.ParseInt(string(k), 10, 64)
+
+	return err == nil || len(k) != seriesKeyLength
+}
@@ -0,0 +1,150 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+)
+
+func TestSeriesMigration(t *testing.T) {
+	path, done := testDatabasePath(t)
+	defer done()
+
+	conn, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = conn.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("legacy"))
+		if err != nil {
+			return err
+		}
+
+		b.Put([]byte("999999999"), []byte("1.5E+00"))
+		b.Put([]byte("1000000000"), []byte("2E+00"))
+
+		return nil
+	})
+
+	conn.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.File{Data: config.DataConfig{DataLocation: path}}
+
+	if err := Init(cfg, make(chan error, 99999)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening the database again mustn't migrate it twice
+	Close()
+
+	if err := Init(cfg, make(chan error, 99999)); err != nil {
+		t.Fatal(err)
+	}
+
+	series, err := LookupSeries("legacy")
+	if err != nil || series == nil {
+		t.Fatalf("Expected the legacy series to exist, got %v (%v)", series, err)
+	}
+
+	items, err := series.ItemsBetween(time.Time{}, time.Time{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []map[string]interface{}{
+		{"ts": int64(999999999), "value": 1.5},
+		{"ts": int64(1000000000), "value": 2.0},
+	}
+
+	if len(items) != len(expected) {
+		t.Fatalf("Expected %d items, got %v", len(expected), items)
+	}
+
+	for index, item := range expected {
+		actual := items[index].(map[string]interface{})
+
+		if actual["ts"] != item["ts"] || actual["value"] != item["value"] {
+			t.Errorf("Expected item %d to be %v, got %v", index+1, item, actual)
+		}
+	}
+}
+
+func TestSeriesMigrationResumes(t *testing.T) {
+	path, done := testDatabasePath(t)
+	defer done()
+
+	legacy := func(fn func(tx *bolt.Tx) error) {
+		conn, err := bolt.Open(path, 0644, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer conn.Close()
+
+		if err = conn.Update(fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	legacy(func(tx *bolt.Tx) error {
+		for name, key := range map[string]string{"alpha": "1000000000", "broken": "yesterday"} {
+			b, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+
+			if err = b.Put([]byte(key), []byte("1E+00")); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	cfg := &config.File{Data: config.DataConfig{DataLocation: path}}
+
+	err := Init(cfg, make(chan error, 99999))
+
+	// Close releases the database even when it failed to open
+	Close()
+
+	if err == nil {
+		t.Fatal("Expected the migration of the broken series to fail")
+	}
+
+	// The series migrated before the failure are kept, but the format isn't
+	// recorded until every series has been migrated
+	legacy(func(tx *bolt.Tx) error {
+		if format := tx.Bucket([]byte("_config")).Get([]byte("series_format")); format != nil {
+			t.Errorf("Expected the series format not to be recorded, got %q", format)
+		}
+
+		if k, _ := tx.Bucket([]byte("alpha")).Cursor().First(); len(k) != seriesKeyLength {
+			t.Errorf("Expected the first series to be migrated, got the key %q", k)
+		}
+
+		return tx.DeleteBucket([]byte("broken"))
+	})
+
+	if err := Init(cfg, make(chan error, 99999)); err != nil {
+		t.Fatal(err)
+	}
+
+	defer Close()
+
+	series, err := LookupSeries("alpha")
+	if err != nil || series == nil {
+		t.Fatalf("Expected the series to exist, got %v (%v)", series, err)
+	}
+
+	if items, err := series.ItemsBetween(time.Time{}, time.Time{}, 10); err != nil || len(items) != 1 || items[0].(map[string]interface{})["value"] != 1.0 {
+		t.Errorf("Expected the migrated item to be kept, got %v (%v)", items, err)
+	}
+}
@@ -0,0 +1,83 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+)
+
+func TestSeriesPushMany(t *testing.T) {
+	defer openTestDatabase(t, config.DataConfig{})()
+
+	series, _, err := GetSeries("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, second := time.Unix(100, 0), time.Unix(200, 0)
+
+	if err := series.PushMany([]*time.Time{&first, &second}, []float64{1}); err == nil {
+		t.Errorf("Pushing more timestamps than values should fail")
+	}
+
+	if err := series.PushMany([]*time.Time{&second, &first, nil}, []float64{2, 1, 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := series.ItemsBetween(time.Time{}, time.Time{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 3 {
+		t.Fatalf("Expected 3 items, got %v", items)
+	}
+
+	for index, value := range []float64{1, 2, 3} {
+		if items[index].(map[string]interface{})["value"] != value {
+			t.Errorf("Expected item %d to be %v, got %v", index+1, value, items[index])
+		}
+	}
+}
+
+func TestSeriesRetentionCleanup(t *testing.T) {
+	defer openTestDatabase(t, config.DataConfig{TTL: "1h"})()
+
+	if manager.cleanupInterval != time.Hour {
+		t.Fatalf("Expected the cleanup to run every hour, got %s", manager.cleanupInterval)
+	}
+
+	series, _, err := GetSeries("short")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := series.SetRetention("2h"); err != nil {
+		t.Fatal(err)
+	}
+
+	if manager.cleanupInterval != time.Hour {
+		t.Errorf("A longer retention should not change the cleanup interval, got %s", manager.cleanupInterval)
+	}
+
+	if err := series.SetRetention("10m"); err != nil {
+		t.Fatal(err)
+	}
+
+	if manager.cleanupInterval != 10*time.Minute {
+		t.Errorf("Expected the cleanup to run every 10 minutes, got %s", manager.cleanupInterval)
+	}
+
+	// Retentions set before the database was opened are counted too
+	path := manager.path
+	Close()
+
+	if err := Init(&config.File{Data: config.DataConfig{DataLocation: path, TTL: "1h"}}, make(chan error, 99999)); err != nil {
+		t.Fatal(err)
+	}
+
+	if manager.cleanupInterval != 10*time.Minute {
+		t.Errorf("Expected the cleanup to run every 10 minutes after reopening, got %s", manager.cleanupInterval)
+	}
+}
@@ -0,0 +1,183 @@
+package job
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/telemetryapp/gotelemetry"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"github.com/telemetryapp/gotelemetry_agent/agent/lua"
+)
+
+// The time that an evaluated script may run for, unless the request sets a timeout
+const defaultEvalTimeout = 30 * time.Second
+
+// EvalRequest is a script to run without storing it. If a job is named, the script
+// runs with the job's arguments, credentials and script directory
+type EvalRequest struct {
+	Source  string                 `json:"source"`
+	Args    map[string]interface{} `json:"args"`
+	Job     string                 `json:"job"`
+	Timeout string                 `json:"timeout"`
+}
+
+// EvalResult is the outcome of an evaluated script. Flow updates, flow errors and
+// notifications are listed instead of being sent
+type EvalResult struct {
+	Output        map[string]interface{} `json:"output"`
+	Logs          []EvalLogEntry         `json:"logs"`
+	Flows         []EvalFlowUpdate       `json:"flows"`
+	Notifications []EvalNotification     `json:"notifications"`
+	Duration      float64                `json:"duration"`
+
+	// Error is either a *lua.ScriptError or a message
+	Error interface{} `json:"error,omitempty"`
+}
+
+// EvalLogEntry is an entry written by the script through telemetry/log
+type EvalLogEntry struct {
+	Level   string                 `json:"level"`
+	Message string                 `json:"message"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+}
+
+// EvalFlowUpdate is an update or error that the script would have sent to a flow
+type EvalFlowUpdate struct {
+	Tag string `json:"tag"`
+
+	// Type is named after the function of telemetry/flows: `replace`, `patch`,
+	// `json_patch` or `error`
+	Type  string      `json:"type"`
+	Data  interface{} `json:"data,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// EvalNotification is a notification that the script would have sent
+type EvalNotification struct {
+	Notification gotelemetry.Notification `json:"notification"`
+	Channel      string                   `json:"channel,omitempty"`
+	Flow         string                   `json:"flow,omitempty"`
+}
+
+// evalProvider records everything that a script publishes. Flows are still read
+// from the Telemetry API with the credentials of the job
+type evalProvider struct {
+	job    *Job
+	result *EvalResult
+}
+
+func (p *evalProvider) ReadFlow(tag string) (interface{}, error) {
+	return p.job.ReadFlow(tag)
+}
+
+func (p *evalProvider) UpdateFlow(tag string, data interface{}, updateType gotelemetry.BatchType) error {
+	flowUpdateType := "replace"
+
+	switch updateType {
+	case gotelemetry.BatchTypePATCH:
+		flowUpdateType = "patch"
+
+	case gotelemetry.BatchTypeJSONPATCH:
+		flowUpdateType = "json_patch"
+	}
+
+	p.result.Flows = append(p.result.Flows, EvalFlowUpdate{Tag: tag, Type: flowUpdateType, Data: data})
+
+	return nil
+}
+
+func (p *evalProvider) SetFlowError(tag string, message string) error {
+	p.result.Flows = append(p.result.Flows, EvalFlowUpdate{Tag: tag, Type: "error", Error: message})
+
+	return nil
+}
+
+// CreateFlow returns a placeholder for the flow, without creating it
+func (p *evalProvider) CreateFlow(tag string, variant string, template interface{}) (*gotelemetry.Flow, error) {
+	return &gotelemetry.Flow{Tag: tag, Variant: variant}, nil
+}
+
+func (p *evalProvider) SendNotification(n gotelemetry.Notification, channelTag string, flowTag string) bool {
+	p.result.Notifications = append(p.result.Notifications, EvalNotification{Notification: n, Channel: channelTag, Flow: flowTag})
+
+	return false
+}
+
+func (p *evalProvider) Log(level string, message string, fields map[string]interface{}) {
+	p.result.Logs = append(p.result.Logs, EvalLogEntry{Level: level, Message: message, Fields: fields})
+}
+
+// EvalScript runs a script that isn't stored anywhere, such as a change being
+// previewed in an editor. Errors in the request are returned, while errors of the
+// script are reported in the result. The script can't write to the storage or to
+// SQL databases
+func EvalScript(request EvalRequest) (*EvalResult, error) {
+	timeout := defaultEvalTimeout
+
+	if request.Timeout != "" {
+		var err error
+
+		if timeout, err = config.ParseTimeInterval(request.Timeout); err != nil {
+			return nil, err
+		}
+	}
+
+	description := config.Job{ID: "eval"}
+	scriptDir := ""
+
+	if request.Job != "" {
+		foundJob, found := jobManager.jobs[request.Job]
+
+		if !found {
+			return nil, fmt.Errorf("Job not found: %s", request.Job)
+		}
+
+		description = foundJob.config
+
+		if foundJob.instance.script != nil && foundJob.instance.script.filePath != "" {
+			scriptDir = filepath.Dir(foundJob.instance.script.filePath)
+		}
+	}
+
+	args := request.Args
+
+	if args == nil {
+		args = scriptArguments(description.Args)
+	}
+
+	args, err := applyArgsSchema(description, request.Source, args)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p := &evalProvider{
+		job: &Job{
+			id:          description.ID,
+			credentials: jobManager.credentials,
+			logger:      newJobLogger(description.ID, jobManager.errorChannel),
+			config:      description,
+		},
+		result: &EvalResult{
+			Logs:          []EvalLogEntry{},
+			Flows:         []EvalFlowUpdate{},
+			Notifications: []EvalNotification{},
+		},
+	}
+
+	start := time.Now()
+
+	output, err := lua.Eval(request.Source, scriptDir, p, args, timeout)
+
+	p.result.Output = output
+	p.result.Duration = time.Since(start).Seconds()
+
+	if scriptErr, ok := err.(*lua.ScriptError); ok {
+		p.result.Error = scriptErr
+	} else if err != nil {
+		p.result.Error = err.Error()
+	}
+
+	return p.result, nil
+}
@@ -3,13 +3,16 @@
 package job
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"sort"
 
 	log "github.com/mgutz/logxi/v1"
 	"github.com/telemetryapp/gotelemetry"
 	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"github.com/telemetryapp/gotelemetry_agent/agent/lua"
 )
 
 // Job is a unit of work that the Agent manages. Jobs manage their own
@@ -25,12 +28,12 @@ type Job struct {
 }
 
 // newJob creates and starts a new Job
-func newJob(credentials gotelemetry.Credentials, stream *gotelemetry.BatchStream, id string, config config.Job, jobCompletionChannel chan string, wait bool) (*Job, error) {
+func newJob(credentials gotelemetry.Credentials, stream *gotelemetry.BatchStream, id string, config config.Job, errorChannel chan error, jobCompletionChannel chan string, wait bool) (*Job, error) {
 	result := &Job{
 		id:                id,
 		credentials:       credentials,
 		stream:            stream,
-		logger:            log.New("job-" + id),
+		logger:            newJobLogger(id, errorChannel),
 		config:            config,
 		completionChannel: jobCompletionChannel,
 	}
@@ -125,6 +128,12 @@ func (j *Job) queueDataUpdate(tag string, data interface{}, updateType gotelemet
 // reportError sends a formatted error to the agent's global error log. This should be
 // a plugin's preferred error reporting method when running.
 func (j *Job) reportError(err error) {
+	// Script errors are logged with their cause, source and traceback
+	if scriptErr, ok := err.(*lua.ScriptError); ok {
+		j.logger.Error(j.id + ": -> " + scriptErr.Report())
+		return
+	}
+
 	j.logger.Error(j.id + ": -> " + err.Error())
 }
 
@@ -132,15 +141,82 @@ func (j *Job) reportError(err error) {
 func (j *Job) setFlowError(tag string, body interface{}) {
 	j.debugf("Setting error status on flow %s", tag)
 
+	if config.CLIConfig.DebugMode == true {
+		j.logf("Debug mode: not setting the error status on flow %s", tag)
+		return
+	}
+
 	if err := gotelemetry.SetFlowError(j.credentials, tag, body); err != nil {
 		j.reportError(err)
 	}
 }
 
-// SendNotification pings the Telemetry API with a notification to a particular flow or channel
+// ReadFlow retrieves the data currently stored on the Telemetry API for a flow
+func (j *Job) ReadFlow(tag string) (interface{}, error) {
+	data := map[string]interface{}{}
+
+	f := &gotelemetry.Flow{Tag: tag, Data: &data}
+
+	if err := f.Read(j.credentials); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// UpdateFlow queues an update to a flow on the job's batch stream. In debug mode,
+// the update is logged instead of being sent
+func (j *Job) UpdateFlow(tag string, data interface{}, updateType gotelemetry.BatchType) error {
+	if config.CLIConfig.DebugMode == true {
+		jsonOutput, err := json.MarshalIndent(data, "", "  ")
+
+		if err != nil {
+			return err
+		}
+
+		j.logf("Debug mode: update to flow %s:\n%s", tag, jsonOutput)
+		return nil
+	}
+
+	j.queueDataUpdate(tag, data, updateType)
+
+	return nil
+}
+
+// SetFlowError sets a given flow to the error state with a message. In debug mode,
+// the error is logged instead of being sent
+func (j *Job) SetFlowError(tag string, message string) error {
+	j.debugf("Setting error status on flow %s", tag)
+
+	if config.CLIConfig.DebugMode == true {
+		j.logf("Debug mode: error on flow %s: %s", tag, message)
+		return nil
+	}
+
+	return gotelemetry.SetFlowError(j.credentials, tag, map[string]interface{}{"message": message})
+}
+
+// CreateFlow returns the flow with the given tag, creating it from the template if needed.
+// In debug mode, the API is not contacted and a placeholder flow is returned
+func (j *Job) CreateFlow(tag string, variant string, template interface{}) (*gotelemetry.Flow, error) {
+	if config.CLIConfig.DebugMode == true {
+		j.logf("Debug mode: not creating flow %s of type %s", tag, variant)
+		return &gotelemetry.Flow{Tag: tag, Variant: variant}, nil
+	}
+
+	return j.getOrCreateFlow(tag, variant, template)
+}
+
+// SendNotification pings the Telemetry API with a notification to a particular flow or channel.
+// In debug mode, the notification is logged instead of being sent
 func (j *Job) SendNotification(notification gotelemetry.Notification, channelTag string, flowTag string) bool {
 	var err error
 
+	if config.CLIConfig.DebugMode == true {
+		j.logf("Debug mode: not sending notification %#v", notification)
+		return false
+	}
+
 	if len(channelTag) > 0 {
 		channel := gotelemetry.NewChannel(channelTag)
 		err = channel.SendNotification(j.credentials, notification)
@@ -158,23 +234,55 @@ func (j *Job) SendNotification(notification gotelemetry.Notification, channelTag
 	return false
 }
 
+// Log records an entry from a script at the given level (debug, info, warn or error)
+// along with a set of fields, attaching the ID of the job
+func (j *Job) Log(level string, message string, fields map[string]interface{}) {
+	keys := make([]string, 0, len(fields))
+
+	for key := range fields {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	args := []interface{}{"job", j.id}
+
+	for _, key := range keys {
+		args = append(args, key, fields[key])
+	}
+
+	switch level {
+	case "debug":
+		j.logger.Debug(message, args...)
+
+	case "warn":
+		j.logger.Warn(message, args...)
+
+	case "error":
+		j.logger.Error(message, args...)
+
+	default:
+		j.logger.Info(message, args...)
+	}
+}
+
 // log sends data to the agent's global log. It works like log.Log
 func (j *Job) log(v ...interface{}) {
 	if j.logger.IsInfo() {
-		j.logger.Info(fmt.Sprint(v))
+		j.logger.Info(fmt.Sprint(v...))
 	}
 }
 
 // logf sends a formatted string to the agent's global log. It works like log.Logf
 func (j *Job) logf(format string, v ...interface{}) {
 	if j.logger.IsInfo() {
-		j.logger.Info(fmt.Sprintf(format, v))
+		j.logger.Info(fmt.Sprintf(format, v...))
 	}
 }
 
 // debugf sends a formatted string to the agent's debug log, if it exists. It works like log.Logf
 func (j *Job) debugf(format string, v ...interface{}) {
 	if j.logger.IsDebug() {
-		j.logger.Debug(fmt.Sprintf(format, v))
+		j.logger.Debug(fmt.Sprintf(format, v...))
 	}
 }
@@ -0,0 +1,81 @@
+package job
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	log "github.com/mgutz/logxi/v1"
+	"github.com/telemetryapp/gotelemetry"
+)
+
+// errorChannelFormatter is a logxi formatter that forwards entries to the Agent's
+// error channel, so that job logs are filtered by --verbosity and show up in the
+// /logs buffer and stream like the rest of the Agent's output
+type errorChannelFormatter struct {
+	errorChannel chan error
+}
+
+// newJobLogger creates the logxi logger for a job. Without an error channel, the
+// logger falls back to logxi's own output
+func newJobLogger(id string, errorChannel chan error) log.Logger {
+	if errorChannel == nil {
+		return log.New("job-" + id)
+	}
+
+	logger := log.NewLogger3(nil, "job-"+id, &errorChannelFormatter{errorChannel: errorChannel})
+
+	// Filtering happens when the entries are received from the channel
+	logger.SetLevel(log.LevelAll)
+
+	return logger
+}
+
+// Format converts a log entry and its key/value pairs into an error with the
+// matching log level
+func (f *errorChannelFormatter) Format(writer io.Writer, level int, msg string, args []interface{}) {
+	message := msg
+
+	if level == log.LevelWarn {
+		message = "Warning: " + message
+	}
+
+	if fields := formatLogFields(args); fields != "" {
+		message += " " + fields
+	}
+
+	switch {
+	case level >= log.LevelDebug:
+		f.errorChannel <- gotelemetry.NewDebugError("%s", message)
+
+	case level >= log.LevelWarn:
+		f.errorChannel <- gotelemetry.NewLogError("%s", message)
+
+	default:
+		f.errorChannel <- gotelemetry.NewErrorWithFormat(-1, "%s", nil, message)
+	}
+}
+
+// formatLogFields formats a list of alternating keys and values as key=value pairs
+func formatLogFields(args []interface{}) string {
+	pairs := []string{}
+
+	for i := 0; i < len(args); i += 2 {
+		key := fmt.Sprint(args[i])
+
+		if i+1 >= len(args) {
+			pairs = append(pairs, key)
+			break
+		}
+
+		value := fmt.Sprint(args[i+1])
+
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+
+		pairs = append(pairs, key+"="+value)
+	}
+
+	return strings.Join(pairs, " ")
+}
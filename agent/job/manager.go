@@ -14,6 +14,7 @@ type manager struct {
 	jobs                 map[string]*Job
 	credentials          gotelemetry.Credentials
 	accountStreams       map[string]*gotelemetry.BatchStream
+	errorChannel         chan error
 	completionChannel    chan bool
 	jobCompletionChannel chan string
 	submissionInterval   time.Duration
@@ -25,6 +26,7 @@ var jobManager *manager
 func Init(jobConfig config.Interface, errorChannel chan error, completionChannel chan bool) error {
 	jobManager = &manager{
 		jobs:                 map[string]*Job{},
+		errorChannel:         errorChannel,
 		completionChannel:    completionChannel,
 		jobCompletionChannel: make(chan string),
 	}
@@ -117,7 +119,7 @@ func (m *manager) createJob(jobDescription *config.Job, wait bool) error {
 		m.accountStreams[channelTag] = accountStream
 	}
 
-	job, err := newJob(m.credentials, accountStream, jobDescription.ID, *jobDescription, m.jobCompletionChannel, wait)
+	job, err := newJob(m.credentials, accountStream, jobDescription.ID, *jobDescription, m.errorChannel, m.jobCompletionChannel, wait)
 	if err != nil {
 		return err
 	}
@@ -239,12 +241,20 @@ func AddScript(id string, scriptSource string) error {
 			return fmt.Errorf("An executable already exists so a script cannot be added to : %s", id)
 		}
 
+		// The new script may declare different arguments
+		args, err := applyArgsSchema(foundJob.config, scriptSource, scriptArguments(foundJob.config.Args))
+
+		if err != nil {
+			return err
+		}
+
 		// Script already exists. Update
 		if foundJob.instance.script != nil {
 
 			// External script. Write to the file. Exit and do not update database
 			if len(foundJob.instance.script.filePath) > 0 {
 				err := foundJob.instance.script.UpdateExternalScript(scriptSource)
+				foundJob.instance.script.args = args
 				return err
 			}
 
@@ -253,6 +263,7 @@ func AddScript(id string, scriptSource string) error {
 
 		// No script has been set. Create a new one
 		foundJob.instance.script = newScriptFromSource(scriptSource)
+		foundJob.instance.script.args = args
 	}
 
 	// Network latency may cause the script to be added before the job is created
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -71,17 +72,17 @@ func newInstance(job *Job) (*processPlugin, error) {
 	scriptArgs := map[string]interface{}{}
 
 	if args, ok := c.Args.([]interface{}); ok {
-		for _, arg := range args {
-			if a, ok := arg.(string); ok {
-				p.args = append(p.args, a)
-			} else {
-				p.args = append(p.args, fmt.Sprintf("%#v", arg))
+		for index, arg := range args {
+			a, err := execArgument(arg)
+
+			if err != nil {
+				return nil, fmt.Errorf("Argument %d %s", index+1, err)
 			}
+
+			p.args = append(p.args, a)
 		}
-	} else if args, ok := c.Args.(map[interface{}]interface{}); ok {
-		scriptArgs = config.MapTemplate(args).(map[string]interface{})
-	} else if args, ok := c.Args.(map[string]interface{}); ok {
-		scriptArgs = args
+	} else {
+		scriptArgs = scriptArguments(c.Args)
 	}
 
 	if exec != "" {
@@ -95,6 +96,10 @@ func newInstance(job *Job) (*processPlugin, error) {
 			return nil, errors.New("You cannot specify a key/value hash of arguments when executing an external process. Provide an array of arguments instead.")
 		}
 
+		if len(c.ArgsSchema) != 0 {
+			return nil, errors.New("An `args_schema` can only be used with scripts.")
+		}
+
 	} else if script != "" {
 		var err error
 		p.script, err = newScriptFromPath(c.Script, scriptArgs)
@@ -107,6 +112,25 @@ func newInstance(job *Job) (*processPlugin, error) {
 		p.script = newScriptFromSource(scriptSource)
 	}
 
+	if exec == "" {
+		source := ""
+
+		if p.script != nil {
+			source = p.script.source
+		}
+
+		// The arguments are checked even if the script is yet to be added
+		args, err := applyArgsSchema(c, source, scriptArgs)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if p.script != nil {
+			p.script.args = args
+		}
+	}
+
 	template := c.Template
 	variant := c.Variant
 
@@ -405,3 +429,40 @@ func (p *processPlugin) terminate() {
 func (p *processPlugin) trackTime(job *Job, start time.Time, template string) {
 	job.logf(template, time.Since(start))
 }
+
+// execArgument formats an argument of an external process. Only strings, numbers and
+// booleans can be passed on the command line
+func execArgument(arg interface{}) (string, error) {
+	switch a := arg.(type) {
+	case string:
+		return a, nil
+
+	case int64:
+		return strconv.FormatInt(a, 10), nil
+
+	case int:
+		return strconv.Itoa(a), nil
+
+	case float64:
+		return strconv.FormatFloat(a, 'f', -1, 64), nil
+
+	case bool:
+		return strconv.FormatBool(a), nil
+	}
+
+	return "", errors.New("must be a string, number or boolean")
+}
+
+// scriptArguments returns the key/value arguments of a job, which are passed to
+// its script in the args global
+func scriptArguments(args interface{}) map[string]interface{} {
+	switch a := args.(type) {
+	case map[interface{}]interface{}:
+		return config.MapTemplate(a).(map[string]interface{})
+
+	case map[string]interface{}:
+		return a
+	}
+
+	return map[string]interface{}{}
+}
@@ -0,0 +1,223 @@
+package job
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/peterh/liner"
+	"github.com/telemetryapp/gotelemetry"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"github.com/telemetryapp/gotelemetry_agent/agent/database"
+	"github.com/telemetryapp/gotelemetry_agent/agent/lua"
+)
+
+const replHistoryFile = ".telemetry_agent_history"
+
+// RunREPL opens an interactive Lua session on the terminal. If a job ID is provided,
+// the session starts with the job's arguments and resolves files relative to its
+// script. Flow updates, flow errors, notifications and logs are printed after each
+// evaluation instead of being sent
+func RunREPL(jobConfig config.Interface, errorChannel chan error, jobID string) error {
+	description := config.Job{ID: "repl"}
+
+	if jobID != "" {
+		d, err := findJobDescription(jobConfig, jobID)
+
+		if err != nil {
+			return err
+		}
+
+		description = *d
+	}
+
+	j := &Job{
+		id:     description.ID,
+		logger: newJobLogger(description.ID, errorChannel),
+		config: description,
+	}
+
+	// Without an API token, the session still works, but cannot read flows
+	if apiToken := jobConfig.APIToken(); len(apiToken) > 0 {
+		credentials, err := gotelemetry.NewCredentials(apiToken, jobConfig.APIURL())
+
+		if err != nil {
+			return err
+		}
+
+		j.credentials = credentials
+	}
+
+	scriptDir := ""
+	scriptSource := database.GetScript(description.ID)
+
+	if description.Script != "" {
+		scriptDir = filepath.Dir(description.Script)
+
+		b, err := ioutil.ReadFile(description.Script)
+
+		if err != nil {
+			return err
+		}
+
+		scriptSource = string(b)
+	}
+
+	args, err := applyArgsSchema(description, scriptSource, scriptArguments(description.Args))
+
+	if err != nil {
+		return err
+	}
+
+	p := &evalProvider{job: j, result: &EvalResult{}}
+
+	session, err := lua.NewSession(scriptDir, p, args)
+
+	if err != nil {
+		return err
+	}
+
+	defer session.Close()
+
+	line := liner.NewLiner()
+	defer line.Close()
+
+	line.SetCtrlCAborts(true)
+
+	historyPath := replHistoryFile
+
+	if home := os.Getenv("HOME"); home != "" {
+		historyPath = filepath.Join(home, replHistoryFile)
+	}
+
+	if f, err := os.Open(historyPath); err == nil {
+		line.ReadHistory(f)
+		f.Close()
+	}
+
+	defer func() {
+		if f, err := os.Create(historyPath); err == nil {
+			line.WriteHistory(f)
+			f.Close()
+		}
+	}()
+
+	fmt.Println("Type Lua statements or expressions to evaluate them. Press Ctrl-D to exit.")
+
+	source := ""
+
+	for {
+		prompt := "> "
+
+		if source != "" {
+			prompt = ">> "
+		}
+
+		input, err := line.Prompt(prompt)
+
+		if err == liner.ErrPromptAborted {
+			source = ""
+			continue
+		}
+
+		if err == io.EOF {
+			fmt.Println()
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if source == "" && strings.TrimSpace(input) == "" {
+			continue
+		}
+
+		source += input
+
+		result, err := session.Eval(source)
+
+		if err == lua.ErrIncompleteInput {
+			source += "\n"
+			continue
+		}
+
+		printEvalRecords(p.result)
+		p.result = &EvalResult{}
+
+		line.AppendHistory(strings.Replace(source, "\n", " ", -1))
+		source = ""
+
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		if result != "" {
+			fmt.Println(result)
+		}
+	}
+}
+
+// printEvalRecords prints what a REPL evaluation published, in the order of the
+// fields of EvalResult
+func printEvalRecords(result *EvalResult) {
+	for _, entry := range result.Logs {
+		fmt.Printf("[%s] %s", entry.Level, entry.Message)
+
+		if len(entry.Fields) > 0 {
+			if fields, err := json.Marshal(entry.Fields); err == nil {
+				fmt.Printf(" %s", fields)
+			}
+		}
+
+		fmt.Println()
+	}
+
+	for _, update := range result.Flows {
+		if update.Type == "error" {
+			fmt.Printf("Flow \"%s\" (error): %s\n", update.Tag, update.Error)
+			continue
+		}
+
+		if data, err := json.MarshalIndent(update.Data, "", "  "); err == nil {
+			fmt.Printf("Flow \"%s\" (%s):\n%s\n", update.Tag, update.Type, data)
+		}
+	}
+
+	for _, notification := range result.Notifications {
+		target := "channel \"" + notification.Channel + "\""
+
+		if notification.Channel == "" {
+			target = "flow \"" + notification.Flow + "\""
+		}
+
+		if data, err := json.MarshalIndent(notification.Notification, "", "  "); err == nil {
+			fmt.Printf("Notification to %s:\n%s\n", target, data)
+		}
+	}
+}
+
+// findJobDescription looks a job up by ID (or tag, for jobs without an ID) in the
+// configuration file first, and then in the database
+func findJobDescription(jobConfig config.Interface, jobID string) (*config.Job, error) {
+	jobsDatabase, _ := database.GetAllJobs()
+
+	for _, jobs := range [][]config.Job{jobConfig.Jobs(), jobsDatabase} {
+		for _, description := range jobs {
+			if description.ID == "" {
+				description.ID = description.Tag
+			}
+
+			if description.ID == jobID {
+				return &description, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("The job `%s` could not be found", jobID)
+}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/telemetryapp/gotelemetry_agent/agent/config"
@@ -62,6 +63,18 @@ func newScriptFromSource(source string) *script {
 	return s
 }
 
+// applyArgsSchema validates the arguments of a job's script against the schema of the
+// job and the one declared in the script's header, and fills in their defaults
+func applyArgsSchema(c config.Job, source string, args map[string]interface{}) (map[string]interface{}, error) {
+	schema, err := lua.ScriptArgsSchema(source)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return schema.Merge(c.ArgsSchema).Apply(args)
+}
+
 func (s *script) UpdateExternalScript(source string) error {
 	buf := new(bytes.Buffer)
 
@@ -79,7 +92,15 @@ func (s *script) UpdateExternalScript(source string) error {
 }
 
 func (s *script) exec(j *Job) (string, error) {
-	output, err := lua.Exec(s.source, j, s.args)
+	var dir string
+
+	// Scripts stored in the database have no path, so their files are
+	// resolved relative to the working directory
+	if s.filePath != "" {
+		dir = filepath.Dir(s.filePath)
+	}
+
+	output, err := lua.Exec(s.source, dir, j, s.args)
 
 	if err != nil {
 		return "", err
@@ -0,0 +1,132 @@
+package lua
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+)
+
+// ScriptArgsSchema reads the arguments declared by the comments at the top of a
+// script, with one `@arg name type [required] [default=value] [enum=a,b,c]` per line:
+//
+//   -- @arg url string required
+//   -- @arg days integer default=7
+//   -- @arg region string enum=eu,us default=eu
+//
+// Values that contain spaces or commas can be quoted, and the defaults of lists
+// and tables are written as JSON
+func ScriptArgsSchema(source string) (config.ArgsSchema, error) {
+	schema := config.ArgsSchema{}
+
+	for index, line := range strings.Split(source, "\n") {
+		line = strings.TrimSpace(line)
+
+		if line == "" {
+			continue
+		}
+
+		// The header ends with the first line of code
+		if !strings.HasPrefix(line, "--") {
+			break
+		}
+
+		text := strings.TrimSpace(strings.TrimLeft(line, "-"))
+
+		if !strings.HasPrefix(text, "@arg ") {
+			continue
+		}
+
+		fields := splitQuoted(strings.TrimPrefix(text, "@arg "), unicode.IsSpace)
+
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("Invalid argument declaration on line %d: a name and a type are required", index+1)
+		}
+
+		name := fields[0]
+		arg := config.ArgSchema{Type: fields[1]}
+
+		for _, option := range fields[2:] {
+			switch {
+			case option == "required":
+				arg.Required = true
+
+			case strings.HasPrefix(option, "default="):
+				value := strings.TrimPrefix(option, "default=")
+
+				if arg.Type == "list" || arg.Type == "table" {
+					if err := json.Unmarshal([]byte(value), &arg.Default); err != nil {
+						return nil, fmt.Errorf("Invalid default for the argument `%s` on line %d: %s", name, index+1, err)
+					}
+				} else {
+					arg.Default = unquote(value)
+				}
+
+			case strings.HasPrefix(option, "enum="):
+				for _, value := range splitQuoted(strings.TrimPrefix(option, "enum="), func(r rune) bool { return r == ',' }) {
+					arg.Enum = append(arg.Enum, unquote(value))
+				}
+
+			default:
+				return nil, fmt.Errorf("Unknown option `%s` for the argument `%s` on line %d", option, name, index+1)
+			}
+		}
+
+		schema[name] = arg
+	}
+
+	return schema, schema.Validate()
+}
+
+// splitQuoted splits a string at the runes matched by isSeparator, except within
+// double quotes. Quotes escaped with a backslash don't end a quoted part
+func splitQuoted(s string, isSeparator func(rune) bool) []string {
+	fields := []string{}
+	field := ""
+	quoted := false
+	escaped := false
+
+	for _, r := range s {
+		if escaped {
+			escaped = false
+		} else if r == '\\' && quoted {
+			escaped = true
+		} else if r == '"' {
+			quoted = !quoted
+		}
+
+		if isSeparator(r) && !quoted {
+			if field != "" {
+				fields = append(fields, field)
+			}
+
+			field = ""
+			continue
+		}
+
+		field += string(r)
+	}
+
+	if field != "" {
+		fields = append(fields, field)
+	}
+
+	return fields
+}
+
+// unquote removes the double quotes around a value and the escapes within them.
+// Values that aren't quoted are kept as they are
+func unquote(s string) string {
+	if len(s) < 2 || !strings.HasPrefix(s, `"`) || !strings.HasSuffix(s, `"`) {
+		return s
+	}
+
+	if value, err := strconv.Unquote(s); err == nil {
+		return value
+	}
+
+	return s[1 : len(s)-1]
+}
@@ -1,7 +1,10 @@
 package lua
 
 import (
+	"strconv"
+
 	"github.com/telemetryapp/go-lua"
+	"github.com/telemetryapp/goluago/util"
 )
 
 func pushArray(l *lua.State) {
@@ -12,3 +15,85 @@ func pushArray(l *lua.State) {
 	l.SetField(-2, arrayMarkerField)
 	l.SetMetaTable(-2)
 }
+
+// pullTable works like util.PullTable, but also converts plain Lua sequences
+// (tables whose keys are exactly 1..n) into slices
+func pullTable(l *lua.State, index int) (interface{}, error) {
+	v, err := util.PullTable(l, index)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sequencesToSlices(v), nil
+}
+
+func sequencesToSlices(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		if arr, ok := sequenceToSlice(value); ok {
+			return sequencesToSlices(arr)
+		}
+
+		for key, item := range value {
+			value[key] = sequencesToSlices(item)
+		}
+
+		return value
+
+	case []interface{}:
+		for index, item := range value {
+			value[index] = sequencesToSlices(item)
+		}
+
+		return value
+
+	default:
+		return v
+	}
+}
+
+func sequenceToSlice(m map[string]interface{}) ([]interface{}, bool) {
+	if len(m) == 0 {
+		return nil, false
+	}
+
+	arr := make([]interface{}, len(m))
+
+	for key, value := range m {
+		index, err := strconv.Atoi(key)
+
+		if err != nil || index < 1 || index > len(m) {
+			return nil, false
+		}
+
+		arr[index-1] = value
+	}
+
+	return arr, true
+}
+
+// pushValue pushes a value pulled from Lua or decoded from JSON, marking lists as
+// arrays so that they are submitted as JSON arrays
+func pushValue(l *lua.State, value interface{}) {
+	switch v := value.(type) {
+	case []interface{}:
+		pushArray(l)
+
+		for index, item := range v {
+			pushValue(l, item)
+			l.RawSetInt(-2, index+1)
+		}
+
+	case map[string]interface{}:
+		l.NewTable()
+
+		for key, item := range v {
+			pushValue(l, item)
+			l.SetField(-2, key)
+		}
+
+	default:
+		util.DeepPush(l, v)
+	}
+}
@@ -0,0 +1,328 @@
+package lua
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/telemetryapp/go-lua"
+)
+
+// The name scripts are loaded under, which is how their frames appear in tracebacks
+const scriptChunkName = "script"
+
+// The registry field where raiseError keeps the Go error behind the last Lua error
+const goErrorField = "_go_error"
+
+// The number of lines shown on each side of the failing line
+const sourceContextLines = 2
+
+var (
+	errorPositionRegex = regexp.MustCompile(`^=?` + scriptChunkName + `:(\d+): `)
+	secretArgRegex     = regexp.MustCompile(`(?i)pass|secret|token|key`)
+)
+
+// ScriptError describes a script that failed to compile or run. It is marshalled
+// as is by the API, while Report formats it for the log
+type ScriptError struct {
+	// Kind is either `syntax` or `runtime`
+	Kind      string                 `json:"kind"`
+	Message   string                 `json:"message"`
+	Chunk     string                 `json:"chunk"`
+	Line      int                    `json:"line"`
+	Source    []SourceLine           `json:"source,omitempty"`
+	Traceback []StackFrame           `json:"traceback,omitempty"`
+	Cause     *ErrorCause            `json:"cause,omitempty"`
+	Args      map[string]interface{} `json:"args,omitempty"`
+}
+
+// SourceLine is one of the lines of the script around the failing line
+type SourceLine struct {
+	Line    int    `json:"line"`
+	Text    string `json:"text"`
+	Current bool   `json:"current,omitempty"`
+}
+
+// StackFrame is an entry of a traceback, starting from the innermost call
+type StackFrame struct {
+	Function string `json:"function"`
+	Source   string `json:"source"`
+	Line     int    `json:"line,omitempty"`
+}
+
+// ErrorCause is the Go error that made a telemetry/* function raise a Lua error
+type ErrorCause struct {
+	Function string `json:"function,omitempty"`
+	Type     string `json:"type"`
+	Message  string `json:"message"`
+}
+
+// Error keeps the single-line form that errors had before they were structured
+func (e *ScriptError) Error() string {
+	kind := "Runtime"
+
+	if e.Kind == "syntax" {
+		kind = "Parse"
+	}
+
+	if e.Line > 0 {
+		return fmt.Sprintf("%s error on line %d: %s", kind, e.Line, e.Message)
+	}
+
+	return fmt.Sprintf("%s error: %s", kind, e.Message)
+}
+
+// Report formats the error over multiple lines, with the cause, the source around
+// the failing line, the traceback and the arguments of the script
+func (e *ScriptError) Report() string {
+	lines := []string{e.Error()}
+
+	if e.Cause != nil {
+		cause := e.Cause.Type + ": " + e.Cause.Message
+
+		if e.Cause.Function != "" {
+			cause = e.Cause.Function + ": " + cause
+		}
+
+		lines = append(lines, "  cause: "+cause)
+	}
+
+	if len(e.Source) > 0 {
+		lines = append(lines, "  source:")
+
+		width := len(strconv.Itoa(e.Source[len(e.Source)-1].Line))
+
+		for _, line := range e.Source {
+			marker := " "
+
+			if line.Current {
+				marker = ">"
+			}
+
+			lines = append(lines, fmt.Sprintf("  %s %*d | %s", marker, width, line.Line, line.Text))
+		}
+	}
+
+	if len(e.Traceback) > 0 {
+		lines = append(lines, "  traceback:")
+
+		for _, frame := range e.Traceback {
+			if frame.Line > 0 {
+				lines = append(lines, fmt.Sprintf("    %s:%d: in %s", frame.Source, frame.Line, frame.Function))
+			} else {
+				lines = append(lines, fmt.Sprintf("    %s: in %s", frame.Source, frame.Function))
+			}
+		}
+	}
+
+	if len(e.Args) > 0 {
+		keys := make([]string, 0, len(e.Args))
+
+		for key := range e.Args {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		args := []string{}
+
+		for _, key := range keys {
+			args = append(args, fmt.Sprintf("%s=%v", key, e.Args[key]))
+		}
+
+		lines = append(lines, "  args: "+strings.Join(args, ", "))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// raiseError raises a Lua error with the message of err, and keeps err so that the
+// report of the script's failure can show the Go error behind it
+func raiseError(l *lua.State, err error) {
+	l.PushUserData(&ErrorCause{Type: fmt.Sprintf("%T", err), Message: err.Error()})
+	l.SetField(lua.RegistryIndex, goErrorField)
+
+	lua.Errorf(l, "%s", err.Error())
+}
+
+// newSyntaxError builds the error for a script that failed to compile
+func newSyntaxError(source, message string, args map[string]interface{}) *ScriptError {
+	e := &ScriptError{Kind: "syntax", Chunk: scriptChunkName, Args: redactArgs(args)}
+	e.Message, e.Line = splitErrorPosition(message)
+	e.Source = sourceContext(source, e.Line)
+
+	return e
+}
+
+// errorHandler returns a message handler for ProtectedCall that fills e with the
+// traceback and cause of a runtime error. It runs before the stack unwinds, while
+// the frames of the failing calls are still available
+func errorHandler(source string, args map[string]interface{}, e *ScriptError) lua.Function {
+	return func(l *lua.State) int {
+		message, ok := l.ToString(1)
+
+		if !ok {
+			message = fmt.Sprintf("(error object is a %s value)", lua.TypeNameOf(l, 1))
+		}
+
+		e.Kind = "runtime"
+		e.Chunk = scriptChunkName
+		e.Args = redactArgs(args)
+		e.Message, e.Line = splitErrorPosition(message)
+
+		// The Go function that raised the error, if any
+		function := ""
+
+		// Level 0 is this handler
+		for level := 1; ; level++ {
+			f, ok := lua.Stack(l, level)
+
+			if !ok {
+				break
+			}
+
+			d, _ := lua.Info(l, "Sl", f)
+
+			frame := StackFrame{Source: d.ShortSource, Line: d.CurrentLine}
+
+			// go-lua can't look up the name of the main chunk, which has none
+			if d.What != "main" {
+				n, _ := lua.Info(l, "n", f)
+				d.Name = n.Name
+			}
+
+			switch {
+			case d.What == "main":
+				frame.Function = "main chunk"
+
+			case d.Name != "":
+				frame.Function = fmt.Sprintf("function '%s'", d.Name)
+
+			case d.What == "Go":
+				frame.Function = "?"
+
+			default:
+				frame.Function = fmt.Sprintf("function <%s:%d>", d.ShortSource, d.LineDefined)
+			}
+
+			if level == 1 && d.What == "Go" {
+				function = d.Name
+			}
+
+			e.Traceback = append(e.Traceback, frame)
+
+			// Errors raised by library functions carry no position, so the
+			// line is that of the innermost call in the script
+			if e.Line == 0 && d.ShortSource == scriptChunkName && d.CurrentLine > 0 {
+				e.Line = d.CurrentLine
+			}
+		}
+
+		l.Field(lua.RegistryIndex, goErrorField)
+
+		// A cause left behind by an error that the script caught with pcall
+		// doesn't match the message
+		if cause, ok := l.ToUserData(-1).(*ErrorCause); ok && strings.HasSuffix(message, cause.Message) {
+			e.Cause = cause
+			e.Cause.Function = function
+		}
+
+		l.Pop(1)
+
+		l.PushNil()
+		l.SetField(lua.RegistryIndex, goErrorField)
+
+		e.Source = sourceContext(source, e.Line)
+
+		l.PushValue(1)
+		return 1
+	}
+}
+
+// splitErrorPosition removes the `script:line:` prefix that Lua adds to messages.
+// Syntax errors name the chunk with the leading `=` it was loaded with
+func splitErrorPosition(message string) (string, int) {
+	matches := errorPositionRegex.FindStringSubmatch(message)
+
+	if matches == nil {
+		return message, 0
+	}
+
+	line, _ := strconv.Atoi(matches[1])
+
+	return strings.TrimPrefix(message, matches[0]), line
+}
+
+func sourceContext(source string, line int) []SourceLine {
+	lines := strings.Split(source, "\n")
+
+	if line < 1 || line > len(lines) {
+		return nil
+	}
+
+	result := []SourceLine{}
+
+	for index := line - sourceContextLines; index <= line+sourceContextLines; index++ {
+		if index < 1 || index > len(lines) {
+			continue
+		}
+
+		result = append(result, SourceLine{
+			Line:    index,
+			Text:    strings.TrimRight(lines[index-1], "\r"),
+			Current: index == line,
+		})
+	}
+
+	return result
+}
+
+// redactArgs copies the arguments of a script for a report, hiding the values of
+// those that look like credentials, including within tables
+func redactArgs(args map[string]interface{}) map[string]interface{} {
+	if len(args) == 0 {
+		return nil
+	}
+
+	return redactValue(args).(map[string]interface{})
+}
+
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := map[string]interface{}{}
+
+		for key, item := range v {
+			if secretArgRegex.MatchString(key) {
+				result[key] = "********"
+			} else {
+				result[key] = redactValue(item)
+			}
+		}
+
+		return result
+
+	case []interface{}:
+		result := make([]interface{}, len(v))
+
+		for index, item := range v {
+			result[index] = redactValue(item)
+		}
+
+		return result
+
+	// Arrays of tables in TOML configuration files
+	case []map[string]interface{}:
+		result := make([]interface{}, len(v))
+
+		for index, item := range v {
+			result[index] = redactValue(item)
+		}
+
+		return result
+	}
+
+	return value
+}
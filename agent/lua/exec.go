@@ -2,8 +2,7 @@ package lua
 
 import (
 	"errors"
-	"fmt"
-	"regexp"
+	"time"
 
 	"github.com/telemetryapp/go-lua"
 	"github.com/telemetryapp/goluago"
@@ -12,58 +11,91 @@ import (
 
 const arrayMarkerField = "_is_array"
 
-var errorRegex = regexp.MustCompile(`:([^:]+)+:(.+)$`)
+// The registry field of the stateCleanup of an interpreter
+const cleanupField = "_cleanup"
 
-// Exec takes a Lua source code string and set of arguments and executes the code using the go-lua interpreter
-func Exec(source string, np notificationProvider, args map[string]interface{}) (map[string]interface{}, error) {
-	l := lua.NewState()
+// The registry field set in the interpreters of Eval, whose scripts can read the
+// storage and databases but not write to them
+const readOnlyField = "_read_only"
 
-	lua.OpenLibraries(l)
-	goluago.Open(l)
+// The number of instructions between checks of the timeout of Eval
+const timeoutCheckInstructions = 1000
 
-	openOAuthLibrary(l)
-	openJSONLibrary(l)
-	openUtilsLibrary(l)
-	openHTTPLibrary(l)
-	openStorageLibrary(l)
-	openExcelLibrary(l)
-	openNotificationsLibrary(l, np)
-	openSQLLibrary(l)
-	openMongoLibrary(l)
-	openXMLLibrary(l)
+// jobProvider is implemented by the job that runs a script, and gives the
+// libraries access to the Telemetry API on its behalf
+type jobProvider interface {
+	notificationProvider
+	flowProvider
+	logProvider
+}
 
-	util.DeepPush(l, args)
+// Exec takes a Lua source code string and set of arguments and executes the code using the go-lua interpreter.
+// Files referenced by the script, such as templates, are resolved relative to scriptDir.
+// Scripts that fail to compile or run return a *ScriptError
+func Exec(source string, scriptDir string, p jobProvider, args map[string]interface{}) (map[string]interface{}, error) {
+	return ExecWithFixtures(source, scriptDir, p, args, nil)
+}
 
-	l.SetGlobal("args")
+// ExecWithFixtures works like Exec, but when fixtures are provided the http, oauth, sql
+// and mongodb libraries answer from them instead of contacting external services
+func ExecWithFixtures(source string, scriptDir string, p jobProvider, args map[string]interface{}, fixtures *Fixtures) (map[string]interface{}, error) {
+	l, err := newState(scriptDir, p, args, fixtures)
 
-	util.DeepPush(l, map[string]interface{}{})
+	if err != nil {
+		return nil, err
+	}
 
-	l.SetGlobal("output")
+	defer closeState(l)
+
+	return run(l, source, args)
+}
 
-	err := lua.LoadString(l, source)
+// Eval works like Exec, but stops the script with an error once the timeout has
+// elapsed. Calls to Go functions, such as HTTP requests, are not interrupted. The
+// script can read the storage, but the functions that write to it, or that run
+// SQL statements with exec, raise an error instead
+func Eval(source string, scriptDir string, p jobProvider, args map[string]interface{}, timeout time.Duration) (map[string]interface{}, error) {
+	l, err := newState(scriptDir, p, args, nil)
 
 	if err != nil {
-		matches := errorRegex.FindStringSubmatch(lua.CheckString(l, -1))
+		return nil, err
+	}
 
-		if len(matches) != 3 {
-			return nil, err
+	defer closeState(l)
+
+	l.PushBoolean(true)
+	l.SetField(lua.RegistryIndex, readOnlyField)
+
+	deadline := time.Now().Add(timeout)
+
+	lua.SetDebugHook(l, func(l *lua.State, d lua.Debug) {
+		if time.Now().After(deadline) {
+			lua.Errorf(l, "The script did not finish within %s", timeout.String())
 		}
+	}, lua.MaskCount, timeoutCheckInstructions)
 
-		return nil, fmt.Errorf("Parse error on line %s: %s", matches[1], matches[2])
-	}
+	return run(l, source, args)
+}
 
-	err = l.ProtectedCall(0, 0, 0)
+// run executes a script in a state created by newState, and returns its output
+func run(l *lua.State, source string, args map[string]interface{}) (map[string]interface{}, error) {
+	if err := lua.LoadBuffer(l, source, "="+scriptChunkName, ""); err != nil {
+		message, _ := l.ToString(-1)
+		return nil, newSyntaxError(source, message, args)
+	}
 
-	if err != nil {
-		matches := errorRegex.FindStringSubmatch(lua.CheckString(l, -1))
+	// The message handler sits below the chunk, and is left on the stack by the call
+	scriptErr := &ScriptError{}
 
-		if len(matches) != 3 {
-			return nil, err
-		}
+	l.PushGoFunction(errorHandler(source, args, scriptErr))
+	l.Insert(1)
 
-		return nil, fmt.Errorf("Runtime error on line %s: %s", matches[1], matches[2])
+	if err := l.ProtectedCall(0, 0, 1); err != nil {
+		return nil, scriptErr
 	}
 
+	l.Pop(1)
+
 	l.Global("output")
 
 	defer l.Pop(1)
@@ -84,3 +116,102 @@ func Exec(source string, np notificationProvider, args map[string]interface{}) (
 
 	return nil, err
 }
+
+// newState creates an interpreter with every library open and the args and output
+// globals set
+func newState(scriptDir string, p jobProvider, args map[string]interface{}, fixtures *Fixtures) (*lua.State, error) {
+	l := lua.NewState()
+
+	l.PushUserData(&stateCleanup{})
+	l.SetField(lua.RegistryIndex, cleanupField)
+
+	lua.OpenLibraries(l)
+	goluago.Open(l)
+
+	if fixtures != nil {
+		if err := fixtures.compile(); err != nil {
+			return nil, err
+		}
+
+		l.PushUserData(fixtures)
+		l.SetField(lua.RegistryIndex, fixturesField)
+	}
+
+	openOAuthLibrary(l)
+	openHTTPLibrary(l)
+	openSQLLibrary(l)
+	openMongoLibrary(l)
+	openJSONLibrary(l)
+	openUtilsLibrary(l)
+	openStorageLibrary(l)
+	openExcelLibrary(l)
+	openNotificationsLibrary(l, p)
+	openFlowsLibrary(l, p)
+	openLogLibrary(l, p)
+	openWidgetsLibrary(l)
+	openXMLLibrary(l)
+	openQueryLibrary(l)
+	openTemplateLibrary(l, scriptDir)
+	openCryptoLibrary(l, scriptDir)
+
+	util.DeepPush(l, args)
+
+	l.SetGlobal("args")
+
+	util.DeepPush(l, map[string]interface{}{})
+
+	l.SetGlobal("output")
+
+	return l, nil
+}
+
+// stateCleanup holds what the libraries opened on behalf of a script and must
+// release once it is over, such as database sessions. go-lua doesn't collect
+// userdata with __gc metamethods, so this can't be left to the garbage collector
+type stateCleanup struct {
+	closers []func()
+}
+
+// addCleanup registers a function that closeState calls when the script is over
+func addCleanup(l *lua.State, fn func()) {
+	l.Field(lua.RegistryIndex, cleanupField)
+	cleanup, _ := l.ToUserData(-1).(*stateCleanup)
+	l.Pop(1)
+
+	if cleanup != nil {
+		cleanup.closers = append(cleanup.closers, fn)
+	}
+}
+
+// isReadOnly returns whether the script of an interpreter mustn't write to the
+// storage or to databases
+func isReadOnly(l *lua.State) bool {
+	l.Field(lua.RegistryIndex, readOnlyField)
+	defer l.Pop(1)
+
+	return l.ToBoolean(-1)
+}
+
+// checkWritable raises an error if the script of an interpreter is read-only
+func checkWritable(l *lua.State, function string) {
+	if isReadOnly(l) {
+		lua.Errorf(l, "%s can't be called by an evaluated script, which can't write to the storage or databases", function)
+	}
+}
+
+// closeState releases everything registered with addCleanup, most recent first
+func closeState(l *lua.State) {
+	l.Field(lua.RegistryIndex, cleanupField)
+	cleanup, _ := l.ToUserData(-1).(*stateCleanup)
+	l.Pop(1)
+
+	if cleanup == nil {
+		return
+	}
+
+	for i := len(cleanup.closers) - 1; i >= 0; i-- {
+		cleanup.closers[i]()
+	}
+
+	cleanup.closers = nil
+}
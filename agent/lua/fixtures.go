@@ -0,0 +1,577 @@
+package lua
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/globalsign/mgo"
+	"github.com/telemetryapp/go-lua"
+)
+
+// The registry field of the fixtures of an interpreter, if it has any
+const fixturesField = "_fixtures"
+
+// Fixtures provide canned responses for the libraries that talk to external
+// services, so that scripts can be run without network or database access. The
+// libraries work as usual, but their requests are answered by the fixtures where
+// they would reach the network or the database driver. A request that doesn't
+// match any fixture fails like a request to an unreachable service
+type Fixtures struct {
+	HTTP    []HTTPFixture  `json:"http"`
+	OAuth   []HTTPFixture  `json:"oauth"`
+	SQL     []SQLFixture   `json:"sql"`
+	MongoDB []MongoFixture `json:"mongodb"`
+}
+
+// HTTPFixture is the response to a request made through telemetry/http or telemetry/oauth.
+// The URL must match exactly, unless it ends with `*`, in which case it is used as a
+// prefix. An empty method matches any method, and an empty name any OAuth entry.
+// The status is only reported by http.parallel, and defaults to 200
+type HTTPFixture struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Name   string      `json:"name"`
+	Status int         `json:"status"`
+	Body   string      `json:"body"`
+	JSON   interface{} `json:"json"`
+	Error  string      `json:"error"`
+}
+
+// SQLFixture is the response to the queries and statements executed through
+// telemetry/sql that match the Query regular expression, ignoring case. Each row
+// maps column names to values
+type SQLFixture struct {
+	Query  string                   `json:"query"`
+	Rows   []map[string]interface{} `json:"rows"`
+	Result map[string]int64         `json:"result"`
+	Error  string                   `json:"error"`
+
+	rx *regexp.Regexp
+}
+
+// MongoFixture is the response to a find (the default), aggregate or command operation
+// executed through telemetry/mongodb. The result of a find or aggregate operation is
+// a list of documents. Empty database and collection names match any name
+type MongoFixture struct {
+	Database   string      `json:"database"`
+	Collection string      `json:"collection"`
+	Operation  string      `json:"operation"`
+	Result     interface{} `json:"result"`
+	Error      string      `json:"error"`
+}
+
+// compile checks the fixtures, preparing the SQL query expressions
+func (f *Fixtures) compile() error {
+	for index := range f.SQL {
+		rx, err := regexp.Compile("(?i)" + f.SQL[index].Query)
+
+		if err != nil {
+			return fmt.Errorf("Invalid SQL fixture query `%s`: %s", f.SQL[index].Query, err)
+		}
+
+		f.SQL[index].rx = rx
+	}
+
+	for _, fixture := range f.MongoDB {
+		switch fixture.Operation {
+		case "", "find", "aggregate", "command":
+		default:
+			return fmt.Errorf("Invalid MongoDB fixture operation `%s`", fixture.Operation)
+		}
+	}
+
+	return nil
+}
+
+// stateFixtures returns the fixtures that the libraries of an interpreter answer
+// from, or nil if they contact the actual services
+func stateFixtures(l *lua.State) *Fixtures {
+	l.Field(lua.RegistryIndex, fixturesField)
+	fixtures, _ := l.ToUserData(-1).(*Fixtures)
+	l.Pop(1)
+
+	return fixtures
+}
+
+func (f *HTTPFixture) matches(method, url, name string) bool {
+	if f.Method != "" && !strings.EqualFold(f.Method, method) {
+		return false
+	}
+
+	if f.Name != "" && f.Name != name {
+		return false
+	}
+
+	if strings.HasSuffix(f.URL, "*") {
+		return strings.HasPrefix(url, strings.TrimSuffix(f.URL, "*"))
+	}
+
+	return f.URL == url
+}
+
+// response returns the body of the fixture, encoding its JSON value if it has one
+func (f *HTTPFixture) response() (string, error) {
+	if f.Error != "" {
+		return "", errors.New(f.Error)
+	}
+
+	if f.JSON != nil {
+		b, err := json.Marshal(f.JSON)
+		return string(b), err
+	}
+
+	return f.Body, nil
+}
+
+// httpFixtureTransport answers HTTP requests from fixtures. Requests made on behalf
+// of an OAuth entry carry its name
+type httpFixtureTransport struct {
+	fixtures []HTTPFixture
+	name     string
+}
+
+func (t *httpFixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	url := req.URL.String()
+
+	for index := range t.fixtures {
+		fixture := &t.fixtures[index]
+
+		if !fixture.matches(req.Method, url, t.name) {
+			continue
+		}
+
+		body, err := fixture.response()
+		if err != nil {
+			return nil, err
+		}
+
+		status := fixture.Status
+
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+			StatusCode:    status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{},
+			Body:          ioutil.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+
+	if t.name != "" {
+		return nil, fmt.Errorf("No OAuth fixture matches %s %s for `%s`", req.Method, url, t.name)
+	}
+
+	return nil, fmt.Errorf("No HTTP fixture matches %s %s", req.Method, url)
+}
+
+// sqlFixtureConnector opens connections of a database/sql driver that answers
+// queries and statements from fixtures
+type sqlFixtureConnector struct {
+	fixtures []SQLFixture
+}
+
+func (c *sqlFixtureConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return &sqlFixtureConn{fixtures: c.fixtures}, nil
+}
+
+func (c *sqlFixtureConnector) Driver() driver.Driver {
+	return sqlFixtureDriver{}
+}
+
+// sqlFixtureDriver is only used through sqlFixtureConnector, which holds the fixtures
+type sqlFixtureDriver struct{}
+
+func (sqlFixtureDriver) Open(name string) (driver.Conn, error) {
+	return nil, errors.New("SQL fixtures can only be opened with their connector")
+}
+
+type sqlFixtureConn struct {
+	fixtures []SQLFixture
+}
+
+func (c *sqlFixtureConn) Prepare(query string) (driver.Stmt, error) {
+	return &sqlFixtureStmt{conn: c, query: query}, nil
+}
+
+func (c *sqlFixtureConn) Close() error {
+	return nil
+}
+
+// Transactions are answered from the same fixtures
+func (c *sqlFixtureConn) Begin() (driver.Tx, error) {
+	return sqlFixtureTx{}, nil
+}
+
+func (c *sqlFixtureConn) find(query string) (*SQLFixture, error) {
+	for index := range c.fixtures {
+		fixture := &c.fixtures[index]
+
+		if fixture.rx.MatchString(query) {
+			if fixture.Error != "" {
+				return nil, errors.New(fixture.Error)
+			}
+
+			return fixture, nil
+		}
+	}
+
+	return nil, fmt.Errorf("No SQL fixture matches `%s`", query)
+}
+
+type sqlFixtureTx struct{}
+
+func (sqlFixtureTx) Commit() error   { return nil }
+func (sqlFixtureTx) Rollback() error { return nil }
+
+// sqlFixtureStmt accepts any number of parameters, and ignores them
+type sqlFixtureStmt struct {
+	conn  *sqlFixtureConn
+	query string
+}
+
+func (s *sqlFixtureStmt) Close() error {
+	return nil
+}
+
+func (s *sqlFixtureStmt) NumInput() int {
+	return -1
+}
+
+func (s *sqlFixtureStmt) Exec(args []driver.Value) (driver.Result, error) {
+	fixture, err := s.conn.find(s.query)
+	if err != nil {
+		return nil, err
+	}
+
+	return sqlFixtureResult(fixture.Result), nil
+}
+
+func (s *sqlFixtureStmt) Query(args []driver.Value) (driver.Rows, error) {
+	fixture, err := s.conn.find(s.query)
+	if err != nil {
+		return nil, err
+	}
+
+	// The columns are the names used by any of the rows
+	seen := map[string]bool{}
+	columns := []string{}
+
+	for _, row := range fixture.Rows {
+		for name := range row {
+			if !seen[name] {
+				seen[name] = true
+				columns = append(columns, name)
+			}
+		}
+	}
+
+	sort.Strings(columns)
+
+	return &sqlFixtureRows{columns: columns, rows: fixture.Rows}, nil
+}
+
+// sqlFixtureResult reports the fields of the result of a fixture, and fails for
+// the rest like drivers that don't support them
+type sqlFixtureResult map[string]int64
+
+func (r sqlFixtureResult) LastInsertId() (int64, error) {
+	return r.field("last_insert_id")
+}
+
+func (r sqlFixtureResult) RowsAffected() (int64, error) {
+	return r.field("rows_affected")
+}
+
+func (r sqlFixtureResult) field(key string) (int64, error) {
+	if value, ok := r[key]; ok {
+		return value, nil
+	}
+
+	return 0, fmt.Errorf("The SQL fixture has no %s", key)
+}
+
+type sqlFixtureRows struct {
+	columns []string
+	rows    []map[string]interface{}
+	next    int
+}
+
+func (r *sqlFixtureRows) Columns() []string {
+	return r.columns
+}
+
+func (r *sqlFixtureRows) Close() error {
+	return nil
+}
+
+func (r *sqlFixtureRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+
+	for index, name := range r.columns {
+		dest[index] = r.rows[r.next][name]
+	}
+
+	r.next++
+
+	return nil
+}
+
+// mongoFixtureSession answers the operations of telemetry/mongodb from fixtures
+type mongoFixtureSession struct {
+	fixtures []MongoFixture
+}
+
+func (s *mongoFixtureSession) DB(name string) mongoDatabase {
+	return &mongoFixtureDatabase{session: s, name: name}
+}
+
+func (s *mongoFixtureSession) LiveServers() []string {
+	return []string{"fixtures"}
+}
+
+func (s *mongoFixtureSession) DatabaseNames() ([]string, error) {
+	names := []string{}
+	seen := map[string]bool{}
+
+	for _, fixture := range s.fixtures {
+		if fixture.Database != "" && !seen[fixture.Database] {
+			seen[fixture.Database] = true
+			names = append(names, fixture.Database)
+		}
+	}
+
+	return names, nil
+}
+
+func (s *mongoFixtureSession) Close() {}
+
+func (s *mongoFixtureSession) find(database, collection, operation string) (*MongoFixture, error) {
+	for index := range s.fixtures {
+		fixture := &s.fixtures[index]
+
+		fixtureOperation := fixture.Operation
+
+		if fixtureOperation == "" {
+			fixtureOperation = "find"
+		}
+
+		if fixtureOperation != operation ||
+			(fixture.Database != "" && fixture.Database != database) ||
+			(fixture.Collection != "" && fixture.Collection != collection) {
+			continue
+		}
+
+		if fixture.Error != "" {
+			return nil, errors.New(fixture.Error)
+		}
+
+		return fixture, nil
+	}
+
+	if operation == "command" {
+		return nil, fmt.Errorf("No MongoDB fixture matches a command on `%s`", database)
+	}
+
+	return nil, fmt.Errorf("No MongoDB fixture matches %s on `%s.%s`", operation, database, collection)
+}
+
+// documents returns the documents of a find or aggregate fixture
+func (f *MongoFixture) documents() []interface{} {
+	if result, ok := f.Result.([]interface{}); ok {
+		return result
+	}
+
+	return []interface{}{}
+}
+
+type mongoFixtureDatabase struct {
+	session *mongoFixtureSession
+	name    string
+}
+
+func (db *mongoFixtureDatabase) CollectionNames() ([]string, error) {
+	names := []string{}
+	seen := map[string]bool{}
+
+	for _, fixture := range db.session.fixtures {
+		if fixture.Collection != "" && (fixture.Database == "" || fixture.Database == db.name) && !seen[fixture.Collection] {
+			seen[fixture.Collection] = true
+			names = append(names, fixture.Collection)
+		}
+	}
+
+	return names, nil
+}
+
+func (db *mongoFixtureDatabase) C(name string) mongoCollection {
+	return &mongoFixtureCollection{database: db, name: name}
+}
+
+func (db *mongoFixtureDatabase) Run(cmd interface{}, result interface{}) error {
+	fixture, err := db.session.find(db.name, "", "command")
+	if err != nil {
+		return err
+	}
+
+	*result.(*interface{}) = fixture.Result
+
+	return nil
+}
+
+type mongoFixtureCollection struct {
+	database *mongoFixtureDatabase
+	name     string
+}
+
+func (c *mongoFixtureCollection) Name() string {
+	return c.name
+}
+
+func (c *mongoFixtureCollection) Find(query interface{}) mongoQuery {
+	fixture, err := c.database.session.find(c.database.name, c.name, "find")
+
+	if err != nil {
+		return mongoFixtureQuery{err: err}
+	}
+
+	return mongoFixtureQuery{documents: fixture.documents()}
+}
+
+func (c *mongoFixtureCollection) Aggregate(pipeline []interface{}, result *[]interface{}) error {
+	fixture, err := c.database.session.find(c.database.name, c.name, "aggregate")
+	if err != nil {
+		return err
+	}
+
+	*result = fixture.documents()
+
+	return nil
+}
+
+// mongoFixtureQuery returns the documents in the order given by the fixture, so
+// sort and select are accepted, but have no effect
+type mongoFixtureQuery struct {
+	documents []interface{}
+	skip      int
+	limit     int
+	err       error
+}
+
+func (q mongoFixtureQuery) Sort(fields ...string) mongoQuery {
+	return q
+}
+
+func (q mongoFixtureQuery) Limit(n int) mongoQuery {
+	q.limit = n
+	return q
+}
+
+func (q mongoFixtureQuery) Skip(n int) mongoQuery {
+	q.skip = n
+	return q
+}
+
+func (q mongoFixtureQuery) Select(selector interface{}) mongoQuery {
+	return q
+}
+
+func (q mongoFixtureQuery) results() ([]interface{}, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+
+	documents := q.documents
+
+	if q.skip >= len(documents) {
+		return []interface{}{}, nil
+	}
+
+	documents = documents[q.skip:]
+
+	if q.limit > 0 && q.limit < len(documents) {
+		documents = documents[:q.limit]
+	}
+
+	return documents, nil
+}
+
+func (q mongoFixtureQuery) All(result *[]interface{}) error {
+	documents, err := q.results()
+	if err != nil {
+		return err
+	}
+
+	*result = documents
+
+	return nil
+}
+
+func (q mongoFixtureQuery) One(result *interface{}) error {
+	documents, err := q.results()
+	if err != nil {
+		return err
+	}
+
+	if len(documents) == 0 {
+		return mgo.ErrNotFound
+	}
+
+	*result = documents[0]
+
+	return nil
+}
+
+func (q mongoFixtureQuery) Count() (int, error) {
+	documents, err := q.results()
+
+	return len(documents), err
+}
+
+func (q mongoFixtureQuery) Distinct(key string, result *[]interface{}) error {
+	documents, err := q.results()
+	if err != nil {
+		return err
+	}
+
+	values := []interface{}{}
+	seen := map[string]bool{}
+
+	for _, document := range documents {
+		if d, ok := document.(map[string]interface{}); ok {
+			if value, ok := d[key]; ok {
+				b, _ := json.Marshal(value)
+
+				if !seen[string(b)] {
+					seen[string(b)] = true
+					values = append(values, value)
+				}
+			}
+		}
+	}
+
+	*result = values
+
+	return nil
+}
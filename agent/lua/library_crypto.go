@@ -0,0 +1,342 @@
+package lua
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pborman/uuid"
+	"github.com/telemetryapp/go-lua"
+)
+
+// Hash functions exposed as crypto.<name>(data) and usable with crypto.hmac
+var cryptoHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+func openCryptoLibrary(l *lua.State, scriptDir string) {
+	var cryptoLibrary = []lua.RegistryFunction{
+		lua.RegistryFunction{
+			Name: "hmac",
+			Function: func(l *lua.State) int {
+				algorithm := lua.CheckString(l, 1)
+				key := lua.CheckString(l, 2)
+				message := lua.CheckString(l, 3)
+
+				h, ok := cryptoHashes[strings.ToLower(algorithm)]
+
+				if !ok {
+					lua.Errorf(l, "Unsupported HMAC algorithm %s", algorithm)
+				}
+
+				mac := hmac.New(h, []byte(key))
+				mac.Write([]byte(message))
+
+				pushEncodedBytes(l, mac.Sum(nil), 4)
+				return 1
+			},
+		},
+
+		lua.RegistryFunction{
+			Name: "base64_encode",
+			Function: func(l *lua.State) int {
+				l.PushString(base64.StdEncoding.EncodeToString([]byte(lua.CheckString(l, 1))))
+				return 1
+			},
+		},
+
+		lua.RegistryFunction{
+			Name: "base64_decode",
+			Function: func(l *lua.State) int {
+				s := strings.TrimRight(lua.CheckString(l, 1), "=")
+				b, err := base64.RawStdEncoding.DecodeString(s)
+
+				if err != nil {
+					raiseError(l, err)
+				}
+
+				l.PushString(string(b))
+				return 1
+			},
+		},
+
+		// URL-safe encoding without padding, as used by JWTs
+		lua.RegistryFunction{
+			Name: "base64url_encode",
+			Function: func(l *lua.State) int {
+				l.PushString(base64.RawURLEncoding.EncodeToString([]byte(lua.CheckString(l, 1))))
+				return 1
+			},
+		},
+
+		lua.RegistryFunction{
+			Name: "base64url_decode",
+			Function: func(l *lua.State) int {
+				s := strings.TrimRight(lua.CheckString(l, 1), "=")
+				b, err := base64.RawURLEncoding.DecodeString(s)
+
+				if err != nil {
+					raiseError(l, err)
+				}
+
+				l.PushString(string(b))
+				return 1
+			},
+		},
+
+		lua.RegistryFunction{
+			Name: "hex_encode",
+			Function: func(l *lua.State) int {
+				l.PushString(hex.EncodeToString([]byte(lua.CheckString(l, 1))))
+				return 1
+			},
+		},
+
+		lua.RegistryFunction{
+			Name: "hex_decode",
+			Function: func(l *lua.State) int {
+				b, err := hex.DecodeString(lua.CheckString(l, 1))
+
+				if err != nil {
+					raiseError(l, err)
+				}
+
+				l.PushString(string(b))
+				return 1
+			},
+		},
+
+		lua.RegistryFunction{
+			Name: "random_bytes",
+			Function: func(l *lua.State) int {
+				n := lua.CheckInteger(l, 1)
+
+				if n < 0 {
+					lua.Errorf(l, "The number of bytes cannot be negative")
+				}
+
+				b := make([]byte, n)
+
+				if _, err := rand.Read(b); err != nil {
+					raiseError(l, err)
+				}
+
+				pushEncodedBytes(l, b, 2)
+				return 1
+			},
+		},
+
+		lua.RegistryFunction{
+			Name: "uuid",
+			Function: func(l *lua.State) int {
+				l.PushString(uuid.NewRandom().String())
+				return 1
+			},
+		},
+
+		// Signs a table of claims as a JWT. The options table must contain the
+		// algorithm (HS256 or RS256) and either a secret or the path to a PEM key_file,
+		// and can contain extra header fields such as kid
+		lua.RegistryFunction{
+			Name: "jwt_sign",
+			Function: func(l *lua.State) int {
+				lua.CheckType(l, 1, lua.TypeTable)
+				lua.CheckType(l, 2, lua.TypeTable)
+
+				claims, err := pullTable(l, 1)
+
+				if err != nil {
+					raiseError(l, err)
+				}
+
+				options, err := pullTable(l, 2)
+
+				if err != nil {
+					raiseError(l, err)
+				}
+
+				o, ok := options.(map[string]interface{})
+
+				if !ok {
+					lua.Errorf(l, "JWT options must be a table of key/value pairs")
+				}
+
+				token, err := signJWT(claims, o, scriptDir)
+
+				if err != nil {
+					raiseError(l, err)
+				}
+
+				l.PushString(token)
+				return 1
+			},
+		},
+	}
+
+	for name, h := range cryptoHashes {
+		h := h
+
+		cryptoLibrary = append(cryptoLibrary, lua.RegistryFunction{
+			Name: name,
+			Function: func(l *lua.State) int {
+				digest := h()
+				digest.Write([]byte(lua.CheckString(l, 1)))
+
+				pushEncodedBytes(l, digest.Sum(nil), 2)
+				return 1
+			},
+		})
+	}
+
+	open := func(l *lua.State) int {
+		lua.NewLibrary(l, cryptoLibrary)
+		return 1
+	}
+
+	lua.Require(l, "telemetry/crypto", open, false)
+	l.Pop(1)
+}
+
+// pushEncodedBytes pushes binary output in the encoding named by the optional
+// argument at index: hex (the default), base64, base64url or raw
+func pushEncodedBytes(l *lua.State, b []byte, index int) {
+	switch encoding := lua.OptString(l, index, "hex"); encoding {
+	case "hex":
+		l.PushString(hex.EncodeToString(b))
+
+	case "base64":
+		l.PushString(base64.StdEncoding.EncodeToString(b))
+
+	case "base64url":
+		l.PushString(base64.RawURLEncoding.EncodeToString(b))
+
+	case "raw":
+		l.PushString(string(b))
+
+	default:
+		lua.Errorf(l, "Unsupported encoding %s; use hex, base64, base64url or raw", encoding)
+	}
+}
+
+func signJWT(claims interface{}, options map[string]interface{}, scriptDir string) (string, error) {
+	algorithm, _ := options["algorithm"].(string)
+
+	header := map[string]interface{}{}
+
+	if h, ok := options["header"].(map[string]interface{}); ok {
+		header = h
+	}
+
+	header["alg"] = strings.ToUpper(algorithm)
+	header["typ"] = "JWT"
+
+	headerJSON, err := json.Marshal(header)
+
+	if err != nil {
+		return "", err
+	}
+
+	claimsJSON, err := json.Marshal(claims)
+
+	if err != nil {
+		return "", err
+	}
+
+	input := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	var signature []byte
+
+	switch strings.ToUpper(algorithm) {
+	case "HS256":
+		secret, ok := options["secret"].(string)
+
+		if !ok {
+			return "", fmt.Errorf("HS256 tokens require a secret")
+		}
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(input))
+		signature = mac.Sum(nil)
+
+	case "RS256":
+		keyFile, ok := options["key_file"].(string)
+
+		if !ok {
+			return "", fmt.Errorf("RS256 tokens require a key_file")
+		}
+
+		if !filepath.IsAbs(keyFile) && scriptDir != "" {
+			keyFile = filepath.Join(scriptDir, keyFile)
+		}
+
+		key, err := readRSAPrivateKey(keyFile)
+
+		if err != nil {
+			return "", err
+		}
+
+		digest := sha256.Sum256([]byte(input))
+
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+
+		if err != nil {
+			return "", err
+		}
+
+	default:
+		return "", fmt.Errorf("Unsupported JWT algorithm %q; use HS256 or RS256", algorithm)
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// readRSAPrivateKey reads a PEM-encoded RSA key in either PKCS#1 or PKCS#8 format
+func readRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in %s", path)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse the private key in %s: %s", path, err)
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+
+	if !ok {
+		return nil, fmt.Errorf("The private key in %s is not an RSA key", path)
+	}
+
+	return rsaKey, nil
+}
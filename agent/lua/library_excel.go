@@ -1,11 +1,45 @@
 package lua
 
 import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/tealeg/xlsx"
 	"github.com/telemetryapp/go-lua"
 	"github.com/telemetryapp/goluago/util"
 )
 
+// excelOptions are the optional settings that can be passed to excel.import and
+// excel.import_csv
+type excelOptions struct {
+	sheet     string
+	index     int
+	header    bool
+	infer     bool
+	cellRange *excelRange
+	delimiter rune
+	encoding  string
+}
+
+// excelRange is a zero-based, inclusive rectangle of cells
+type excelRange struct {
+	minCol, minRow int
+	maxCol, maxRow int
+}
+
+var excelNumberPattern = regexp.MustCompile(`^[-+]?(\d+\.?\d*|\.\d+)([eE][-+]?\d+)?$`)
+
+// Layouts tried, in order, when inferring dates from text cells
+var excelDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
 var excelLibrary = []lua.RegistryFunction{
 	lua.RegistryFunction{
 		Name: "import",
@@ -13,16 +47,384 @@ var excelLibrary = []lua.RegistryFunction{
 
 			path := lua.CheckString(l, 1)
 
-			res, err := xlsx.FileToSlice(path)
+			// Without options, return every sheet as raw strings like we always have
+			if l.IsNoneOrNil(2) {
+				res, err := xlsx.FileToSlice(path)
+
+				if err != nil {
+					raiseError(l, err)
+				}
+
+				util.DeepPush(l, res)
+				return 1
+			}
+
+			options := checkExcelOptions(l, 2)
+
+			file, err := xlsx.OpenFile(path)
+
+			if err != nil {
+				raiseError(l, err)
+			}
+
+			sheet, err := excelSheet(file, options)
 
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
+			}
+
+			rows := [][]interface{}{}
+
+			for y, row := range sheet.Rows {
+				if !options.cellRange.containsRow(y) {
+					continue
+				}
+
+				values := []interface{}{}
+
+				for x, cell := range row.Cells {
+					if !options.cellRange.containsCol(x) {
+						continue
+					}
+
+					values = append(values, excelCellValue(cell, file.Date1904, options.infer))
+				}
+
+				rows = append(rows, values)
 			}
 
-			util.DeepPush(l, res)
+			pushSpreadsheet(l, rows, options.header, options.cellRange.firstColumn())
 			return 1
 		},
 	},
+
+	lua.RegistryFunction{
+		Name: "import_csv",
+		Function: func(l *lua.State) int {
+
+			path := lua.CheckString(l, 1)
+			options := checkExcelOptions(l, 2)
+
+			records, err := readCSVFile(path, options.delimiter, options.encoding)
+
+			if err != nil {
+				raiseError(l, err)
+			}
+
+			rows := [][]interface{}{}
+
+			for y, record := range records {
+				if !options.cellRange.containsRow(y) {
+					continue
+				}
+
+				values := []interface{}{}
+
+				for x, field := range record {
+					if !options.cellRange.containsCol(x) {
+						continue
+					}
+
+					if options.infer {
+						values = append(values, inferCellValue(field))
+					} else {
+						values = append(values, field)
+					}
+				}
+
+				rows = append(rows, values)
+			}
+
+			pushSpreadsheet(l, rows, options.header, options.cellRange.firstColumn())
+			return 1
+		},
+	},
+}
+
+func checkExcelOptions(l *lua.State, index int) *excelOptions {
+	options := &excelOptions{delimiter: ',', encoding: "utf-8"}
+
+	if l.IsNoneOrNil(index) {
+		return options
+	}
+
+	lua.CheckType(l, index, lua.TypeTable)
+
+	l.Field(index, "sheet")
+	switch l.TypeOf(-1) {
+	case lua.TypeNumber:
+		options.index = lua.CheckInteger(l, -1)
+
+	case lua.TypeString:
+		options.sheet = lua.CheckString(l, -1)
+	}
+	l.Pop(1)
+
+	l.Field(index, "header")
+	options.header = l.ToBoolean(-1)
+	l.Pop(1)
+
+	l.Field(index, "infer")
+	options.infer = l.ToBoolean(-1)
+	l.Pop(1)
+
+	l.Field(index, "range")
+	if cellRange, ok := l.ToString(-1); ok {
+		r, err := parseExcelRange(cellRange)
+
+		if err != nil {
+			raiseError(l, err)
+		}
+
+		options.cellRange = r
+	}
+	l.Pop(1)
+
+	l.Field(index, "delimiter")
+	if delimiter, ok := l.ToString(-1); ok {
+		runes := []rune(delimiter)
+
+		if len(runes) != 1 {
+			lua.Errorf(l, "The delimiter must be a single character")
+		}
+
+		options.delimiter = runes[0]
+	}
+	l.Pop(1)
+
+	l.Field(index, "encoding")
+	if encoding, ok := l.ToString(-1); ok {
+		options.encoding = encoding
+	}
+	l.Pop(1)
+
+	return options
+}
+
+// excelSheet returns the sheet selected by name or by its one-based index,
+// defaulting to the first sheet in the workbook
+func excelSheet(file *xlsx.File, options *excelOptions) (*xlsx.Sheet, error) {
+	if options.sheet != "" {
+		if sheet, ok := file.Sheet[options.sheet]; ok {
+			return sheet, nil
+		}
+
+		return nil, fmt.Errorf("Sheet %q not found", options.sheet)
+	}
+
+	index := options.index
+
+	if index == 0 {
+		index = 1
+	}
+
+	if index < 1 || index > len(file.Sheets) {
+		return nil, fmt.Errorf("Sheet %d not found; the workbook has %d sheet(s)", index, len(file.Sheets))
+	}
+
+	return file.Sheets[index-1], nil
+}
+
+// parseExcelRange parses a range in A1 notation, such as B2:D20
+func parseExcelRange(value string) (*excelRange, error) {
+	parts := strings.Split(strings.ToUpper(strings.TrimSpace(value)), ":")
+
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid cell range %q; expected a range like A1:D20", value)
+	}
+
+	minCol, minRow, err := xlsx.GetCoordsFromCellIDString(parts[0])
+
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cell range %q: %s", value, err)
+	}
+
+	maxCol, maxRow, err := xlsx.GetCoordsFromCellIDString(parts[1])
+
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cell range %q: %s", value, err)
+	}
+
+	if minCol < 0 || minRow < 0 || maxCol < minCol || maxRow < minRow {
+		return nil, fmt.Errorf("Invalid cell range %q", value)
+	}
+
+	return &excelRange{minCol: minCol, minRow: minRow, maxCol: maxCol, maxRow: maxRow}, nil
+}
+
+func (r *excelRange) containsRow(y int) bool {
+	return r == nil || (y >= r.minRow && y <= r.maxRow)
+}
+
+func (r *excelRange) firstColumn() int {
+	if r == nil {
+		return 0
+	}
+
+	return r.minCol
+}
+
+func (r *excelRange) containsCol(x int) bool {
+	return r == nil || (x >= r.minCol && x <= r.maxCol)
+}
+
+// excelCellValue returns the value of a cell, optionally converting numeric
+// cells to numbers and date-formatted cells to RFC3339 strings
+func excelCellValue(cell *xlsx.Cell, date1904 bool, infer bool) interface{} {
+	if !infer {
+		return cell.Value
+	}
+
+	switch cell.Type() {
+	case xlsx.CellTypeBool:
+		return cell.Bool()
+
+	case xlsx.CellTypeDate:
+		if t, err := cell.GetTime(date1904); err == nil {
+			return t.Format(time.RFC3339)
+		}
+
+	case xlsx.CellTypeNumeric, xlsx.CellTypeFormula:
+		f, err := cell.Float()
+
+		if err != nil {
+			break
+		}
+
+		if isExcelDateFormat(cell.GetNumberFormat()) {
+			if t, err := cell.GetTime(date1904); err == nil {
+				return t.Format(time.RFC3339)
+			}
+		}
+
+		return f
+
+	case xlsx.CellTypeString, xlsx.CellTypeInline:
+		return cell.Value
+	}
+
+	return inferCellValue(cell.Value)
+}
+
+// isExcelDateFormat reports whether a number format displays its value as a
+// date or time. Literal text and bracketed sections are ignored
+func isExcelDateFormat(format string) bool {
+	format = strings.ToLower(format)
+
+	if format == "" || format == "general" {
+		return false
+	}
+
+	var b strings.Builder
+	quoted, bracketed := false, false
+
+	for _, c := range format {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '[':
+			bracketed = true
+		case c == ']':
+			bracketed = false
+		case bracketed:
+		default:
+			b.WriteRune(c)
+		}
+	}
+
+	return strings.ContainsAny(b.String(), "ydhs") || strings.Contains(b.String(), "mm")
+}
+
+// inferCellValue converts text that looks like a number, boolean or date into
+// the corresponding type. Dates are returned as RFC3339 strings
+func inferCellValue(value string) interface{} {
+	trimmed := strings.TrimSpace(value)
+
+	if trimmed == "" {
+		return value
+	}
+
+	if excelNumberPattern.MatchString(trimmed) {
+		if f, err := strconv.ParseFloat(trimmed, 64); err == nil {
+			return f
+		}
+	}
+
+	switch strings.ToLower(trimmed) {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+
+	for _, layout := range excelDateLayouts {
+		if t, err := time.Parse(layout, trimmed); err == nil {
+			return t.Format(time.RFC3339)
+		}
+	}
+
+	return value
+}
+
+// pushSpreadsheet pushes rows as an array of arrays or, when header is true,
+// as an array of records keyed by the values of the first row. Empty cells are
+// omitted from records and missing headings are replaced by the column letter
+func pushSpreadsheet(l *lua.State, rows [][]interface{}, header bool, firstColumn int) {
+	pushArray(l)
+
+	if !header {
+		for index, row := range rows {
+			pushArray(l)
+
+			for x, value := range row {
+				util.DeepPush(l, value)
+				l.RawSetInt(-2, x+1)
+			}
+
+			l.RawSetInt(-2, index+1)
+		}
+
+		return
+	}
+
+	if len(rows) == 0 {
+		return
+	}
+
+	keys := make([]string, len(rows[0]))
+
+	for x, value := range rows[0] {
+		keys[x] = strings.TrimSpace(fmt.Sprintf("%v", value))
+
+		if keys[x] == "" {
+			keys[x] = excelColumnName(firstColumn + x)
+		}
+	}
+
+	for index, row := range rows[1:] {
+		record := map[string]interface{}{}
+
+		for x, value := range row {
+			if s, ok := value.(string); ok && s == "" {
+				continue
+			}
+
+			if x < len(keys) {
+				record[keys[x]] = value
+			} else {
+				record[excelColumnName(firstColumn+x)] = value
+			}
+		}
+
+		util.DeepPush(l, record)
+		l.RawSetInt(-2, index+1)
+	}
+}
+
+// excelColumnName returns the letter(s) of a zero-based column index
+func excelColumnName(x int) string {
+	return strings.TrimRight(xlsx.GetCellIDStringFromCoords(x, 0), "0123456789")
 }
 
 func openExcelLibrary(l *lua.State) {
@@ -0,0 +1,113 @@
+package lua
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Code points for the 0x80-0x9F range of Windows-1252; the remaining bytes map
+// directly to the Latin-1 code point with the same value
+var windows1252Table = [32]rune{
+	0x20AC, 0x0081, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008D, 0x017D, 0x008F,
+	0x0090, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0x009D, 0x017E, 0x0178,
+}
+
+// readCSVFile reads every record of a delimited text file, converting it from
+// the given encoding to UTF-8 first
+func readCSVFile(path string, delimiter rune, encoding string) ([][]string, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := decodeText(data, encoding)
+
+	if err != nil {
+		return nil, err
+	}
+
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.Comma = delimiter
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	return reader.ReadAll()
+}
+
+// decodeText converts data in one of the supported encodings to a UTF-8 string.
+// Byte order marks are removed
+func decodeText(data []byte, encoding string) (string, error) {
+	switch strings.Replace(strings.ToLower(encoding), "_", "-", -1) {
+	case "", "utf-8", "utf8":
+		data = bytes.TrimPrefix(data, []byte{0xEF, 0xBB, 0xBF})
+
+		if !utf8.Valid(data) {
+			return "", fmt.Errorf("The file is not valid UTF-8; use the encoding option to specify its character set")
+		}
+
+		return string(data), nil
+
+	case "utf-16":
+		if bytes.HasPrefix(data, []byte{0xFE, 0xFF}) {
+			return decodeUTF16(data[2:], true)
+		}
+
+		return decodeUTF16(bytes.TrimPrefix(data, []byte{0xFF, 0xFE}), false)
+
+	case "utf-16le":
+		return decodeUTF16(bytes.TrimPrefix(data, []byte{0xFF, 0xFE}), false)
+
+	case "utf-16be":
+		return decodeUTF16(bytes.TrimPrefix(data, []byte{0xFE, 0xFF}), true)
+
+	case "latin1", "latin-1", "iso-8859-1":
+		runes := make([]rune, len(data))
+
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+
+		return string(runes), nil
+
+	case "windows-1252", "cp1252":
+		runes := make([]rune, len(data))
+
+		for i, b := range data {
+			if b >= 0x80 && b <= 0x9F {
+				runes[i] = windows1252Table[b-0x80]
+			} else {
+				runes[i] = rune(b)
+			}
+		}
+
+		return string(runes), nil
+	}
+
+	return "", fmt.Errorf("Unsupported encoding %q; use utf-8, utf-16, utf-16le, utf-16be, latin1 or windows-1252", encoding)
+}
+
+func decodeUTF16(data []byte, bigEndian bool) (string, error) {
+	if len(data)%2 != 0 {
+		return "", fmt.Errorf("The file is not valid UTF-16")
+	}
+
+	units := make([]uint16, len(data)/2)
+
+	for i := range units {
+		if bigEndian {
+			units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+		} else {
+			units[i] = uint16(data[2*i+1])<<8 | uint16(data[2*i])
+		}
+	}
+
+	return string(utf16.Decode(units)), nil
+}
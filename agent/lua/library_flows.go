@@ -0,0 +1,131 @@
+package lua
+
+import (
+	"github.com/telemetryapp/go-lua"
+	"github.com/telemetryapp/goluago/util"
+	"github.com/telemetryapp/gotelemetry"
+)
+
+type flowProvider interface {
+	ReadFlow(tag string) (interface{}, error)
+	UpdateFlow(tag string, data interface{}, updateType gotelemetry.BatchType) error
+	SetFlowError(tag string, message string) error
+	CreateFlow(tag string, variant string, template interface{}) (*gotelemetry.Flow, error)
+}
+
+func openFlowsLibrary(l *lua.State, p flowProvider) {
+	// Returns a function that submits the table at index 2 to the flow named
+	// by the argument at index 1 using the given update type
+	update := func(updateType gotelemetry.BatchType) lua.Function {
+		return func(l *lua.State) int {
+			tag := lua.CheckString(l, 1)
+			lua.CheckType(l, 2, lua.TypeTable)
+
+			data, err := pullTable(l, 2)
+
+			if err != nil {
+				raiseError(l, err)
+			}
+
+			if updateType == gotelemetry.BatchTypeJSONPATCH {
+				if _, ok := data.([]interface{}); !ok {
+					lua.Errorf(l, "JSON patches must be an array of operations")
+				}
+			} else if _, ok := data.(map[string]interface{}); !ok {
+				lua.Errorf(l, "Flow data must be a table of key/value pairs")
+			}
+
+			if err := p.UpdateFlow(tag, data, updateType); err != nil {
+				raiseError(l, err)
+			}
+
+			return 0
+		}
+	}
+
+	var flowsLibrary = []lua.RegistryFunction{
+		lua.RegistryFunction{
+			Name: "read",
+			Function: func(l *lua.State) int {
+				tag := lua.CheckString(l, 1)
+
+				data, err := p.ReadFlow(tag)
+
+				if err != nil {
+					raiseError(l, err)
+				}
+
+				util.DeepPush(l, data)
+				return 1
+			},
+		},
+
+		lua.RegistryFunction{
+			Name:     "patch",
+			Function: update(gotelemetry.BatchTypePATCH),
+		},
+
+		lua.RegistryFunction{
+			Name:     "replace",
+			Function: update(gotelemetry.BatchTypePOST),
+		},
+
+		lua.RegistryFunction{
+			Name:     "json_patch",
+			Function: update(gotelemetry.BatchTypeJSONPATCH),
+		},
+
+		lua.RegistryFunction{
+			Name: "set_error",
+			Function: func(l *lua.State) int {
+				tag := lua.CheckString(l, 1)
+				message := lua.CheckString(l, 2)
+
+				if err := p.SetFlowError(tag, message); err != nil {
+					raiseError(l, err)
+				}
+
+				return 0
+			},
+		},
+
+		// Returns the flow with the given tag, creating it from the template if it
+		// doesn't exist yet
+		lua.RegistryFunction{
+			Name: "create",
+			Function: func(l *lua.State) int {
+				tag := lua.CheckString(l, 1)
+				variant := lua.CheckString(l, 2)
+				lua.CheckType(l, 3, lua.TypeTable)
+
+				template, err := pullTable(l, 3)
+
+				if err != nil {
+					raiseError(l, err)
+				}
+
+				f, err := p.CreateFlow(tag, variant, template)
+
+				if err != nil {
+					raiseError(l, err)
+				}
+
+				util.DeepPush(l, map[string]interface{}{
+					"id":       f.ID,
+					"embed_id": f.EmbedID,
+					"tag":      f.Tag,
+					"variant":  f.Variant,
+				})
+				return 1
+			},
+		},
+	}
+
+	open := func(l *lua.State) int {
+		lua.NewLibrary(l, flowsLibrary)
+		return 1
+	}
+
+	lua.Require(l, "telemetry/flows", open, false)
+	l.Pop(1)
+}
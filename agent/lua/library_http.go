@@ -4,15 +4,67 @@ import (
 	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/telemetryapp/go-lua"
 	"github.com/telemetryapp/goluago/util"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
 )
 
+// The number of requests that http.parallel runs at the same time by default
+const defaultHTTPConcurrency = 10
+
+// The time that each request of http.parallel may take by default
+const defaultHTTPTimeout = 30 * time.Second
+
+// httpTransports keeps one transport per set of TLS settings, so that requests with
+// the same settings share their connections instead of leaving new ones open
+var httpTransports = struct {
+	sync.Mutex
+	transports map[string]httpCachedTransport
+}{
+	transports: map[string]httpCachedTransport{},
+}
+
+// httpCachedTransport is a transport along with the modification times and sizes
+// of the files named by its TLS settings when it was created
+type httpCachedTransport struct {
+	transport *http.Transport
+	files     string
+}
+
+// httpRequest is a request read from a table passed to http.parallel
+type httpRequest struct {
+	method   string
+	url      string
+	body     string
+	username string
+	password string
+	header   map[string]string
+	tls      map[string]string
+	client   *http.Client
+
+	// The error of setting up the client, such as an unreadable certificate,
+	// which is returned as the response of the request
+	err error
+}
+
+// httpResponse is the outcome of a request made by http.parallel
+type httpResponse struct {
+	status int
+	header http.Header
+	body   string
+	err    error
+}
+
 var httpLibrary = []lua.RegistryFunction{
 	lua.RegistryFunction{
 		Name: "get",
@@ -21,7 +73,7 @@ var httpLibrary = []lua.RegistryFunction{
 
 			req, err := http.NewRequest("GET", url, nil)
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			argIndex := 2
@@ -48,29 +100,19 @@ var httpLibrary = []lua.RegistryFunction{
 
 			// see if there is another table in the arguments, and extract the TLS
 			// information from there
-			useTLS := false
-			var tlsConfig *tls.Config
+			var tlsSettings map[string]string
 
 			argIndex++
 			if l.IsTable(argIndex) {
-				useTLS = true
-				var tlsSettings map[string]string
 				tlsSettings, err = util.PullStringTable(l, argIndex)
 				if err != nil {
 					lua.Errorf(l, "Error reading TLS Settings table: %s", err.Error())
 				}
-				tlsConfig = tlsConfigFromLuaTable(l, tlsSettings)
 			}
 
-			var client *http.Client
-			if useTLS {
-				client = &http.Client{
-					Transport: &http.Transport{
-						TLSClientConfig: tlsConfig,
-					},
-				}
-			} else {
-				client = http.DefaultClient
+			client, err := httpClient(l, tlsSettings, 0)
+			if err != nil {
+				raiseError(l, err)
 			}
 
 			if len(username) > 0 || len(password) > 0 {
@@ -79,14 +121,14 @@ var httpLibrary = []lua.RegistryFunction{
 
 			resp, err := client.Do(req)
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			defer resp.Body.Close()
 
 			data, err := ioutil.ReadAll(resp.Body)
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			util.DeepPush(l, string(data))
@@ -102,7 +144,7 @@ var httpLibrary = []lua.RegistryFunction{
 
 			req, err := http.NewRequest("POST", url, bytes.NewBuffer([]byte(body)))
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			argIndex := 3
@@ -129,29 +171,19 @@ var httpLibrary = []lua.RegistryFunction{
 
 			// see if there is another table in the arguments, and extract the TLS
 			// information from there
-			useTLS := false
-			var tlsConfig *tls.Config
+			var tlsSettings map[string]string
 
 			argIndex++
 			if l.IsTable(argIndex) {
-				useTLS = true
-				var tlsSettings map[string]string
 				tlsSettings, err = util.PullStringTable(l, argIndex)
 				if err != nil {
 					lua.Errorf(l, "Error reading TLS Settings table: %s", err.Error())
 				}
-				tlsConfig = tlsConfigFromLuaTable(l, tlsSettings)
 			}
 
-			var client *http.Client
-			if useTLS {
-				client = &http.Client{
-					Transport: &http.Transport{
-						TLSClientConfig: tlsConfig,
-					},
-				}
-			} else {
-				client = http.DefaultClient
+			client, err := httpClient(l, tlsSettings, 0)
+			if err != nil {
+				raiseError(l, err)
 			}
 
 			if len(username) > 0 || len(password) > 0 {
@@ -160,14 +192,14 @@ var httpLibrary = []lua.RegistryFunction{
 
 			resp, err := client.Do(req)
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			defer resp.Body.Close()
 
 			data, err := ioutil.ReadAll(resp.Body)
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			util.DeepPush(l, string(data))
@@ -194,7 +226,7 @@ var httpLibrary = []lua.RegistryFunction{
 				req, err = http.NewRequest(method, url, nil)
 			}
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			argIndex := 4
@@ -221,29 +253,19 @@ var httpLibrary = []lua.RegistryFunction{
 
 			// see if there is another table in the arguments, and extract the TLS
 			// information from there
-			useTLS := false
-			var tlsConfig *tls.Config
+			var tlsSettings map[string]string
 
 			argIndex++
 			if l.IsTable(argIndex) {
-				useTLS = true
-				var tlsSettings map[string]string
 				tlsSettings, err = util.PullStringTable(l, argIndex)
 				if err != nil {
 					lua.Errorf(l, "Error reading TLS Settings table: %s", err.Error())
 				}
-				tlsConfig = tlsConfigFromLuaTable(l, tlsSettings)
 			}
 
-			var client *http.Client
-			if useTLS {
-				client = &http.Client{
-					Transport: &http.Transport{
-						TLSClientConfig: tlsConfig,
-					},
-				}
-			} else {
-				client = http.DefaultClient
+			client, err := httpClient(l, tlsSettings, 0)
+			if err != nil {
+				raiseError(l, err)
 			}
 
 			if len(username) > 0 || len(password) > 0 {
@@ -252,14 +274,14 @@ var httpLibrary = []lua.RegistryFunction{
 
 			resp, err := client.Do(req)
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			defer resp.Body.Close()
 
 			data, err := ioutil.ReadAll(resp.Body)
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			util.DeepPush(l, string(data))
@@ -267,9 +289,336 @@ var httpLibrary = []lua.RegistryFunction{
 			return 1
 		},
 	},
+	lua.RegistryFunction{
+		Name: "parallel",
+		Function: func(l *lua.State) int {
+			requests := checkHTTPRequests(l, 1)
+			concurrency, timeout := checkHTTPParallelOptions(l, 2)
+
+			for index := range requests {
+				requests[index].client, requests[index].err = httpClient(l, requests[index].tls, timeout)
+			}
+
+			pushHTTPResponses(l, doHTTPRequests(requests, concurrency))
+
+			return 1
+		},
+	},
+}
+
+// checkHTTPRequests reads the list of requests passed to http.parallel. Each one is
+// either a URL to GET or a table with url, method, body, headers, username,
+// password and tls fields, which work like the arguments of http.custom
+func checkHTTPRequests(l *lua.State, index int) []httpRequest {
+	lua.CheckType(l, index, lua.TypeTable)
+
+	requests := []httpRequest{}
+
+	for i := 1; i <= l.RawLength(index); i++ {
+		l.RawGetInt(index, i)
+
+		if l.IsString(-1) {
+			requests = append(requests, httpRequest{method: "GET", url: lua.CheckString(l, -1)})
+			l.Pop(1)
+			continue
+		}
+
+		if !l.IsTable(-1) {
+			lua.Errorf(l, "Request %d must be a URL or a table", i)
+		}
+
+		r := httpRequest{}
+
+		l.Field(-1, "url")
+		r.url = lua.OptString(l, -1, "")
+		l.Pop(1)
+
+		if r.url == "" {
+			lua.Errorf(l, "Request %d is missing its url", i)
+		}
+
+		l.Field(-1, "method")
+		r.method = strings.ToUpper(lua.OptString(l, -1, "GET"))
+		l.Pop(1)
+
+		l.Field(-1, "body")
+		r.body = lua.OptString(l, -1, "")
+		l.Pop(1)
+
+		l.Field(-1, "username")
+		r.username = lua.OptString(l, -1, "")
+		l.Pop(1)
+
+		l.Field(-1, "password")
+		r.password = lua.OptString(l, -1, "")
+		l.Pop(1)
+
+		l.Field(-1, "headers")
+		if l.IsTable(-1) {
+			header, err := util.PullStringTable(l, l.Top())
+
+			if err != nil {
+				lua.Errorf(l, "Error reading the headers of request %d: %s", i, err.Error())
+			}
+
+			r.header = header
+		}
+		l.Pop(1)
+
+		l.Field(-1, "tls")
+		if l.IsTable(-1) {
+			tlsSettings, err := util.PullStringTable(l, l.Top())
+
+			if err != nil {
+				lua.Errorf(l, "Error reading TLS Settings table: %s", err.Error())
+			}
+
+			r.tls = tlsSettings
+		}
+		l.Pop(1)
+
+		l.Pop(1)
+
+		requests = append(requests, r)
+	}
+
+	return requests
+}
+
+// checkHTTPParallelOptions reads the concurrency and the timeout, in seconds or as
+// a time interval like "5s", from the options table passed to http.parallel
+func checkHTTPParallelOptions(l *lua.State, index int) (int, time.Duration) {
+	concurrency := defaultHTTPConcurrency
+	timeout := defaultHTTPTimeout
+
+	if !l.IsTable(index) {
+		return concurrency, timeout
+	}
+
+	l.Field(index, "concurrency")
+	concurrency = lua.OptInteger(l, -1, defaultHTTPConcurrency)
+	l.Pop(1)
+
+	if concurrency < 1 {
+		lua.Errorf(l, "The concurrency must be at least 1")
+	}
+
+	l.Field(index, "timeout")
+	switch l.TypeOf(-1) {
+	case lua.TypeString:
+		duration, err := config.ParseTimeInterval(lua.CheckString(l, -1))
+
+		if err != nil {
+			raiseError(l, err)
+		}
+
+		timeout = duration
+
+	case lua.TypeNumber:
+		timeout = time.Duration(lua.CheckNumber(l, -1) * float64(time.Second))
+	}
+	l.Pop(1)
+
+	return concurrency, timeout
+}
+
+// httpClient returns a client for requests with the given TLS settings and timeout.
+// Scripts that run with fixtures get a client that answers from them
+func httpClient(l *lua.State, tlsSettings map[string]string, timeout time.Duration) (*http.Client, error) {
+	if fixtures := stateFixtures(l); fixtures != nil {
+		return &http.Client{Transport: &httpFixtureTransport{fixtures: fixtures.HTTP}, Timeout: timeout}, nil
+	}
+
+	if tlsSettings == nil && timeout == 0 {
+		return http.DefaultClient, nil
+	}
+
+	client := &http.Client{Timeout: timeout}
+
+	if tlsSettings != nil {
+		transport, err := httpTransport(tlsSettings)
+
+		if err != nil {
+			return nil, err
+		}
+
+		client.Transport = transport
+	}
+
+	return client, nil
+}
+
+// The TLS settings that name files, which are read when a transport is created
+var tlsFileSettings = []string{"RootCAs", "certFile", "keyFile"}
+
+// httpTransport returns the transport for a set of TLS settings. The transport is
+// replaced when a file named by the settings changes, so that renewed certificates
+// are used without restarting the Agent
+func httpTransport(tlsSettings map[string]string) (*http.Transport, error) {
+	keys := make([]string, 0, len(tlsSettings))
+
+	for key := range tlsSettings {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	id := ""
+
+	for _, key := range keys {
+		id += key + "\x00" + tlsSettings[key] + "\x00"
+	}
+
+	// Files that can't be read are reported by tlsConfigFromSettings
+	files := ""
+
+	for _, key := range tlsFileSettings {
+		if path, ok := tlsSettings[key]; ok {
+			if info, err := os.Stat(path); err == nil {
+				files += fmt.Sprintf("%d:%d\x00", info.ModTime().UnixNano(), info.Size())
+			}
+		}
+	}
+
+	httpTransports.Lock()
+	defer httpTransports.Unlock()
+
+	cached, ok := httpTransports.transports[id]
+
+	if ok && cached.files == files {
+		return cached.transport, nil
+	}
+
+	tlsConfig, err := tlsConfigFromSettings(tlsSettings)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ok {
+		cached.transport.CloseIdleConnections()
+	}
+
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+		IdleConnTimeout: 90 * time.Second,
+	}
+
+	httpTransports.transports[id] = httpCachedTransport{transport: transport, files: files}
+
+	return transport, nil
+}
+
+func (r httpRequest) do() httpResponse {
+	if r.err != nil {
+		return httpResponse{err: r.err}
+	}
+
+	var body *bytes.Buffer
+
+	if len(r.body) > 0 {
+		body = bytes.NewBuffer([]byte(r.body))
+	}
+
+	var req *http.Request
+	var err error
+
+	if body != nil {
+		req, err = http.NewRequest(r.method, r.url, body)
+	} else {
+		req, err = http.NewRequest(r.method, r.url, nil)
+	}
+
+	if err != nil {
+		return httpResponse{err: err}
+	}
+
+	for key, value := range r.header {
+		req.Header.Set(key, value)
+	}
+
+	if len(r.username) > 0 || len(r.password) > 0 {
+		req.SetBasicAuth(r.username, r.password)
+	}
+
+	resp, err := r.client.Do(req)
+
+	if err != nil {
+		return httpResponse{err: err}
+	}
+
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return httpResponse{err: err}
+	}
+
+	return httpResponse{status: resp.StatusCode, header: resp.Header, body: string(data)}
+}
+
+// doHTTPRequests runs the requests with at most concurrency of them in flight, and
+// returns the responses in the same order
+func doHTTPRequests(requests []httpRequest, concurrency int) []httpResponse {
+	responses := make([]httpResponse, len(requests))
+	slots := make(chan bool, concurrency)
+	wg := sync.WaitGroup{}
+
+	for index, r := range requests {
+		wg.Add(1)
+		slots <- true
+
+		go func(index int, r httpRequest) {
+			defer wg.Done()
+
+			responses[index] = r.do()
+
+			<-slots
+		}(index, r)
+	}
+
+	wg.Wait()
+
+	return responses
+}
+
+// pushHTTPResponses pushes an array with a table for each response. Failed requests
+// only have an error field, so that one failure doesn't abort the whole script
+func pushHTTPResponses(l *lua.State, responses []httpResponse) {
+	pushArray(l)
+
+	for index, response := range responses {
+		l.NewTable()
+
+		if response.err != nil {
+			l.PushString(response.err.Error())
+			l.SetField(-2, "error")
+		} else {
+			l.PushInteger(response.status)
+			l.SetField(-2, "status")
+
+			l.PushString(response.body)
+			l.SetField(-2, "body")
+
+			l.NewTable()
+
+			for key := range response.header {
+				l.PushString(response.header.Get(key))
+				l.SetField(-2, key)
+			}
+
+			l.SetField(-2, "headers")
+		}
+
+		l.RawSetInt(-2, index+1)
+	}
 }
 
-func tlsConfigFromLuaTable(l *lua.State, tlsSettings map[string]string) *tls.Config {
+// tlsConfigFromSettings reads the TLS settings of a request, along with the files
+// that they name
+func tlsConfigFromSettings(tlsSettings map[string]string) (*tls.Config, error) {
 	var tlsKeyPath, tlsCertPath string
 	var tlsConfig tls.Config
 	for key, value := range tlsSettings {
@@ -277,19 +626,19 @@ func tlsConfigFromLuaTable(l *lua.State, tlsSettings map[string]string) *tls.Con
 		case "InsecureSkipVerify":
 			v, err := strconv.ParseBool(value)
 			if err != nil {
-				lua.Errorf(l, "Error in TLS Settings for '%s': %s", key, err.Error())
+				return nil, fmt.Errorf("Error in TLS Settings for '%s': %s", key, err.Error())
 			}
 			tlsConfig.InsecureSkipVerify = v
 		case "SessionTicketsDisabled":
 			v, err := strconv.ParseBool(value)
 			if err != nil {
-				lua.Errorf(l, "Error in TLS Settings for '%s': %s", key, err.Error())
+				return nil, fmt.Errorf("Error in TLS Settings for '%s': %s", key, err.Error())
 			}
 			tlsConfig.SessionTicketsDisabled = v
 		case "PreferServerCipherSuites":
 			v, err := strconv.ParseBool(value)
 			if err != nil {
-				lua.Errorf(l, "Error in TLS Settings for '%s': %s", key, err.Error())
+				return nil, fmt.Errorf("Error in TLS Settings for '%s': %s", key, err.Error())
 			}
 			tlsConfig.PreferServerCipherSuites = v
 		case "MinVersion":
@@ -303,7 +652,7 @@ func tlsConfigFromLuaTable(l *lua.State, tlsSettings map[string]string) *tls.Con
 			case "VersionTLS12":
 				tlsConfig.MinVersion = tls.VersionTLS12
 			default:
-				lua.Errorf(l, "Error in TLS Settings for '%s': value '%s' is not an accepted value", key, value)
+				return nil, fmt.Errorf("Error in TLS Settings for '%s': value '%s' is not an accepted value", key, value)
 			}
 		case "MaxVersion":
 			switch value {
@@ -316,7 +665,7 @@ func tlsConfigFromLuaTable(l *lua.State, tlsSettings map[string]string) *tls.Con
 			case "VersionTLS12":
 				tlsConfig.MaxVersion = tls.VersionTLS12
 			default:
-				lua.Errorf(l, "Error in TLS Settings for '%s': value '%s' is not an accepted value", key, value)
+				return nil, fmt.Errorf("Error in TLS Settings for '%s': value '%s' is not an accepted value", key, value)
 			}
 		case "CipherSuites":
 			var clientSupportedCiphers []uint16
@@ -357,18 +706,18 @@ func tlsConfigFromLuaTable(l *lua.State, tlsSettings map[string]string) *tls.Con
 				case "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":
 					clientSupportedCiphers = append(clientSupportedCiphers, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384)
 				default:
-					lua.Errorf(l, "Error in TLS Settings for '%s': '%s' is not an accepted cipher", key, cipher)
+					return nil, fmt.Errorf("Error in TLS Settings for '%s': '%s' is not an accepted cipher", key, cipher)
 				}
 			}
 		case "RootCAs":
 			caBytes, err := ioutil.ReadFile(value)
 			if err != nil {
-				lua.Errorf(l, "Error in TLS Settings for '%s': could not read CA data from '%s': %s", key, value, err.Error())
+				return nil, fmt.Errorf("Error in TLS Settings for '%s': could not read CA data from '%s': %s", key, value, err.Error())
 			}
 			caPool := x509.NewCertPool()
 			ok := caPool.AppendCertsFromPEM(caBytes)
 			if !ok {
-				lua.Errorf(l, "Error in TLS Settings for '%s': could not append certs to root CA pool: %s", key, err.Error())
+				return nil, fmt.Errorf("Error in TLS Settings for '%s': could not append certs to root CA pool from '%s'", key, value)
 			}
 			tlsConfig.RootCAs = caPool
 		case "certFile":
@@ -384,13 +733,13 @@ func tlsConfigFromLuaTable(l *lua.State, tlsSettings map[string]string) *tls.Con
 	if tlsKeyPath != "" && tlsCertPath != "" {
 		cert, err := tls.LoadX509KeyPair(tlsCertPath, tlsKeyPath)
 		if err != nil {
-			lua.Errorf(l, "Error in TLS Settings: could not load cert and/or key from '%s' / '%s': %s", tlsCertPath, tlsKeyPath, err.Error())
+			return nil, fmt.Errorf("Error in TLS Settings: could not load cert and/or key from '%s' / '%s': %s", tlsCertPath, tlsKeyPath, err.Error())
 		}
 
 		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
 
-	return &tlsConfig
+	return &tlsConfig, nil
 }
 
 func openHTTPLibrary(l *lua.State) {
@@ -18,7 +18,7 @@ var jsonLibrary = []lua.RegistryFunction{
 
 			if l.IsTable(1) {
 				if v, err = util.PullTable(l, 1); err != nil {
-					lua.Errorf(l, "%s", err.Error())
+					raiseError(l, err)
 				}
 			} else {
 				v = l.ToValue(1)
@@ -27,7 +27,7 @@ var jsonLibrary = []lua.RegistryFunction{
 			res, err := json.Marshal(v)
 
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			util.DeepPush(l, string(res))
@@ -42,7 +42,7 @@ var jsonLibrary = []lua.RegistryFunction{
 			err := json.Unmarshal([]byte(lua.CheckString(l, 1)), &res)
 
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			util.DeepPush(l, res)
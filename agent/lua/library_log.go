@@ -0,0 +1,55 @@
+package lua
+
+import (
+	"github.com/telemetryapp/go-lua"
+	"github.com/telemetryapp/goluago/util"
+)
+
+type logProvider interface {
+	Log(level string, message string, fields map[string]interface{})
+}
+
+func openLogLibrary(l *lua.State, p logProvider) {
+	logLibrary := []lua.RegistryFunction{}
+
+	for _, level := range []string{"debug", "info", "warn", "error"} {
+		level := level
+
+		logLibrary = append(logLibrary, lua.RegistryFunction{
+			Name: level,
+			Function: func(l *lua.State) int {
+				message := lua.CheckString(l, 1)
+				fields := map[string]interface{}{}
+
+				if !l.IsNoneOrNil(2) {
+					lua.CheckType(l, 2, lua.TypeTable)
+
+					v, err := util.PullTable(l, 2)
+
+					if err != nil {
+						raiseError(l, err)
+					}
+
+					f, ok := v.(map[string]interface{})
+
+					if !ok {
+						lua.Errorf(l, "Log fields must be a table of key/value pairs")
+					}
+
+					fields = f
+				}
+
+				p.Log(level, message, fields)
+				return 0
+			},
+		})
+	}
+
+	open := func(l *lua.State) int {
+		lua.NewLibrary(l, logLibrary)
+		return 1
+	}
+
+	lua.Require(l, "telemetry/log", open, false)
+	l.Pop(1)
+}
@@ -1,9 +1,131 @@
 package lua
 
 import (
+	"github.com/globalsign/mgo"
 	"github.com/telemetryapp/go-lua"
 )
 
+// The library works with these interfaces instead of the mgo types, so that fixtures
+// can answer its operations. They are implemented by the mgo adapters below
+type mongoSession interface {
+	DB(name string) mongoDatabase
+	LiveServers() []string
+	DatabaseNames() ([]string, error)
+	Close()
+}
+
+type mongoDatabase interface {
+	CollectionNames() ([]string, error)
+	C(name string) mongoCollection
+	Run(cmd interface{}, result interface{}) error
+}
+
+type mongoCollection interface {
+	Name() string
+	Find(query interface{}) mongoQuery
+	Aggregate(pipeline []interface{}, result *[]interface{}) error
+}
+
+type mongoQuery interface {
+	Sort(fields ...string) mongoQuery
+	Limit(n int) mongoQuery
+	Skip(n int) mongoQuery
+	Select(selector interface{}) mongoQuery
+	All(result *[]interface{}) error
+	One(result *interface{}) error
+	Count() (int, error)
+	Distinct(key string, result *[]interface{}) error
+}
+
+// mgoSession adapts *mgo.Session, and the types below the other mgo types
+type mgoSession struct {
+	s *mgo.Session
+}
+
+func (s mgoSession) DB(name string) mongoDatabase {
+	return mgoDatabase{s.s.DB(name)}
+}
+
+func (s mgoSession) LiveServers() []string {
+	return s.s.LiveServers()
+}
+
+func (s mgoSession) DatabaseNames() ([]string, error) {
+	return s.s.DatabaseNames()
+}
+
+func (s mgoSession) Close() {
+	s.s.Close()
+}
+
+type mgoDatabase struct {
+	db *mgo.Database
+}
+
+func (db mgoDatabase) CollectionNames() ([]string, error) {
+	return db.db.CollectionNames()
+}
+
+func (db mgoDatabase) C(name string) mongoCollection {
+	return mgoCollection{db.db.C(name)}
+}
+
+func (db mgoDatabase) Run(cmd interface{}, result interface{}) error {
+	return db.db.Run(cmd, result)
+}
+
+type mgoCollection struct {
+	c *mgo.Collection
+}
+
+func (c mgoCollection) Name() string {
+	return c.c.Name
+}
+
+func (c mgoCollection) Find(query interface{}) mongoQuery {
+	return mgoQuery{c.c.Find(query)}
+}
+
+func (c mgoCollection) Aggregate(pipeline []interface{}, result *[]interface{}) error {
+	return c.c.Pipe(pipeline).AllowDiskUse().All(result)
+}
+
+type mgoQuery struct {
+	q *mgo.Query
+}
+
+func (q mgoQuery) Sort(fields ...string) mongoQuery {
+	return mgoQuery{q.q.Sort(fields...)}
+}
+
+func (q mgoQuery) Limit(n int) mongoQuery {
+	return mgoQuery{q.q.Limit(n)}
+}
+
+func (q mgoQuery) Skip(n int) mongoQuery {
+	return mgoQuery{q.q.Skip(n)}
+}
+
+func (q mgoQuery) Select(selector interface{}) mongoQuery {
+	return mgoQuery{q.q.Select(selector)}
+}
+
+func (q mgoQuery) All(result *[]interface{}) error {
+	return q.q.All(result)
+}
+
+func (q mgoQuery) One(result *interface{}) error {
+	return q.q.One(result)
+}
+
+func (q mgoQuery) Count() (int, error) {
+	return q.q.Count()
+}
+
+func (q mgoQuery) Distinct(key string, result *[]interface{}) error {
+	return q.q.Distinct(key, result)
+}
+
 var mongoLibrary = []lua.RegistryFunction{
 	lua.RegistryFunction{
 		Name: "open",
@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/globalsign/mgo"
@@ -16,8 +17,42 @@ import (
 	"github.com/telemetryapp/goluago/util"
 )
 
-var mongoConnectionFunctions = map[string]func(s *mgo.Session) lua.Function{
-	"db": func(s *mgo.Session) lua.Function {
+// mongoSessions keeps one master session per connection string. Each call to
+// mongodb.open receives a copy of the master session, which reuses its socket pool
+// instead of dialing the server again
+var mongoSessions = struct {
+	sync.Mutex
+	sessions map[string]*mgo.Session
+}{
+	sessions: map[string]*mgo.Session{},
+}
+
+func getMongoSession(connectionString string) (*mgo.Session, error) {
+	mongoSessions.Lock()
+	defer mongoSessions.Unlock()
+
+	master, ok := mongoSessions.sessions[connectionString]
+
+	if !ok {
+		ci, err := parseMongoURI(connectionString)
+		if err != nil {
+			return nil, err
+		}
+
+		master, err = mgo.DialWithInfo(ci)
+
+		if err != nil {
+			return nil, err
+		}
+
+		mongoSessions.sessions[connectionString] = master
+	}
+
+	return master.Copy(), nil
+}
+
+var mongoConnectionFunctions = map[string]func(s mongoSession) lua.Function{
+	"db": func(s mongoSession) lua.Function {
 		return func(l *lua.State) int {
 			pushMongoDatabase(l, s, lua.CheckString(l, 1))
 
@@ -25,7 +60,7 @@ var mongoConnectionFunctions = map[string]func(s *mgo.Session) lua.Function{
 		}
 	},
 
-	"live_servers": func(s *mgo.Session) lua.Function {
+	"live_servers": func(s mongoSession) lua.Function {
 		return func(l *lua.State) int {
 			pushArray(l)
 
@@ -38,14 +73,14 @@ var mongoConnectionFunctions = map[string]func(s *mgo.Session) lua.Function{
 		}
 	},
 
-	"database_names": func(s *mgo.Session) lua.Function {
+	"database_names": func(s mongoSession) lua.Function {
 		return func(l *lua.State) int {
 			pushArray(l)
 
 			dbNames, err := s.DatabaseNames()
 
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			for index, dbName := range dbNames {
@@ -57,7 +92,7 @@ var mongoConnectionFunctions = map[string]func(s *mgo.Session) lua.Function{
 		}
 	},
 
-	"close": func(s *mgo.Session) lua.Function {
+	"close": func(s mongoSession) lua.Function {
 		return func(l *lua.State) int {
 			s.Close()
 
@@ -67,16 +102,18 @@ var mongoConnectionFunctions = map[string]func(s *mgo.Session) lua.Function{
 }
 
 func pushGoConnection(l *lua.State, connectionString string) {
-	ci, err := parseMongoURI(connectionString)
-	if err != nil {
-		lua.Errorf(l, "%s", err.Error())
-	}
+	var s mongoSession
 
-	//s, err := mgo.Dial(connectionString)
-	s, err := mgo.DialWithInfo(ci)
+	if fixtures := stateFixtures(l); fixtures != nil {
+		s = &mongoFixtureSession{fixtures: fixtures.MongoDB}
+	} else {
+		session, err := getMongoSession(connectionString)
 
-	if err != nil {
-		lua.Errorf(l, "%s", err.Error())
+		if err != nil {
+			raiseError(l, err)
+		}
+
+		s = mgoSession{session}
 	}
 
 	l.NewTable()
@@ -86,14 +123,8 @@ func pushGoConnection(l *lua.State, connectionString string) {
 		l.SetField(-2, name)
 	}
 
-	l.CreateTable(0, 1)
-	l.PushGoFunction(func(l *lua.State) int {
-		s.Close()
-
-		return 0
-	})
-	l.SetField(-2, "__gc")
-	l.SetMetaTable(-2)
+	// Copies that the script doesn't close are returned to the pool when it finishes
+	addCleanup(l, s.Close)
 }
 
 func parseMongoURI(rawURI string) (*mgo.DialInfo, error) {
@@ -3,18 +3,17 @@ package lua
 import (
 	"encoding/json"
 
-	"github.com/globalsign/mgo"
 	"github.com/telemetryapp/go-lua"
 	"github.com/telemetryapp/goluago/util"
 )
 
-var mongoDBFunctions = map[string]func(db *mgo.Database) lua.Function{
-	"collections": func(db *mgo.Database) lua.Function {
+var mongoDBFunctions = map[string]func(db mongoDatabase) lua.Function{
+	"collections": func(db mongoDatabase) lua.Function {
 		return func(l *lua.State) int {
 			names, err := db.CollectionNames()
 
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			pushArray(l)
@@ -28,7 +27,7 @@ var mongoDBFunctions = map[string]func(db *mgo.Database) lua.Function{
 		}
 	},
 
-	"collection": func(db *mgo.Database) lua.Function {
+	"collection": func(db mongoDatabase) lua.Function {
 		return func(l *lua.State) int {
 			pushMongoCollection(l, db, lua.CheckString(l, 1))
 
@@ -36,26 +35,26 @@ var mongoDBFunctions = map[string]func(db *mgo.Database) lua.Function{
 		}
 	},
 
-	"command": func(db *mgo.Database) lua.Function {
+	"command": func(db mongoDatabase) lua.Function {
 		return func(l *lua.State) int {
 			var result interface{}
 
 			cmd, err := util.PullTable(l, 1)
 
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			err = db.Run(cmd, &result)
 
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			bytes, err := json.Marshal(&result)
 
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			var resultJSON interface{}
@@ -68,7 +67,7 @@ var mongoDBFunctions = map[string]func(db *mgo.Database) lua.Function{
 	},
 }
 
-func pushMongoDatabase(l *lua.State, s *mgo.Session, dbName string) {
+func pushMongoDatabase(l *lua.State, s mongoSession, dbName string) {
 	db := s.DB(dbName)
 
 	l.NewTable()
@@ -10,28 +10,27 @@ import (
 	"github.com/telemetryapp/go-lua"
 	"github.com/telemetryapp/goluago/util"
 
-	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 )
 
-var mongoCollectionFunctions = map[string]func(c *mgo.Collection) lua.Function{
-	"find": func(collection *mgo.Collection) lua.Function {
+var mongoCollectionFunctions = map[string]func(c mongoCollection) lua.Function{
+	"find": func(collection mongoCollection) lua.Function {
 		return func(l *lua.State) int {
 
 			var err error
 			var query interface{}
 
 			if l.IsTable(1) {
-				query, err = util.PullTable(l, 1)
+				query, err = pullTable(l, 1)
 				if err != nil {
-					lua.Errorf(l, "%s", err.Error())
+					raiseError(l, err)
 				}
 
 				// Convert basic types into BSON types
 				if queryMap, ok := query.(map[string]interface{}); ok {
 					query, err = convertTypes(queryMap)
 					if err != nil {
-						lua.Errorf(l, "%s", err.Error())
+						raiseError(l, err)
 					}
 				} else {
 					lua.Errorf(l, "failed to convert query to 'map[string]interface{}' (pre-requisite to convert types)")
@@ -44,11 +43,11 @@ var mongoCollectionFunctions = map[string]func(c *mgo.Collection) lua.Function{
 			queryResult := collection.Find(query)
 
 			if skip > 0 {
-				queryResult.Skip(skip)
+				queryResult = queryResult.Skip(skip)
 			}
 
 			if limit >= 0 {
-				queryResult.Limit(limit)
+				queryResult = queryResult.Limit(limit)
 			}
 
 			pushMongoQuery(l, queryResult)
@@ -56,24 +55,117 @@ var mongoCollectionFunctions = map[string]func(c *mgo.Collection) lua.Function{
 			return 1
 		}
 	},
-	"name": func(c *mgo.Collection) lua.Function {
+	"aggregate": func(collection mongoCollection) lua.Function {
 		return func(l *lua.State) int {
-			l.PushString(c.Name)
+			stages, err := pullTable(l, 1)
+			if err != nil {
+				raiseError(l, err)
+			}
+
+			pipeline, ok := stages.([]interface{})
+			if !ok {
+				lua.Errorf(l, "The aggregation pipeline must be an array of stages")
+			}
+
+			for index, stage := range pipeline {
+				if stageMap, ok := stage.(map[string]interface{}); ok {
+					if pipeline[index], err = convertTypes(stageMap); err != nil {
+						raiseError(l, err)
+					}
+				} else {
+					lua.Errorf(l, "Stage %d of the aggregation pipeline is not a table", index+1)
+				}
+			}
+
+			var result []interface{}
+
+			err = collection.Aggregate(pipeline, &result)
+
+			if err != nil {
+				raiseError(l, err)
+			}
+
+			pushMongoResult(l, &result)
+
+			return 1
+		}
+	},
+	"name": func(c mongoCollection) lua.Function {
+		return func(l *lua.State) int {
+			l.PushString(c.Name())
 
 			return 1
 		}
 	},
 }
 
-var mongoQueryFunctions = map[string]func(query *mgo.Query) lua.Function{
-	"all": func(query *mgo.Query) lua.Function {
+// mongoQueryModifiers change the options of a query. The query is pushed back onto
+// the stack so that calls can be chained: c.find({}).sort("-ts").limit(10).all()
+var mongoQueryModifiers = map[string]func(l *lua.State, query mongoQuery) mongoQuery{
+	"sort": func(l *lua.State, query mongoQuery) mongoQuery {
+		return query.Sort(checkMongoSortFields(l)...)
+	},
+	"limit": func(l *lua.State, query mongoQuery) mongoQuery {
+		return query.Limit(lua.CheckInteger(l, 1))
+	},
+	"skip": func(l *lua.State, query mongoQuery) mongoQuery {
+		skip := lua.CheckInteger(l, 1)
+		lua.ArgumentCheck(l, skip >= 0, 1, "the number of documents to skip can't be negative")
+
+		return query.Skip(skip)
+	},
+	"select": func(l *lua.State, query mongoQuery) mongoQuery {
+		return query.Select(checkMongoProjection(l))
+	},
+}
+
+// checkMongoSortFields reads the fields of a sort, each with an optional `+` or `-`
+// prefix for the direction. mgo panics on empty field names, so they are raised
+// as errors instead
+func checkMongoSortFields(l *lua.State) []string {
+	fields := []string{}
+
+	for i := 1; i <= l.Top(); i++ {
+		field := lua.CheckString(l, i)
+
+		lua.ArgumentCheck(l, strings.TrimLeft(field, "+-") != "", i, "empty field name")
+
+		fields = append(fields, field)
+	}
+
+	return fields
+}
+
+// checkMongoProjection reads either a projection table or a list of field names to
+// include in the results
+func checkMongoProjection(l *lua.State) interface{} {
+	if l.IsTable(1) {
+		projection, err := pullTable(l, 1)
+		if err != nil {
+			raiseError(l, err)
+		}
+
+		return projection
+	}
+
+	fields := bson.M{}
+
+	for i := 1; i <= l.Top(); i++ {
+		fields[lua.CheckString(l, i)] = 1
+	}
+
+	return fields
+}
+
+var mongoQueryFunctions = map[string]func(query mongoQuery) lua.Function{
+	"all": func(query mongoQuery) lua.Function {
 		return func(l *lua.State) int {
 			var result []interface{}
 
 			err := query.All(&result)
 
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			pushMongoResult(l, &result)
@@ -81,14 +173,14 @@ var mongoQueryFunctions = map[string]func(query *mgo.Query) lua.Function{
 			return 1
 		}
 	},
-	"one": func(query *mgo.Query) lua.Function {
+	"one": func(query mongoQuery) lua.Function {
 		return func(l *lua.State) int {
 			var result interface{}
 
 			err := query.One(&result)
 
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			var p []interface{}
@@ -98,12 +190,12 @@ var mongoQueryFunctions = map[string]func(query *mgo.Query) lua.Function{
 			return 1
 		}
 	},
-	"count": func(query *mgo.Query) lua.Function {
+	"count": func(query mongoQuery) lua.Function {
 		return func(l *lua.State) int {
 			count, err := query.Count()
 
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			l.PushInteger(count)
@@ -111,7 +203,7 @@ var mongoQueryFunctions = map[string]func(query *mgo.Query) lua.Function{
 			return 1
 		}
 	},
-	"distinct": func(query *mgo.Query) lua.Function {
+	"distinct": func(query mongoQuery) lua.Function {
 		return func(l *lua.State) int {
 			var result []interface{}
 
@@ -119,7 +211,7 @@ var mongoQueryFunctions = map[string]func(query *mgo.Query) lua.Function{
 			err := query.Distinct(key, &result)
 
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			pushMongoResult(l, &result)
@@ -139,6 +231,17 @@ func convertTypes(query map[string]interface{}) (interface{}, error) {
 			if err != nil {
 				return nil, err
 			}
+		case []interface{}:
+			// Convert any maps contained in arrays, such as the operands of $in or $and
+			for index, item := range valueType {
+				if itemMap, ok := item.(map[string]interface{}); ok {
+					var err error
+					valueType[index], err = convertTypes(itemMap)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
 		case string:
 			// We are looking for values with a type (#) prefix
 			if strings.HasPrefix(valueType, "#") {
@@ -180,7 +283,7 @@ func pushMongoResult(l *lua.State, result *[]interface{}) {
 	bytes, err := json.Marshal(&result)
 
 	if err != nil {
-		lua.Errorf(l, "%s", err.Error())
+		raiseError(l, err)
 	}
 
 	var resultJSON []interface{}
@@ -194,7 +297,7 @@ func pushMongoResult(l *lua.State, result *[]interface{}) {
 	}
 }
 
-func pushMongoCollection(l *lua.State, db *mgo.Database, name string) {
+func pushMongoCollection(l *lua.State, db mongoDatabase, name string) {
 	c := db.C(name)
 
 	l.NewTable()
@@ -205,11 +308,22 @@ func pushMongoCollection(l *lua.State, db *mgo.Database, name string) {
 	}
 }
 
-func pushMongoQuery(l *lua.State, query *mgo.Query) {
+func pushMongoQuery(l *lua.State, query mongoQuery) {
 	l.NewTable()
 
 	for name, fn := range mongoQueryFunctions {
 		l.PushGoFunction(fn(query))
 		l.SetField(-2, name)
 	}
+
+	for name, modifier := range mongoQueryModifiers {
+		modifier := modifier
+
+		l.PushGoFunction(func(l *lua.State) int {
+			pushMongoQuery(l, modifier(l, query))
+
+			return 1
+		})
+		l.SetField(-2, name)
+	}
 }
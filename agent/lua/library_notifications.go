@@ -30,7 +30,7 @@ func openNotificationsLibrary(l *lua.State, p notificationProvider) {
 					dd, err := time.ParseDuration(d)
 
 					if err != nil {
-						lua.Errorf(l, "%s", err.Error())
+						raiseError(l, err)
 					}
 
 					duration = int(dd.Seconds())
@@ -15,7 +15,7 @@ func oauthRequest(l *lua.State, entryName, method, urlString string, body string
 	req, err := http.NewRequest(method, urlString, bytes.NewBuffer([]byte(body)))
 
 	if err != nil {
-		lua.Errorf(l, "%s", err.Error())
+		raiseError(l, err)
 	}
 
 	if query != "" {
@@ -23,16 +23,23 @@ func oauthRequest(l *lua.State, entryName, method, urlString string, body string
 		parsedQuery, err = url.ParseQuery(query)
 
 		if err != nil {
-			lua.Errorf(l, "%s", err.Error())
+			raiseError(l, err)
 		}
 
 		req.Form = parsedQuery
 	}
 
-	res, err := oauth.Do(entryName, req)
+	var res *http.Response
+
+	if fixtures := stateFixtures(l); fixtures != nil {
+		client := &http.Client{Transport: &httpFixtureTransport{fixtures: fixtures.OAuth, name: entryName}}
+		res, err = client.Do(req)
+	} else {
+		res, err = oauth.Do(entryName, req)
+	}
 
 	if err != nil {
-		lua.Errorf(l, "%s", err.Error())
+		raiseError(l, err)
 	}
 
 	defer res.Body.Close()
@@ -40,7 +47,7 @@ func oauthRequest(l *lua.State, entryName, method, urlString string, body string
 	data, err := ioutil.ReadAll(res.Body)
 
 	if err != nil {
-		lua.Errorf(l, "%s", err.Error())
+		raiseError(l, err)
 	}
 
 	util.DeepPush(l, string(data))
@@ -0,0 +1,151 @@
+package lua
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/PaesslerAG/gval"
+	"github.com/PaesslerAG/jsonpath"
+	"github.com/jmespath/go-jmespath"
+	"github.com/telemetryapp/go-lua"
+)
+
+// JSONPath with the full set of operators available in filters, such as
+// $.items[?(@.price < 10 && @.stock > 0)].name
+var jsonPathLanguage = gval.Full(jsonpath.Language())
+
+// checkQueryData reads the data to be queried, which is either a table or a JSON string
+func checkQueryData(l *lua.State, index int) interface{} {
+	switch l.TypeOf(index) {
+	case lua.TypeTable:
+		data, err := pullTable(l, index)
+
+		if err != nil {
+			raiseError(l, err)
+		}
+
+		return data
+
+	case lua.TypeString:
+		var data interface{}
+
+		if err := json.Unmarshal([]byte(lua.CheckString(l, index)), &data); err != nil {
+			lua.Errorf(l, "Unable to decode the JSON data: %s", err.Error())
+		}
+
+		return data
+
+	default:
+		lua.ArgumentError(l, index, "table or JSON string expected")
+		return nil
+	}
+}
+
+// The beginnings of the errors that JSONPath selectors return for paths that lead
+// nowhere
+var jsonPathNoMatchErrors = []string{
+	"unknown key ",
+	"index ",
+	"unsupported value type ",
+	"could not select value, ",
+}
+
+func isJSONPathNoMatch(err error) bool {
+	for _, prefix := range jsonPathNoMatchErrors {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// queryJSONPath evaluates a JSONPath expression. Paths that lead nowhere, like a
+// missing key or an index out of bounds, produce nil instead of an error
+func queryJSONPath(l *lua.State, data interface{}, expression string) interface{} {
+	eval, err := jsonPathLanguage.NewEvaluable(expression)
+
+	if err != nil {
+		lua.Errorf(l, "Invalid JSONPath expression `%s`: %s", expression, err.Error())
+	}
+
+	result, err := eval(context.Background(), data)
+
+	if err != nil {
+		if isJSONPathNoMatch(err) {
+			return nil
+		}
+
+		raiseError(l, fmt.Errorf("Unable to evaluate the JSONPath expression `%s`: %s", expression, err))
+	}
+
+	return result
+}
+
+func queryJMESPath(l *lua.State, data interface{}, expression string) interface{} {
+	query, err := jmespath.Compile(expression)
+
+	if err != nil {
+		lua.Errorf(l, "Invalid JMESPath expression `%s`: %s", expression, err.Error())
+	}
+
+	result, err := query.Search(data)
+
+	if err != nil {
+		raiseError(l, err)
+	}
+
+	return result
+}
+
+var queryLibrary = []lua.RegistryFunction{
+	lua.RegistryFunction{
+		Name: "jsonpath",
+		Function: func(l *lua.State) int {
+			data := checkQueryData(l, 1)
+
+			pushValue(l, queryJSONPath(l, data, lua.CheckString(l, 2)))
+			return 1
+		},
+	},
+
+	lua.RegistryFunction{
+		Name: "jmespath",
+		Function: func(l *lua.State) int {
+			data := checkQueryData(l, 1)
+
+			pushValue(l, queryJMESPath(l, data, lua.CheckString(l, 2)))
+			return 1
+		},
+	},
+
+	// Expressions that start with `$` are evaluated as JSONPath, and everything
+	// else as JMESPath
+	lua.RegistryFunction{
+		Name: "get",
+		Function: func(l *lua.State) int {
+			data := checkQueryData(l, 1)
+			expression := lua.CheckString(l, 2)
+
+			if strings.HasPrefix(strings.TrimSpace(expression), "$") {
+				pushValue(l, queryJSONPath(l, data, expression))
+			} else {
+				pushValue(l, queryJMESPath(l, data, expression))
+			}
+
+			return 1
+		},
+	},
+}
+
+func openQueryLibrary(l *lua.State) {
+	open := func(l *lua.State) int {
+		lua.NewLibrary(l, queryLibrary)
+		return 1
+	}
+
+	lua.Require(l, "telemetry/query", open, false)
+	l.Pop(1)
+}
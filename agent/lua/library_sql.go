@@ -1,17 +1,118 @@
 package lua
 
 import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
 	"github.com/telemetryapp/go-lua"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
 )
 
+// sqlPool keeps one connection pool per driver/DSN pair and pool options for the
+// lifetime of the process so that scripts can call sql.open on every run without
+// leaking handles
+var sqlPool = struct {
+	sync.Mutex
+	connections map[string]*sqlx.DB
+}{
+	connections: map[string]*sqlx.DB{},
+}
+
+// sqlPoolOptions are the optional settings that can be passed to sql.open
+type sqlPoolOptions struct {
+	maxOpen     int
+	maxIdle     int
+	maxLifetime time.Duration
+}
+
+// Jobs that open the same database with different options get pools of their
+// own, so that they don't override each other's settings
+func getSQLConnection(driverName, dataSourceName string, options *sqlPoolOptions) (*sqlx.DB, error) {
+	sqlPool.Lock()
+	defer sqlPool.Unlock()
+
+	key := driverName + "\x00" + dataSourceName
+
+	if options != nil {
+		key += fmt.Sprintf("\x00%d\x00%d\x00%s", options.maxOpen, options.maxIdle, options.maxLifetime)
+	}
+
+	db, ok := sqlPool.connections[key]
+
+	if ok {
+		return db, nil
+	}
+
+	db, err := sqlx.Open(driverName, dataSourceName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if options != nil {
+		if options.maxOpen > 0 {
+			db.SetMaxOpenConns(options.maxOpen)
+		}
+
+		if options.maxIdle > 0 {
+			db.SetMaxIdleConns(options.maxIdle)
+		}
+
+		if options.maxLifetime > 0 {
+			db.SetConnMaxLifetime(options.maxLifetime)
+		}
+	}
+
+	sqlPool.connections[key] = db
+
+	return db, nil
+}
+
+func checkSQLPoolOptions(l *lua.State, index int) *sqlPoolOptions {
+	if !l.IsTable(index) {
+		return nil
+	}
+
+	options := &sqlPoolOptions{}
+
+	l.Field(index, "max_open")
+	options.maxOpen = lua.OptInteger(l, -1, 0)
+	l.Pop(1)
+
+	l.Field(index, "max_idle")
+	options.maxIdle = lua.OptInteger(l, -1, 0)
+	l.Pop(1)
+
+	l.Field(index, "max_lifetime")
+	switch l.TypeOf(-1) {
+	case lua.TypeString:
+		duration, err := config.ParseTimeInterval(lua.CheckString(l, -1))
+
+		if err != nil {
+			raiseError(l, err)
+		}
+
+		options.maxLifetime = duration
+
+	case lua.TypeNumber:
+		options.maxLifetime = time.Duration(lua.CheckInteger(l, -1)) * time.Second
+	}
+	l.Pop(1)
+
+	return options
+}
+
 var sqlLibrary = []lua.RegistryFunction{
 	lua.RegistryFunction{
 		Name: "open",
 		Function: func(l *lua.State) int {
 			driver := lua.CheckString(l, 1)
 			connString := lua.CheckString(l, 2)
+			options := checkSQLPoolOptions(l, 3)
 
-			pushSQLInstance(l, driver, connString)
+			pushSQLInstance(l, driver, connString, options)
 
 			return 1
 		},
@@ -0,0 +1,15 @@
+package lua
+
+// Database drivers available to the telemetry/sql library. The name passed as the
+// first argument of sql.open selects the driver:
+//
+//   postgres   PostgreSQL (github.com/lib/pq)
+//   mysql      MySQL and MariaDB (github.com/go-sql-driver/mysql)
+//   sqlserver  Microsoft SQL Server (github.com/denisenkom/go-mssqldb)
+//   sqlite3    SQLite (github.com/mattn/go-sqlite3, requires cgo)
+import (
+	_ "github.com/denisenkom/go-mssqldb"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
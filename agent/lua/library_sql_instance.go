@@ -1,79 +1,465 @@
 package lua
 
 import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/jmoiron/sqlx"
 	"github.com/telemetryapp/go-lua"
 	"github.com/telemetryapp/goluago/util"
 )
 
-var sqlInstanceFunctions = map[string]func(c *sqlx.DB) lua.Function{
-	"query": func(db *sqlx.DB) lua.Function {
+// sqlConnection is satisfied by both *sqlx.DB and *sqlx.Tx, which allows the same
+// set of Lua functions to be exposed on database instances and transactions
+type sqlConnection interface {
+	Queryx(query string, args ...interface{}) (*sqlx.Rows, error)
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	BindNamed(query string, arg interface{}) (string, []interface{}, error)
+	Preparex(query string) (*sqlx.Stmt, error)
+	PrepareNamed(query string) (*sqlx.NamedStmt, error)
+}
+
+// sqlStatement wraps a prepared statement that uses either positional or named parameters
+type sqlStatement struct {
+	stmt  *sqlx.Stmt
+	named *sqlx.NamedStmt
+}
+
+// Database column types whose values some drivers return as raw bytes
+var sqlNumericTypes = map[string]bool{
+	"BIGINT":     true,
+	"DECIMAL":    true,
+	"DOUBLE":     true,
+	"FLOAT":      true,
+	"FLOAT4":     true,
+	"FLOAT8":     true,
+	"INT":        true,
+	"INT2":       true,
+	"INT4":       true,
+	"INT8":       true,
+	"INTEGER":    true,
+	"MEDIUMINT":  true,
+	"MONEY":      true,
+	"NUMERIC":    true,
+	"REAL":       true,
+	"SMALLINT":   true,
+	"SMALLMONEY": true,
+	"TINYINT":    true,
+}
+
+var sqlInstanceFunctions = map[string]func(c sqlConnection) lua.Function{
+	"query": func(c sqlConnection) lua.Function {
+		return func(l *lua.State) int {
+			query := lua.CheckString(l, 1)
+
+			rows, err := queryWithArguments(c, query, l, 2)
+
+			if err != nil {
+				raiseError(l, err)
+			}
+
+			pushSQLRows(l, rows, -1)
+
+			return 1
+		}
+	},
+
+	"query_one": func(c sqlConnection) lua.Function {
+		return func(l *lua.State) int {
+			query := lua.CheckString(l, 1)
+
+			rows, err := queryWithArguments(c, query, l, 2)
+
+			if err != nil {
+				raiseError(l, err)
+			}
+
+			pushSQLRows(l, rows, 1)
+
+			return 1
+		}
+	},
+
+	"exec": func(c sqlConnection) lua.Function {
 		return func(l *lua.State) int {
-			args := l.Top()
+			checkWritable(l, "exec")
 
 			query := lua.CheckString(l, 1)
-			params := make([]interface{}, args-1)
+			params, named := checkSQLArguments(l, 2)
+
+			query, params, err := bindSQLArguments(c, query, params, named)
 
-			for i := 2; i <= args; i++ {
-				params[i-2] = l.ToValue(i)
+			if err != nil {
+				raiseError(l, err)
 			}
 
-			result := []map[string]interface{}{}
+			res, err := c.Exec(query, params...)
 
-			rs, err := db.Queryx(query, params...)
+			if err != nil {
+				raiseError(l, err)
+			}
+
+			pushSQLResult(l, res)
+
+			return 1
+		}
+	},
+
+	"prepare": func(c sqlConnection) lua.Function {
+		return func(l *lua.State) int {
+			query := lua.CheckString(l, 1)
+
+			s := &sqlStatement{}
+			var err error
+
+			if hasNamedParameters(query) {
+				s.named, err = c.PrepareNamed(query)
+			} else {
+				s.stmt, err = c.Preparex(query)
+			}
 
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
-			defer rs.Close()
+			pushSQLStatement(l, s)
+
+			return 1
+		}
+	},
+}
+
+var sqlStatementFunctions = map[string]func(s *sqlStatement) lua.Function{
+	"query": func(s *sqlStatement) lua.Function {
+		return func(l *lua.State) int {
+			rows, err := s.queryx(l, 1)
 
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
-			for rs.Next() {
-				row := make(map[string]interface{})
-				err := rs.MapScan(row)
+			pushSQLRows(l, rows, -1)
+
+			return 1
+		}
+	},
 
-				if err != nil {
-					lua.Errorf(l, "%s", err.Error())
-				}
+	"query_one": func(s *sqlStatement) lua.Function {
+		return func(l *lua.State) int {
+			rows, err := s.queryx(l, 1)
 
-				result = append(result, row)
+			if err != nil {
+				raiseError(l, err)
 			}
 
-			l.CreateTable(len(result), 0)
+			pushSQLRows(l, rows, 1)
+
+			return 1
+		}
+	},
 
-			pushArray(l)
+	"exec": func(s *sqlStatement) lua.Function {
+		return func(l *lua.State) int {
+			checkWritable(l, "exec")
 
-			for index, value := range result {
-				for i, v := range value {
-					if vv, ok := v.([]byte); ok {
-						value[i] = string(vv)
-					}
-				}
+			var res sql.Result
+			var err error
 
-				util.DeepPush(l, value)
-				l.RawSetInt(-2, index+1)
+			params, named := checkSQLArguments(l, 1)
+
+			if s.named != nil {
+				res, err = s.named.Exec(named)
+			} else {
+				res, err = s.stmt.Exec(params...)
 			}
 
+			if err != nil {
+				raiseError(l, err)
+			}
+
+			pushSQLResult(l, res)
+
 			return 1
 		}
 	},
+
+	"close": func(s *sqlStatement) lua.Function {
+		return func(l *lua.State) int {
+			s.close()
+
+			return 0
+		}
+	},
 }
 
-func pushSQLInstance(l *lua.State, driverName, dataSourceName string) {
-	instance, err := sqlx.Open(driverName, dataSourceName)
+func (s *sqlStatement) queryx(l *lua.State, index int) (*sqlx.Rows, error) {
+	params, named := checkSQLArguments(l, index)
+
+	if s.named != nil {
+		if named == nil {
+			named = map[string]interface{}{}
+		}
+
+		return s.named.Queryx(named)
+	}
+
+	if named != nil {
+		return nil, fmt.Errorf("This statement uses positional parameters, but a table of named parameters was provided")
+	}
+
+	return s.stmt.Queryx(params...)
+}
+
+func (s *sqlStatement) close() {
+	if s.named != nil {
+		s.named.Close()
+	} else if s.stmt != nil {
+		s.stmt.Close()
+	}
+}
+
+// hasNamedParameters reports whether a query uses :name style parameters. Binding
+// against an empty map only fails when the query references a name
+func hasNamedParameters(query string) bool {
+	_, _, err := sqlx.Named(query, map[string]interface{}{})
+
+	return err != nil
+}
+
+// checkSQLArguments reads the query parameters from the Lua stack starting at index.
+// A single table argument is treated as a set of named parameters, otherwise every
+// argument is used as a positional parameter
+func checkSQLArguments(l *lua.State, index int) ([]interface{}, map[string]interface{}) {
+	top := l.Top()
+
+	if top == index && l.IsTable(index) {
+		v, err := util.PullTable(l, index)
+
+		if err != nil {
+			raiseError(l, err)
+		}
+
+		named, ok := v.(map[string]interface{})
+
+		if !ok {
+			lua.Errorf(l, "Named parameters must be provided as a table of key/value pairs")
+		}
+
+		return nil, named
+	}
+
+	params := []interface{}{}
+
+	for i := index; i <= top; i++ {
+		switch l.TypeOf(i) {
+		case lua.TypeNil:
+			params = append(params, nil)
+
+		case lua.TypeBoolean:
+			params = append(params, l.ToBoolean(i))
+
+		case lua.TypeNumber:
+			params = append(params, sqlNumber(lua.CheckNumber(l, i)))
+
+		case lua.TypeString:
+			params = append(params, lua.CheckString(l, i))
+
+		default:
+			lua.Errorf(l, "Unsupported SQL parameter type %s at position %d", lua.TypeNameOf(l, i), i-index+1)
+		}
+	}
+
+	return params, nil
+}
+
+// sqlNumber converts whole Lua numbers to integers so that drivers bind them as such
+func sqlNumber(n float64) interface{} {
+	if n == math.Trunc(n) && n >= math.MinInt64 && n < math.MaxInt64 {
+		return int64(n)
+	}
+
+	return n
+}
+
+func bindSQLArguments(c sqlConnection, query string, params []interface{}, named map[string]interface{}) (string, []interface{}, error) {
+	if named != nil {
+		return c.BindNamed(query, named)
+	}
+
+	return query, params, nil
+}
+
+func queryWithArguments(c sqlConnection, query string, l *lua.State, index int) (*sqlx.Rows, error) {
+	params, named := checkSQLArguments(l, index)
+
+	query, params, err := bindSQLArguments(c, query, params, named)
 
 	if err != nil {
-		lua.Errorf(l, "%s", err.Error())
+		return nil, err
 	}
 
+	return c.Queryx(query, params...)
+}
+
+// sqlValue converts a value scanned from the database into a type that Lua understands.
+// NULL values become nil and timestamps are formatted as RFC3339 strings
+func sqlValue(value interface{}, databaseType string) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+
+	case []byte:
+		if sqlNumericTypes[strings.ToUpper(databaseType)] {
+			if f, err := strconv.ParseFloat(string(v), 64); err == nil {
+				return f
+			}
+		}
+
+		return string(v)
+
+	case time.Time:
+		return v.Format(time.RFC3339)
+
+	case bool, int64, float64, string:
+		return v
+
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// pushSQLRows reads up to limit rows (or all of them if limit is negative) and pushes
+// them onto the stack as an array. When limit is 1, a single row or nil is pushed instead
+func pushSQLRows(l *lua.State, rows *sqlx.Rows, limit int) {
+	defer rows.Close()
+
+	columnTypes, err := rows.ColumnTypes()
+
+	if err != nil {
+		raiseError(l, err)
+	}
+
+	result := []map[string]interface{}{}
+
+	for (limit < 0 || len(result) < limit) && rows.Next() {
+		row := make(map[string]interface{})
+
+		if err := rows.MapScan(row); err != nil {
+			raiseError(l, err)
+		}
+
+		for _, columnType := range columnTypes {
+			name := columnType.Name()
+			row[name] = sqlValue(row[name], columnType.DatabaseTypeName())
+		}
+
+		result = append(result, row)
+	}
+
+	if err := rows.Err(); err != nil {
+		raiseError(l, err)
+	}
+
+	if limit == 1 {
+		if len(result) == 0 {
+			l.PushNil()
+		} else {
+			util.DeepPush(l, result[0])
+		}
+
+		return
+	}
+
+	pushArray(l)
+
+	for index, value := range result {
+		util.DeepPush(l, value)
+		l.RawSetInt(-2, index+1)
+	}
+}
+
+func pushSQLResult(l *lua.State, res sql.Result) {
+	l.NewTable()
+
+	if rowsAffected, err := res.RowsAffected(); err == nil {
+		l.PushInteger(int(rowsAffected))
+		l.SetField(-2, "rows_affected")
+	}
+
+	// Not every driver supports this (e.g.: PostgreSQL)
+	if lastInsertID, err := res.LastInsertId(); err == nil {
+		l.PushInteger(int(lastInsertID))
+		l.SetField(-2, "last_insert_id")
+	}
+}
+
+func pushSQLConnection(l *lua.State, c sqlConnection) {
 	l.NewTable()
 
 	for name, fn := range sqlInstanceFunctions {
-		l.PushGoFunction(fn(instance))
+		l.PushGoFunction(fn(c))
 		l.SetField(-2, name)
 	}
 }
+
+func pushSQLStatement(l *lua.State, s *sqlStatement) {
+	l.NewTable()
+
+	for name, fn := range sqlStatementFunctions {
+		l.PushGoFunction(fn(s))
+		l.SetField(-2, name)
+	}
+
+	// Statements that the script doesn't close are closed when it finishes
+	addCleanup(l, s.close)
+}
+
+func pushSQLInstance(l *lua.State, driverName, dataSourceName string, options *sqlPoolOptions) {
+	var instance *sqlx.DB
+
+	if fixtures := stateFixtures(l); fixtures != nil {
+		// The driver name still decides how named parameters are bound
+		instance = sqlx.NewDb(sql.OpenDB(&sqlFixtureConnector{fixtures: fixtures.SQL}), driverName)
+		addCleanup(l, func() { instance.Close() })
+	} else {
+		var err error
+
+		if instance, err = getSQLConnection(driverName, dataSourceName, options); err != nil {
+			raiseError(l, err)
+		}
+	}
+
+	pushSQLConnection(l, instance)
+
+	// Runs the function passed as the only argument inside a transaction. The
+	// transaction is committed if the function returns normally and rolled back
+	// if it raises an error, which is then propagated to the caller
+	l.PushGoFunction(func(l *lua.State) int {
+		lua.CheckType(l, 1, lua.TypeFunction)
+
+		tx, err := instance.Beginx()
+
+		if err != nil {
+			raiseError(l, err)
+		}
+
+		l.PushValue(1)
+		pushSQLConnection(l, tx)
+
+		if err := l.ProtectedCall(1, 1, 0); err != nil {
+			tx.Rollback()
+			l.Error()
+		}
+
+		if err := tx.Commit(); err != nil {
+			raiseError(l, err)
+		}
+
+		return 1
+	})
+	l.SetField(-2, "transaction")
+}
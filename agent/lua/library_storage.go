@@ -1,6 +1,9 @@
 package lua
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/telemetryapp/go-lua"
 	"github.com/telemetryapp/gotelemetry_agent/agent/database"
 )
@@ -9,7 +12,48 @@ var storageLibrary = []lua.RegistryFunction{
 	lua.RegistryFunction{
 		Name: "series",
 		Function: func(l *lua.State) int {
-			pushSeries(l, lua.CheckString(l, 1))
+			name := lua.CheckString(l, 1)
+
+			// Labels given here replace the ones the series already has
+			if !l.IsNoneOrNil(2) {
+				checkWritable(l, "storage.series with labels")
+
+				series, _, err := database.GetSeries(name)
+
+				if err != nil {
+					raiseError(l, err)
+				}
+
+				if err = series.SetLabels(checkLabels(l, 2)); err != nil {
+					raiseError(l, err)
+				}
+			}
+
+			pushSeries(l, name)
+
+			return 1
+		},
+	},
+	lua.RegistryFunction{
+		Name: "select",
+		Function: func(l *lua.State) int {
+			selector := checkSelector(l, 1)
+
+			res, err := database.SelectSeries(selector)
+
+			if err != nil {
+				raiseError(l, err)
+			}
+
+			pushArray(l)
+
+			for index, series := range res {
+				pushSeries(l, series.Name)
+				l.RawSetInt(-2, index+1)
+			}
+
+			l.PushGoFunction(aggregateSelection(res))
+			l.SetField(-2, "aggregate")
 
 			return 1
 		},
@@ -20,7 +64,7 @@ var storageLibrary = []lua.RegistryFunction{
 			res, err := database.FindSeries(lua.CheckString(l, 1))
 
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			pushArray(l)
@@ -67,6 +111,30 @@ func openStorageLibrary(l *lua.State) {
 		l.PushInteger(int(database.StdDev))
 		l.SetField(-2, "STDDEV")
 
+		l.PushInteger(int(database.Median))
+		l.SetField(-2, "MEDIAN")
+
+		l.PushInteger(int(database.Median))
+		l.SetField(-2, "P50")
+
+		l.PushInteger(int(database.P90))
+		l.SetField(-2, "P90")
+
+		l.PushInteger(int(database.P95))
+		l.SetField(-2, "P95")
+
+		l.PushInteger(int(database.P99))
+		l.SetField(-2, "P99")
+
+		l.PushInteger(int(database.Rate))
+		l.SetField(-2, "RATE")
+
+		l.PushInteger(int(database.Delta))
+		l.SetField(-2, "DELTA")
+
+		l.PushInteger(int(database.Last))
+		l.SetField(-2, "LAST")
+
 		l.SetField(-2, "Functions")
 
 		return 1
@@ -75,3 +143,122 @@ func openStorageLibrary(l *lua.State) {
 	lua.Require(l, "telemetry/storage", open, false)
 	l.Pop(1)
 }
+
+// checkSelector reads a table of label names and the values they must have,
+// either as a string or as a list of strings that are all accepted
+func checkSelector(l *lua.State, index int) map[string][]string {
+	selector := map[string][]string{}
+
+	if l.IsNoneOrNil(index) {
+		return selector
+	}
+
+	lua.CheckType(l, index, lua.TypeTable)
+
+	table, err := pullTable(l, index)
+
+	if err != nil {
+		raiseError(l, err)
+	}
+
+	values, ok := table.(map[string]interface{})
+
+	if !ok {
+		lua.Errorf(l, "The selector must be a table of label names and values")
+	}
+
+	for name, value := range values {
+		switch v := value.(type) {
+		case []interface{}:
+			for _, item := range v {
+				selector[name] = append(selector[name], fmt.Sprint(item))
+			}
+		case string, float64, bool:
+			selector[name] = []string{fmt.Sprint(v)}
+		default:
+			lua.Errorf(l, "The value of the label `%s` must be a string or a list of strings", name)
+		}
+	}
+
+	return selector
+}
+
+// aggregateSelection aggregates the series returned by storage.select. The
+// options can contain `by`, the label or list of labels to group the series by,
+// `combine`, the function used to combine the values of each period across the
+// series of a group (SUM by default), and `end`, the end of the last period
+func aggregateSelection(series []*database.Series) lua.Function {
+	return func(l *lua.State) int {
+		functionType := lua.CheckInteger(l, 1)
+		interval := checkInterval(l, 2)
+		count := lua.CheckInteger(l, 3)
+
+		by := []string{}
+		combine := database.Sum
+		end := time.Now()
+
+		if !l.IsNoneOrNil(4) {
+			lua.CheckType(l, 4, lua.TypeTable)
+
+			l.Field(4, "by")
+
+			switch l.TypeOf(-1) {
+			case lua.TypeString:
+				by = append(by, lua.CheckString(l, -1))
+			case lua.TypeTable:
+				for i := 1; i <= l.RawLength(-1); i++ {
+					l.RawGetInt(-1, i)
+					by = append(by, lua.CheckString(l, -1))
+					l.Pop(1)
+				}
+			}
+
+			l.Pop(1)
+
+			l.Field(4, "combine")
+			if !l.IsNil(-1) {
+				combine = database.FunctionType(lua.CheckInteger(l, -1))
+			}
+			l.Pop(1)
+
+			l.Field(4, "end")
+			if !l.IsNil(-1) {
+				end = checkTime(l, -1)
+			}
+			l.Pop(1)
+		}
+
+		groups, err := database.AggregateGroups(series, by, database.FunctionType(functionType), combine, interval, count, &end)
+
+		if err != nil {
+			raiseError(l, err)
+		}
+
+		pushArray(l)
+
+		for index, group := range groups {
+			l.NewTable()
+
+			l.NewTable()
+			for name, value := range group.Labels {
+				l.PushString(value)
+				l.SetField(-2, name)
+			}
+			l.SetField(-2, "labels")
+
+			pushArray(l)
+			for i, name := range group.Series {
+				l.PushString(name)
+				l.RawSetInt(-2, i+1)
+			}
+			l.SetField(-2, "series")
+
+			pushSeriesItems(l, group.Items)
+			l.SetField(-2, "items")
+
+			l.RawSetInt(-2, index+1)
+		}
+
+		return 1
+	}
+}
@@ -8,6 +8,12 @@ import (
 var counterFunctions = map[string]func(c *database.Counter) lua.Function{
 	"value": func(c *database.Counter) lua.Function {
 		return func(l *lua.State) int {
+			// Read-only scripts see counters that don't exist yet as zero
+			if c == nil {
+				l.PushInteger(0)
+				return 1
+			}
+
 			l.PushInteger(int(c.GetValue()))
 
 			return 1
@@ -16,32 +22,61 @@ var counterFunctions = map[string]func(c *database.Counter) lua.Function{
 
 	"set": func(c *database.Counter) lua.Function {
 		return func(l *lua.State) int {
-			c.SetValue(int64(lua.CheckInteger(l, 1)))
+			if err := c.SetValue(int64(lua.CheckInteger(l, 1))); err != nil {
+				raiseError(l, err)
+			}
 
 			return 0
 		}
 	},
 
+	// increment returns the new value of the counter
 	"increment": func(c *database.Counter) lua.Function {
 		return func(l *lua.State) int {
-			c.Increment(int64(lua.CheckInteger(l, 1)))
+			value, err := c.Increment(int64(lua.CheckInteger(l, 1)))
 
-			return 0
+			if err != nil {
+				raiseError(l, err)
+			}
+
+			l.PushInteger(int(value))
+
+			return 1
 		}
 	},
 }
 
+// The functions of a counter that write to it, which read-only scripts can't call
+var counterWriteFunctions = map[string]bool{
+	"set":       true,
+	"increment": true,
+}
+
 func pushCounter(l *lua.State, name string) {
-	counter, _, err := database.GetCounter(name)
+	readOnly := isReadOnly(l)
+
+	var counter *database.Counter
+	var err error
+
+	if readOnly {
+		counter, err = database.LookupCounter(name)
+	} else {
+		counter, _, err = database.GetCounter(name)
+	}
 
 	if err != nil {
-		lua.Errorf(l, "%s", err.Error())
+		raiseError(l, err)
 	}
 
 	l.NewTable()
 
 	for name, fn := range counterFunctions {
-		l.PushGoFunction(fn(counter))
+		if readOnly && counterWriteFunctions[name] {
+			l.PushGoFunction(readOnlyFunction("counter." + name))
+		} else {
+			l.PushGoFunction(fn(counter))
+		}
+
 		l.SetField(-2, name)
 	}
 }
@@ -1,6 +1,7 @@
 package lua
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/telemetryapp/go-lua"
@@ -25,22 +26,118 @@ var seriesFunctions = map[string]func(s *database.Series) lua.Function{
 				duration, err := config.ParseTimeInterval(lua.CheckString(l, 1))
 
 				if err != nil {
-					lua.Errorf(l, "%s", err.Error())
+					raiseError(l, err)
 				}
 
 				since := time.Now().Add(-duration)
 
 				if err = s.TrimSince(since); err != nil {
-					lua.Errorf(l, "%s", err.Error())
+					raiseError(l, err)
 				}
 
 				return 0
 			}
 
-			err := s.TrimSince(time.Unix(int64(lua.CheckInteger(l, 1)), 0))
+			err := s.TrimSince(unixTime(lua.CheckNumber(l, 1)))
 
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
+			}
+
+			return 0
+		}
+	},
+
+	"setRetention": func(s *database.Series) lua.Function {
+		return func(l *lua.State) int {
+			index := 1
+
+			// Allow both series.setRetention(ttl) and series:setRetention(ttl)
+			if l.TypeOf(index) == lua.TypeTable {
+				index++
+			}
+
+			ttl := ""
+
+			if !l.IsNoneOrNil(index) {
+				ttl = lua.CheckString(l, index)
+			}
+
+			if err := s.SetRetention(ttl); err != nil {
+				raiseError(l, err)
+			}
+
+			return 0
+		}
+	},
+
+	"retention": func(s *database.Series) lua.Function {
+		return func(l *lua.State) int {
+			retention, err := s.Retention()
+
+			if err != nil {
+				raiseError(l, err)
+			}
+
+			result := map[string]interface{}{"source": retention.Source}
+
+			if retention.Seconds > 0 {
+				result["ttl"] = retention.TTL
+				result["seconds"] = retention.Seconds
+			}
+
+			if len(retention.Pattern) > 0 {
+				result["pattern"] = retention.Pattern
+			}
+
+			util.DeepPush(l, result)
+
+			return 1
+		}
+	},
+
+	"labels": func(s *database.Series) lua.Function {
+		return func(l *lua.State) int {
+			labels, err := s.Labels()
+
+			if err != nil {
+				raiseError(l, err)
+			}
+
+			l.NewTable()
+
+			for name, value := range labels {
+				l.PushString(value)
+				l.SetField(-2, name)
+			}
+
+			return 1
+		}
+	},
+
+	"setLabels": func(s *database.Series) lua.Function {
+		return func(l *lua.State) int {
+			index := 1
+
+			// Allow both series.setLabels(labels) and series:setLabels(labels)
+			if l.TypeOf(index) == lua.TypeTable {
+				l.Field(index, "setLabels")
+
+				if l.IsGoFunction(-1) {
+					index++
+				}
+
+				l.Pop(1)
+			}
+
+			labels := map[string]string{}
+
+			if !l.IsNoneOrNil(index) {
+				labels = checkLabels(l, index)
+			}
+
+			if err := s.SetLabels(labels); err != nil {
+				raiseError(l, err)
 			}
 
 			return 0
@@ -53,7 +150,7 @@ var seriesFunctions = map[string]func(s *database.Series) lua.Function{
 			count := lua.CheckInteger(l, 1)
 
 			if err := s.TrimCount(count); err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			return 0
@@ -63,10 +160,15 @@ var seriesFunctions = map[string]func(s *database.Series) lua.Function{
 	"push": func(s *database.Series) lua.Function {
 		return func(l *lua.State) int {
 			value := lua.CheckNumber(l, 1)
-			timestamp := time.Unix(int64(lua.OptInteger(l, 2, int(time.Now().Unix()))), 0)
+			timestamp := time.Now()
+
+			// Timestamps can have a fraction of a second
+			if !l.IsNoneOrNil(2) {
+				timestamp = unixTime(lua.CheckNumber(l, 2))
+			}
 
 			if err := s.Push(&timestamp, value); err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			return 0
@@ -78,7 +180,13 @@ var seriesFunctions = map[string]func(s *database.Series) lua.Function{
 			res, err := s.Pop()
 
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
+			}
+
+			// Empty series have no items
+			if res == nil {
+				l.PushNil()
+				return 1
 			}
 
 			util.DeepPush(l, res)
@@ -92,7 +200,13 @@ var seriesFunctions = map[string]func(s *database.Series) lua.Function{
 			res, err := s.Last()
 
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
+			}
+
+			// Empty series have no items
+			if res == nil {
+				l.PushNil()
+				return 1
 			}
 
 			util.DeepPush(l, res)
@@ -107,45 +221,11 @@ var seriesFunctions = map[string]func(s *database.Series) lua.Function{
 			res, err := s.Items(lua.CheckInteger(l, 1))
 
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			if arr, ok := res.([]interface{}); ok {
-				l.CreateTable(len(arr), 0)
-
-				l.NewTable()
-				l.PushBoolean(true)
-				l.SetField(-2, arrayMarkerField)
-				l.SetMetaTable(-2)
-
-				extractor := func(field string) lua.Function {
-					return func(l *lua.State) int {
-						l.CreateTable(len(arr), 0)
-
-						l.NewTable()
-						l.PushBoolean(true)
-						l.SetField(-2, arrayMarkerField)
-						l.SetMetaTable(-2)
-
-						for index, value := range arr {
-							util.DeepPush(l, value.(map[string]interface{})[field])
-							l.RawSetInt(-2, index+1)
-						}
-
-						return 1
-					}
-				}
-
-				l.PushGoFunction(extractor("ts"))
-				l.SetField(-2, "ts")
-
-				l.PushGoFunction(extractor("value"))
-				l.SetField(-2, "values")
-
-				for index, value := range arr {
-					util.DeepPush(l, value)
-					l.RawSetInt(-2, index+1)
-				}
+				pushSeriesItems(l, arr)
 			} else {
 				l.PushNil()
 			}
@@ -162,7 +242,7 @@ var seriesFunctions = map[string]func(s *database.Series) lua.Function{
 				duration, err := config.ParseTimeInterval(lua.CheckString(l, 2))
 
 				if err != nil {
-					lua.Errorf(l, "%s", err.Error())
+					raiseError(l, err)
 				}
 
 				curTime := time.Now()
@@ -171,7 +251,7 @@ var seriesFunctions = map[string]func(s *database.Series) lua.Function{
 				res, err := s.Compute(database.FunctionType(functionType), &timeSince, &curTime)
 
 				if err != nil {
-					lua.Errorf(l, "%s", err.Error())
+					raiseError(l, err)
 				}
 
 				util.DeepPush(l, res)
@@ -179,13 +259,13 @@ var seriesFunctions = map[string]func(s *database.Series) lua.Function{
 				return 1
 			}
 
-			start := time.Unix(int64(lua.CheckInteger(l, 2)), 0)
-			end := time.Unix(int64(lua.CheckInteger(l, 3)), 0)
+			start := unixTime(lua.CheckNumber(l, 2))
+			end := unixTime(lua.CheckNumber(l, 3))
 
 			res, err := s.Compute(database.FunctionType(functionType), &start, &end)
 
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			util.DeepPush(l, res)
@@ -197,84 +277,163 @@ var seriesFunctions = map[string]func(s *database.Series) lua.Function{
 	"aggregate": func(s *database.Series) lua.Function {
 		return func(l *lua.State) int {
 			functionType := lua.CheckInteger(l, 1)
-			var interval int
+			interval := checkInterval(l, 2)
 			count := lua.CheckInteger(l, 3)
-			end := time.Unix(int64(lua.OptInteger(l, 4, int(time.Now().Unix()))), 0)
+			end := optTime(l, 4)
 
-			if l.TypeOf(2) == lua.TypeString {
-				duration, err := config.ParseTimeInterval(lua.CheckString(l, 2))
+			res, err := s.Aggregate(database.FunctionType(functionType), interval, count, &end)
 
-				if err != nil {
-					lua.Errorf(l, "%s", err.Error())
-				}
+			if err != nil {
+				raiseError(l, err)
+			}
 
-				interval = int(duration.Seconds())
+			if arr, ok := res.([]interface{}); ok {
+				pushSeriesItems(l, arr)
 			} else {
-				interval = lua.CheckInteger(l, 2)
+				l.PushNil()
 			}
 
-			res, err := s.Aggregate(database.FunctionType(functionType), interval, count, &end)
+			return 1
+		}
+	},
+}
 
-			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
-			}
+// The functions of a series that write to it, which read-only scripts can't call
+var seriesWriteFunctions = map[string]bool{
+	"trimSince":    true,
+	"setRetention": true,
+	"setLabels":    true,
+	"trimCount":    true,
+	"push":         true,
+	"pop":          true,
+}
 
-			if arr, ok := res.([]interface{}); ok {
-				l.CreateTable(len(arr), 0)
+func pushSeries(l *lua.State, name string) {
+	readOnly := isReadOnly(l)
 
-				l.NewTable()
-				l.PushBoolean(true)
-				l.SetField(-2, arrayMarkerField)
-				l.SetMetaTable(-2)
+	var series *database.Series
+	var err error
 
-				extractor := func(field string) lua.Function {
-					return func(l *lua.State) int {
-						l.CreateTable(len(arr), 0)
+	// Read-only scripts don't create the series, whose functions then fail as if
+	// it had been dropped
+	if readOnly {
+		if series, err = database.LookupSeries(name); series == nil && err == nil {
+			series = &database.Series{Name: name}
+		}
+	} else {
+		series, _, err = database.GetSeries(name)
+	}
 
-						l.NewTable()
-						l.PushBoolean(true)
-						l.SetField(-2, arrayMarkerField)
-						l.SetMetaTable(-2)
+	if err != nil {
+		raiseError(l, err)
+	}
 
-						for index, value := range arr {
-							util.DeepPush(l, value.(map[string]interface{})[field])
-							l.RawSetInt(-2, index+1)
-						}
+	l.NewTable()
 
-						return 1
-					}
-				}
+	for name, fn := range seriesFunctions {
+		if readOnly && seriesWriteFunctions[name] {
+			l.PushGoFunction(readOnlyFunction("series." + name))
+		} else {
+			l.PushGoFunction(fn(series))
+		}
+
+		l.SetField(-2, name)
+	}
+}
 
-				l.PushGoFunction(extractor("ts"))
-				l.SetField(-2, "ts")
+// readOnlyFunction replaces a function that read-only scripts can't call
+func readOnlyFunction(name string) lua.Function {
+	return func(l *lua.State) int {
+		checkWritable(l, name)
 
-				l.PushGoFunction(extractor("value"))
-				l.SetField(-2, "values")
+		return 0
+	}
+}
 
-				for index, value := range arr {
-					util.DeepPush(l, value)
-					l.RawSetInt(-2, index+1)
-				}
-			} else {
-				l.PushNil()
+// pushSeriesItems pushes the items of a series as an array, with `ts` and `values`
+// functions that extract the timestamps and the values of the items
+func pushSeriesItems(l *lua.State, arr []interface{}) {
+	l.CreateTable(len(arr), 0)
+
+	l.NewTable()
+	l.PushBoolean(true)
+	l.SetField(-2, arrayMarkerField)
+	l.SetMetaTable(-2)
+
+	extractor := func(field string) lua.Function {
+		return func(l *lua.State) int {
+			l.CreateTable(len(arr), 0)
+
+			l.NewTable()
+			l.PushBoolean(true)
+			l.SetField(-2, arrayMarkerField)
+			l.SetMetaTable(-2)
+
+			for index, value := range arr {
+				util.DeepPush(l, value.(map[string]interface{})[field])
+				l.RawSetInt(-2, index+1)
 			}
 
 			return 1
 		}
-	},
+	}
+
+	l.PushGoFunction(extractor("ts"))
+	l.SetField(-2, "ts")
+
+	l.PushGoFunction(extractor("value"))
+	l.SetField(-2, "values")
+
+	for index, value := range arr {
+		util.DeepPush(l, value)
+		l.RawSetInt(-2, index+1)
+	}
 }
 
-func pushSeries(l *lua.State, name string) {
-	series, _, err := database.GetSeries(name)
+// checkInterval reads an aggregation interval, either in seconds or as a
+// duration such as `5m`
+func checkInterval(l *lua.State, index int) int {
+	if l.TypeOf(index) == lua.TypeString {
+		duration, err := config.ParseTimeInterval(lua.CheckString(l, index))
+
+		if err != nil {
+			raiseError(l, err)
+		}
+
+		return int(duration.Seconds())
+	}
+
+	return lua.CheckInteger(l, index)
+}
+
+// checkLabels reads a table of labels. Numbers and booleans are converted to strings
+func checkLabels(l *lua.State, index int) map[string]string {
+	lua.CheckType(l, index, lua.TypeTable)
+
+	table, err := pullTable(l, index)
 
 	if err != nil {
-		lua.Errorf(l, "%s", err.Error())
+		raiseError(l, err)
 	}
 
-	l.NewTable()
+	labels := map[string]string{}
 
-	for name, fn := range seriesFunctions {
-		l.PushGoFunction(fn(series))
-		l.SetField(-2, name)
+	values, ok := table.(map[string]interface{})
+
+	if !ok {
+		lua.Errorf(l, "Labels must be a table of names and values")
 	}
+
+	for name, value := range values {
+		switch v := value.(type) {
+		case string:
+			labels[name] = v
+		case float64, bool:
+			labels[name] = fmt.Sprint(v)
+		default:
+			lua.Errorf(l, "The value of the label `%s` must be a string", name)
+		}
+	}
+
+	return labels
 }
@@ -0,0 +1,323 @@
+package lua
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/telemetryapp/go-lua"
+)
+
+// Helpers available inside templates. They are also exposed to Lua under the
+// same names so that scripts can format individual values
+var templateFunctions = template.FuncMap{
+	"number":        formatNumber,
+	"currency":      formatCurrency,
+	"percent":       formatPercent,
+	"relative_time": formatRelativeTime,
+	"truncate":      truncateString,
+}
+
+func openTemplateLibrary(l *lua.State, scriptDir string) {
+	var templateLibrary = []lua.RegistryFunction{
+		lua.RegistryFunction{
+			Name: "render",
+			Function: func(l *lua.State) int {
+				source := lua.CheckString(l, 1)
+				data := checkTemplateData(l, 2)
+
+				t, err := template.New("template").Funcs(templateFunctions).Parse(source)
+
+				if err != nil {
+					raiseError(l, err)
+				}
+
+				l.PushString(executeTemplate(l, t, data))
+				return 1
+			},
+		},
+
+		// Relative paths are resolved against the directory of the running script
+		lua.RegistryFunction{
+			Name: "render_file",
+			Function: func(l *lua.State) int {
+				path := lua.CheckString(l, 1)
+				data := checkTemplateData(l, 2)
+
+				if !filepath.IsAbs(path) && scriptDir != "" {
+					path = filepath.Join(scriptDir, path)
+				}
+
+				t, err := template.New(filepath.Base(path)).Funcs(templateFunctions).ParseFiles(path)
+
+				if err != nil {
+					raiseError(l, err)
+				}
+
+				l.PushString(executeTemplate(l, t, data))
+				return 1
+			},
+		},
+
+		lua.RegistryFunction{
+			Name: "number",
+			Function: func(l *lua.State) int {
+				l.PushString(formatNumber(lua.CheckNumber(l, 1), lua.OptInteger(l, 2, 0)))
+				return 1
+			},
+		},
+
+		lua.RegistryFunction{
+			Name: "currency",
+			Function: func(l *lua.State) int {
+				l.PushString(formatCurrency(lua.CheckNumber(l, 1), lua.OptString(l, 2, "$"), lua.OptInteger(l, 3, 2)))
+				return 1
+			},
+		},
+
+		lua.RegistryFunction{
+			Name: "percent",
+			Function: func(l *lua.State) int {
+				l.PushString(formatPercent(lua.CheckNumber(l, 1), lua.OptInteger(l, 2, 0)))
+				return 1
+			},
+		},
+
+		lua.RegistryFunction{
+			Name: "relative_time",
+			Function: func(l *lua.State) int {
+				var value interface{}
+
+				if l.TypeOf(1) == lua.TypeNumber {
+					value = lua.CheckNumber(l, 1)
+				} else {
+					value = lua.CheckString(l, 1)
+				}
+
+				l.PushString(formatRelativeTime(value))
+				return 1
+			},
+		},
+
+		lua.RegistryFunction{
+			Name: "truncate",
+			Function: func(l *lua.State) int {
+				l.PushString(truncateString(lua.CheckString(l, 1), lua.CheckInteger(l, 2)))
+				return 1
+			},
+		},
+	}
+
+	open := func(l *lua.State) int {
+		lua.NewLibrary(l, templateLibrary)
+		return 1
+	}
+
+	lua.Require(l, "telemetry/template", open, false)
+	l.Pop(1)
+}
+
+func checkTemplateData(l *lua.State, index int) interface{} {
+	if l.IsNoneOrNil(index) {
+		return nil
+	}
+
+	if !l.IsTable(index) {
+		return l.ToValue(index)
+	}
+
+	data, err := pullTable(l, index)
+
+	if err != nil {
+		raiseError(l, err)
+	}
+
+	return data
+}
+
+func executeTemplate(l *lua.State, t *template.Template, data interface{}) string {
+	var b bytes.Buffer
+
+	if err := t.Execute(&b, data); err != nil {
+		raiseError(l, err)
+	}
+
+	return b.String()
+}
+
+// templateNumber converts the values found in template data to a float
+func templateNumber(value interface{}) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case float32:
+		return float64(v)
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case string:
+		f, _ := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f
+	}
+
+	return 0
+}
+
+// templateDecimals reads an optional number of decimal places from a list of
+// template arguments
+func templateDecimals(args []interface{}, index, fallback int) int {
+	if index < len(args) {
+		return int(templateNumber(args[index]))
+	}
+
+	return fallback
+}
+
+// formatNumber formats a value with a fixed number of decimals and commas
+// separating the thousands, e.g.: 1234567.891 with 2 decimals is 1,234,567.89
+func formatNumber(value interface{}, args ...interface{}) string {
+	n := templateNumber(value)
+	decimals := templateDecimals(args, 0, 0)
+
+	if decimals < 0 {
+		decimals = 0
+	}
+
+	s := strconv.FormatFloat(math.Abs(n), 'f', decimals, 64)
+
+	integer, fraction := s, ""
+
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		integer, fraction = s[:i], s[i:]
+	}
+
+	var b strings.Builder
+
+	if n < 0 && strings.Trim(s, "0.") != "" {
+		b.WriteByte('-')
+	}
+
+	for i, c := range integer {
+		if i > 0 && (len(integer)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+
+		b.WriteRune(c)
+	}
+
+	b.WriteString(fraction)
+
+	return b.String()
+}
+
+// formatCurrency formats an amount with a currency symbol, which defaults to $,
+// and two decimals unless specified otherwise
+func formatCurrency(value interface{}, args ...interface{}) string {
+	symbol := "$"
+
+	if len(args) > 0 {
+		symbol = fmt.Sprintf("%v", args[0])
+	}
+
+	s := formatNumber(value, templateDecimals(args, 1, 2))
+
+	if strings.HasPrefix(s, "-") {
+		return "-" + symbol + s[1:]
+	}
+
+	return symbol + s
+}
+
+// formatPercent formats a ratio as a percentage, e.g.: 0.256 is 26%
+func formatPercent(value interface{}, args ...interface{}) string {
+	return formatNumber(templateNumber(value)*100, templateDecimals(args, 0, 0)) + "%"
+}
+
+// formatRelativeTime describes a Unix timestamp or RFC3339 string relative to
+// the current time, e.g.: "5 minutes ago" or "in 2 days"
+func formatRelativeTime(value interface{}) string {
+	var t time.Time
+
+	if s, ok := value.(string); ok {
+		parsed, err := time.Parse(time.RFC3339, s)
+
+		if err != nil {
+			return s
+		}
+
+		t = parsed
+	} else {
+		t = time.Unix(int64(templateNumber(value)), 0)
+	}
+
+	d := time.Since(t)
+	future := d < 0
+
+	if future {
+		d = -d
+	}
+
+	if d < 45*time.Second {
+		return "just now"
+	}
+
+	units := []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"year", 365 * 24 * time.Hour},
+		{"month", 30 * 24 * time.Hour},
+		{"week", 7 * 24 * time.Hour},
+		{"day", 24 * time.Hour},
+		{"hour", time.Hour},
+		{"minute", time.Minute},
+	}
+
+	var description string
+
+	for _, unit := range units {
+		if d >= unit.duration {
+			count := int(d / unit.duration)
+			description = fmt.Sprintf("%d %s", count, unit.name)
+
+			if count != 1 {
+				description += "s"
+			}
+
+			break
+		}
+	}
+
+	if description == "" {
+		description = "1 minute"
+	}
+
+	if future {
+		return "in " + description
+	}
+
+	return description + " ago"
+}
+
+// truncateString shortens a string to at most length characters, ending it
+// with an ellipsis if anything was removed
+func truncateString(value interface{}, length int) string {
+	s := fmt.Sprintf("%v", value)
+	runes := []rune(s)
+
+	if length <= 0 {
+		return ""
+	}
+
+	if len(runes) <= length {
+		return s
+	}
+
+	return string(runes[:length-1]) + "…"
+}
@@ -1,10 +1,14 @@
 package lua
 
 import (
+	"fmt"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/telemetryapp/go-lua"
 	"github.com/telemetryapp/goluago/util"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
 )
 
 var utilsLibrary = []lua.RegistryFunction{
@@ -100,6 +104,299 @@ var utilsLibrary = []lua.RegistryFunction{
 			return 1
 		},
 	},
+	// Parses a timestamp into a Unix epoch. Without a layout, common formats
+	// such as RFC3339 are tried in turn. Timestamps without a zone are read in
+	// the given timezone, which defaults to UTC
+	lua.RegistryFunction{
+		Name: "parse",
+		Function: func(l *lua.State) int {
+			value := lua.CheckString(l, 1)
+			layout := lua.OptString(l, 2, "")
+			location := checkLocation(l, 3)
+
+			t, err := parseTime(value, layout, location)
+
+			if err != nil {
+				raiseError(l, err)
+			}
+
+			l.PushInteger(int(t.Unix()))
+			return 1
+		},
+	},
+	lua.RegistryFunction{
+		Name: "format",
+		Function: func(l *lua.State) int {
+			t := checkTime(l, 1)
+			layout := lua.OptString(l, 2, "rfc3339")
+			location := checkLocation(l, 3)
+
+			if named, ok := timeLayouts[strings.ToLower(layout)]; ok {
+				layout = named
+			}
+
+			l.PushString(t.In(location).Format(layout))
+			return 1
+		},
+	},
+	// Returns the RFC3339 representation of a time in another timezone. The
+	// optional third argument is the zone of timestamps that don't specify one
+	lua.RegistryFunction{
+		Name: "convert_tz",
+		Function: func(l *lua.State) int {
+			var t time.Time
+
+			to := checkLocation(l, 2)
+
+			if l.TypeOf(1) == lua.TypeString {
+				var err error
+
+				t, err = parseTime(lua.CheckString(l, 1), "", checkLocation(l, 3))
+
+				if err != nil {
+					raiseError(l, err)
+				}
+			} else {
+				t = checkTime(l, 1)
+			}
+
+			l.PushString(t.In(to).Format(time.RFC3339))
+			return 1
+		},
+	},
+	lua.RegistryFunction{
+		Name: "start_of",
+		Function: func(l *lua.State) int {
+			unit := lua.CheckString(l, 1)
+			t := optTime(l, 2)
+			location := checkLocation(l, 3)
+
+			start, err := startOf(t.In(location), unit)
+
+			if err != nil {
+				raiseError(l, err)
+			}
+
+			l.PushInteger(int(start.Unix()))
+			return 1
+		},
+	},
+	// Returns the last second of the unit containing the given time
+	lua.RegistryFunction{
+		Name: "end_of",
+		Function: func(l *lua.State) int {
+			unit := lua.CheckString(l, 1)
+			t := optTime(l, 2)
+			location := checkLocation(l, 3)
+
+			start, err := startOf(t.In(location), unit)
+
+			if err != nil {
+				raiseError(l, err)
+			}
+
+			l.PushInteger(int(nextStart(start, unit).Unix() - 1))
+			return 1
+		},
+	},
+	// Adds an interval such as "3d" or "-2h" to a time
+	lua.RegistryFunction{
+		Name: "add",
+		Function: func(l *lua.State) int {
+			t := checkTime(l, 1)
+			interval := lua.CheckString(l, 2)
+
+			d, err := parseSignedInterval(interval)
+
+			if err != nil {
+				raiseError(l, err)
+			}
+
+			l.PushInteger(int(t.Add(d).Unix()))
+			return 1
+		},
+	},
+	// Returns a - b in seconds, or in the unit given as the third argument
+	// (s, m, h, d or w)
+	lua.RegistryFunction{
+		Name: "diff",
+		Function: func(l *lua.State) int {
+			a := checkTime(l, 1)
+			b := checkTime(l, 2)
+			unit := lua.OptString(l, 3, "s")
+
+			size, err := config.ParseTimeInterval("1" + unit)
+
+			if err != nil {
+				lua.Errorf(l, "Invalid unit %s; use s, m, h, d or w", unit)
+			}
+
+			l.PushNumber(float64(a.Sub(b)) / float64(size))
+			return 1
+		},
+	},
+}
+
+// Named layouts accepted by utils.format in addition to Go layout strings
+var timeLayouts = map[string]string{
+	"rfc3339":  time.RFC3339,
+	"rfc1123":  time.RFC1123,
+	"rfc1123z": time.RFC1123Z,
+	"rfc822":   time.RFC822,
+	"kitchen":  time.Kitchen,
+	"date":     "2006-01-02",
+	"datetime": "2006-01-02 15:04:05",
+	"time":     "15:04:05",
+}
+
+// Layouts tried, in order, when utils.parse is called without one
+var defaultTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC850,
+	time.ANSIC,
+	time.RFC822Z,
+	time.RFC822,
+}
+
+func parseTime(value, layout string, location *time.Location) (time.Time, error) {
+	if layout != "" {
+		if named, ok := timeLayouts[strings.ToLower(layout)]; ok {
+			layout = named
+		}
+
+		return time.ParseInLocation(layout, value, location)
+	}
+
+	for _, layout := range defaultTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, location); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("Unable to parse the time %q; please specify a layout", value)
+}
+
+// checkLocation reads an optional timezone name, such as America/New_York.
+// Omitting it selects UTC, and "local" selects the timezone of the Agent
+func checkLocation(l *lua.State, index int) *time.Location {
+	name := lua.OptString(l, index, "UTC")
+
+	if strings.ToLower(name) == "local" {
+		return time.Local
+	}
+
+	location, err := time.LoadLocation(name)
+
+	if err != nil {
+		lua.Errorf(l, "Unknown timezone %s", name)
+	}
+
+	return location
+}
+
+// checkTime reads a time given either as a Unix epoch or a timestamp string
+func checkTime(l *lua.State, index int) time.Time {
+	if l.TypeOf(index) == lua.TypeString {
+		t, err := parseTime(lua.CheckString(l, index), "", time.UTC)
+
+		if err != nil {
+			raiseError(l, err)
+		}
+
+		return t
+	}
+
+	return unixTime(lua.CheckNumber(l, index))
+}
+
+// unixTime converts a Unix epoch in seconds, with a fraction, to a time
+func unixTime(epoch float64) time.Time {
+	seconds := math.Floor(epoch)
+
+	return time.Unix(int64(seconds), int64((epoch-seconds)*1e9))
+}
+
+func optTime(l *lua.State, index int) time.Time {
+	if l.IsNoneOrNil(index) {
+		return time.Now()
+	}
+
+	return checkTime(l, index)
+}
+
+func parseSignedInterval(interval string) (time.Duration, error) {
+	interval = strings.TrimSpace(interval)
+	negative := strings.HasPrefix(interval, "-")
+
+	d, err := config.ParseTimeInterval(strings.TrimPrefix(strings.TrimPrefix(interval, "-"), "+"))
+
+	if negative {
+		d = -d
+	}
+
+	return d, err
+}
+
+// startOf truncates a time to the beginning of a calendar unit in its own
+// timezone. Weeks start on Monday
+func startOf(t time.Time, unit string) (time.Time, error) {
+	y, m, d := t.Date()
+
+	switch unit {
+	case "second":
+		return time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, t.Location()), nil
+
+	case "minute":
+		return time.Date(y, m, d, t.Hour(), t.Minute(), 0, 0, t.Location()), nil
+
+	case "hour":
+		return time.Date(y, m, d, t.Hour(), 0, 0, 0, t.Location()), nil
+
+	case "day":
+		return time.Date(y, m, d, 0, 0, 0, 0, t.Location()), nil
+
+	case "week":
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(y, m, d-offset, 0, 0, 0, 0, t.Location()), nil
+
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, t.Location()), nil
+
+	case "quarter":
+		return time.Date(y, m-(m-1)%3, 1, 0, 0, 0, 0, t.Location()), nil
+
+	case "year":
+		return time.Date(y, 1, 1, 0, 0, 0, 0, t.Location()), nil
+	}
+
+	return t, fmt.Errorf("Invalid unit %s; use second, minute, hour, day, week, month, quarter or year", unit)
+}
+
+// nextStart returns the beginning of the unit that follows the one starting at start
+func nextStart(start time.Time, unit string) time.Time {
+	switch unit {
+	case "second":
+		return start.Add(time.Second)
+	case "minute":
+		return start.Add(time.Minute)
+	case "hour":
+		return start.Add(time.Hour)
+	case "day":
+		return start.AddDate(0, 0, 1)
+	case "week":
+		return start.AddDate(0, 0, 7)
+	case "month":
+		return start.AddDate(0, 1, 0)
+	case "quarter":
+		return start.AddDate(0, 3, 0)
+	}
+
+	return start.AddDate(1, 0, 0)
 }
 
 func openUtilsLibrary(l *lua.State) {
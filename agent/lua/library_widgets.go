@@ -0,0 +1,312 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/telemetryapp/go-lua"
+	"github.com/telemetryapp/gotelemetry"
+)
+
+// The payload structs declared by gotelemetry for each variant
+var widgetVariants = map[string]reflect.Type{
+	"barchart":    reflect.TypeOf(gotelemetry.Barchart{}),
+	"box":         reflect.TypeOf(gotelemetry.Box{}),
+	"bulletchart": reflect.TypeOf(gotelemetry.Bulletchart{}),
+	"countdown":   reflect.TypeOf(gotelemetry.Countdown{}),
+	"custom":      reflect.TypeOf(gotelemetry.Custom{}),
+	"funnelchart": reflect.TypeOf(gotelemetry.Funnelchart{}),
+	"gauge":       reflect.TypeOf(gotelemetry.Gauge{}),
+	"graph":       reflect.TypeOf(gotelemetry.Graph{}),
+	"grid":        reflect.TypeOf(gotelemetry.Grid{}),
+	"histogram":   reflect.TypeOf(gotelemetry.Histogram{}),
+	"icon":        reflect.TypeOf(gotelemetry.Icon{}),
+	"image":       reflect.TypeOf(gotelemetry.Image{}),
+	"log":         reflect.TypeOf(gotelemetry.Log{}),
+	"map":         reflect.TypeOf(gotelemetry.Map{}),
+	"multigauge":  reflect.TypeOf(gotelemetry.Multigauge{}),
+	"multivalue":  reflect.TypeOf(gotelemetry.Multivalue{}),
+	"piechart":    reflect.TypeOf(gotelemetry.Piechart{}),
+	"scatterplot": reflect.TypeOf(gotelemetry.Scatterplot{}),
+	"servers":     reflect.TypeOf(gotelemetry.Servers{}),
+	"status":      reflect.TypeOf(gotelemetry.Status{}),
+	"table":       reflect.TypeOf(gotelemetry.Table{}),
+	"text":        reflect.TypeOf(gotelemetry.Text{}),
+	"tickertape":  reflect.TypeOf(gotelemetry.Tickertape{}),
+	"timeline":    reflect.TypeOf(gotelemetry.Timeline{}),
+	"timeseries":  reflect.TypeOf(gotelemetry.Timeseries{}),
+	"upstatus":    reflect.TypeOf(gotelemetry.Upstatus{}),
+	"value":       reflect.TypeOf(gotelemetry.Value{}),
+	"video":       reflect.TypeOf(gotelemetry.Video{}),
+	"waterfall":   reflect.TypeOf(gotelemetry.Waterfall{}),
+}
+
+// widgetField describes a JSON field of a variant struct
+type widgetField struct {
+	fieldType reflect.Type
+	required  bool
+}
+
+func openWidgetsLibrary(l *lua.State) {
+	widgetsLibrary := []lua.RegistryFunction{}
+
+	for variant, t := range widgetVariants {
+		variant, t := variant, t
+
+		widgetsLibrary = append(widgetsLibrary, lua.RegistryFunction{
+			Name: variant,
+			Function: func(l *lua.State) int {
+				lua.CheckType(l, 1, lua.TypeTable)
+
+				data, err := pullTable(l, 1)
+
+				if err != nil {
+					raiseError(l, err)
+				}
+
+				data, err = checkWidgetValue("", data, t)
+
+				if err != nil {
+					lua.Errorf(l, "Invalid %s widget: %s", variant, err.Error())
+				}
+
+				pushValue(l, data)
+				return 1
+			},
+		})
+	}
+
+	open := func(l *lua.State) int {
+		lua.NewLibrary(l, widgetsLibrary)
+		return 1
+	}
+
+	lua.Require(l, "telemetry/widgets", open, false)
+	l.Pop(1)
+}
+
+// checkWidgetValue verifies that a value pulled from Lua can be decoded into the
+// given type, and returns it with empty tables that stand for lists turned into slices
+func checkWidgetValue(path string, value interface{}, t reflect.Type) (interface{}, error) {
+	switch t.Kind() {
+	case reflect.Interface:
+		return value, nil
+
+	case reflect.Ptr:
+		return checkWidgetValue(path, value, t.Elem())
+
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			return nil, widgetTypeError(path, "a string", value)
+		}
+
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			return nil, widgetTypeError(path, "a boolean", value)
+		}
+
+	case reflect.Float32, reflect.Float64:
+		if _, ok := value.(float64); !ok {
+			return nil, widgetTypeError(path, "a number", value)
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, ok := value.(float64); !ok || n != math.Trunc(n) {
+			return nil, widgetTypeError(path, "a whole number", value)
+		}
+
+	case reflect.Slice:
+		if m, ok := value.(map[string]interface{}); ok && len(m) == 0 {
+			return []interface{}{}, nil
+		}
+
+		items, ok := value.([]interface{})
+
+		if !ok {
+			return nil, widgetTypeError(path, "a list", value)
+		}
+
+		for index, item := range items {
+			checked, err := checkWidgetValue(fmt.Sprintf("%s[%d]", path, index+1), item, t.Elem())
+
+			if err != nil {
+				return nil, err
+			}
+
+			items[index] = checked
+		}
+
+	case reflect.Struct:
+		fields, ok := value.(map[string]interface{})
+
+		if !ok {
+			return nil, widgetTypeError(path, "a table of fields", value)
+		}
+
+		known := widgetFields(t)
+
+		keys := make([]string, 0, len(fields))
+
+		for key := range fields {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			field, ok := known[key]
+
+			if !ok {
+				return nil, unknownWidgetFieldError(joinWidgetPath(path, key), key, known)
+			}
+
+			checked, err := checkWidgetValue(joinWidgetPath(path, key), fields[key], field.fieldType)
+
+			if err != nil {
+				return nil, err
+			}
+
+			fields[key] = checked
+		}
+
+		names := make([]string, 0, len(known))
+
+		for name := range known {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			if _, ok := fields[name]; !ok && known[name].required {
+				return nil, fmt.Errorf("missing required field `%s`", joinWidgetPath(path, name))
+			}
+		}
+	}
+
+	return value, nil
+}
+
+// widgetFields returns the fields of a variant struct keyed by their JSON names.
+// Fields not marked omitempty are required
+func widgetFields(t reflect.Type) map[string]widgetField {
+	fields := map[string]widgetField{}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")
+
+		if tag[0] == "-" || tag[0] == "" {
+			continue
+		}
+
+		required := true
+
+		for _, option := range tag[1:] {
+			if option == "omitempty" {
+				required = false
+			}
+		}
+
+		fields[tag[0]] = widgetField{fieldType: f.Type, required: required}
+	}
+
+	return fields
+}
+
+func joinWidgetPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+func widgetTypeError(path, expected string, value interface{}) error {
+	var actual string
+
+	switch value.(type) {
+	case string:
+		actual = "a string"
+	case float64:
+		actual = "a number"
+	case bool:
+		actual = "a boolean"
+	case []interface{}:
+		actual = "a list"
+	case map[string]interface{}:
+		actual = "a table"
+	default:
+		actual = fmt.Sprintf("%T", value)
+	}
+
+	if path == "" {
+		return fmt.Errorf("expected %s, got %s", expected, actual)
+	}
+
+	return fmt.Errorf("field `%s` must be %s, got %s", path, expected, actual)
+}
+
+// unknownWidgetFieldError reports a field that the variant doesn't have,
+// suggesting the closest valid name if there is one
+func unknownWidgetFieldError(path, key string, known map[string]widgetField) error {
+	best, bestDistance := "", 3
+
+	for name := range known {
+		if d := levenshtein(key, name); d < bestDistance || (d == bestDistance && name < best) {
+			best, bestDistance = name, d
+		}
+	}
+
+	if best != "" {
+		return fmt.Errorf("unknown field `%s` (did you mean `%s`?)", path, best)
+	}
+
+	names := make([]string, 0, len(known))
+
+	for name := range known {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return fmt.Errorf("unknown field `%s`; valid fields are %s", path, strings.Join(names, ", "))
+}
+
+func levenshtein(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			current[j] = minInt(previous[j]+1, minInt(current[j-1]+1, previous[j-1]+cost))
+		}
+
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
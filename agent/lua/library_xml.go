@@ -17,7 +17,7 @@ var xmlLibrary = []lua.RegistryFunction{
 
 			if l.IsTable(1) {
 				if v, err = util.PullTable(l, 1); err != nil {
-					lua.Errorf(l, "%s", err.Error())
+					raiseError(l, err)
 				}
 			} else {
 				lua.Errorf(l, "Only tables can be converted to XML")
@@ -26,7 +26,7 @@ var xmlLibrary = []lua.RegistryFunction{
 			res, err := mxj.Map(v.(map[string]interface{})).Xml()
 
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			util.DeepPush(l, string(res))
@@ -40,7 +40,7 @@ var xmlLibrary = []lua.RegistryFunction{
 			res, err := mxj.NewMapXml([]byte(lua.CheckString(l, 1)))
 
 			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
+				raiseError(l, err)
 			}
 
 			util.DeepPush(l, res)
@@ -0,0 +1,207 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/telemetryapp/go-lua"
+)
+
+// ErrIncompleteInput is returned by Session.Eval when the source ends in the middle
+// of a statement, and more lines are needed to run it
+var ErrIncompleteInput = errors.New("Incomplete input")
+
+var identifierRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Session is an interpreter that keeps its globals between evaluations, with the
+// same libraries and globals as a script run by Exec
+type Session struct {
+	l *lua.State
+}
+
+// NewSession creates an interactive session. Files are resolved relative to scriptDir
+func NewSession(scriptDir string, p jobProvider, args map[string]interface{}) (*Session, error) {
+	l, err := newState(scriptDir, p, args, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{l: l}, nil
+}
+
+// Close releases what the libraries opened during the session, such as database
+// sessions and prepared statements
+func (s *Session) Close() {
+	closeState(s.l)
+}
+
+// Eval runs a chunk of source code and returns its results, formatted for display
+// one per line. Like the standalone Lua interpreter, expressions are evaluated
+// and returned, so that `args.url` prints the value
+func (s *Session) Eval(source string) (string, error) {
+	l := s.l
+
+	defer l.SetTop(0)
+
+	if err := lua.LoadBuffer(l, "return "+source, "=stdin", ""); err != nil {
+		l.Pop(1)
+
+		if err := lua.LoadBuffer(l, source, "=stdin", ""); err != nil {
+			message, _ := l.ToString(-1)
+
+			if strings.HasSuffix(message, "<eof>") {
+				return "", ErrIncompleteInput
+			}
+
+			// Syntax errors keep the `=` that marks the chunk name as literal
+			return "", errors.New(strings.TrimPrefix(message, "="))
+		}
+	}
+
+	if err := l.ProtectedCall(0, lua.MultipleReturns, 0); err != nil {
+		message, _ := l.ToString(-1)
+		return "", errors.New(message)
+	}
+
+	results := []string{}
+
+	for index := 1; index <= l.Top(); index++ {
+		results = append(results, formatValue(l, index, "", map[interface{}]bool{}))
+	}
+
+	return strings.Join(results, "\n"), nil
+}
+
+// tableField is a formatted key/value pair of a table
+type tableField struct {
+	key      string
+	value    string
+	number   float64
+	isNumber bool
+}
+
+// formatValue pretty-prints the value at index. Short tables are kept on one line,
+// and tables that contain themselves are only expanded once
+func formatValue(l *lua.State, index int, indent string, seen map[interface{}]bool) string {
+	index = l.AbsIndex(index)
+
+	switch l.TypeOf(index) {
+	case lua.TypeString:
+		s, _ := l.ToString(index)
+		return strconv.Quote(s)
+
+	case lua.TypeNumber:
+		n, _ := l.ToNumber(index)
+		return strconv.FormatFloat(n, 'f', -1, 64)
+
+	case lua.TypeTable:
+		return formatTable(l, index, indent, seen)
+
+	default:
+		s, _ := lua.ToStringMeta(l, index)
+		l.Pop(1)
+		return s
+	}
+}
+
+// pushTableEntries pushes a sequence that alternates the keys and values of the
+// table at index, and returns the number of entries. NextField is used because
+// Next stops at the end of the sequence part of a table
+func pushTableEntries(l *lua.State, index int) int {
+	l.NewTable()
+	entries := l.Top()
+	count := 0
+
+	l.PushNil()
+
+	for l.NextField(index) {
+		l.RawSetInt(entries, 2*count+2)
+		l.PushValue(-1)
+		l.RawSetInt(entries, 2*count+1)
+		count++
+	}
+
+	return count
+}
+
+// formatTable lists the fields of a table, sequence first
+func formatTable(l *lua.State, index int, indent string, seen map[interface{}]bool) string {
+	pointer := l.ToValue(index)
+
+	if seen[pointer] {
+		return fmt.Sprintf("<cycle: %p>", pointer)
+	}
+
+	seen[pointer] = true
+	defer delete(seen, pointer)
+
+	nested := indent + "  "
+	length := l.RawLength(index)
+	count := pushTableEntries(l, index)
+	entries := l.Top()
+	fields := []tableField{}
+
+	for i := 0; i < count; i++ {
+		l.RawGetInt(entries, 2*i+1)
+		l.RawGetInt(entries, 2*i+2)
+
+		field := tableField{value: formatValue(l, -1, nested, seen)}
+
+		if n, ok := l.ToNumber(-2); ok && l.TypeOf(-2) == lua.TypeNumber {
+			field.key = "[" + strconv.FormatFloat(n, 'f', -1, 64) + "]"
+			field.number = n
+			field.isNumber = true
+		} else if s, ok := l.ToString(-2); ok && l.TypeOf(-2) == lua.TypeString && identifierRegex.MatchString(s) {
+			field.key = s
+		} else {
+			field.key = "[" + formatValue(l, -2, nested, seen) + "]"
+		}
+
+		fields = append(fields, field)
+
+		l.Pop(2)
+	}
+
+	l.Pop(1)
+
+	if len(fields) == 0 {
+		return "{}"
+	}
+
+	// Numeric keys come first in order, followed by the rest sorted by name
+	sort.Slice(fields, func(i, j int) bool {
+		if fields[i].isNumber != fields[j].isNumber {
+			return fields[i].isNumber
+		}
+
+		if fields[i].isNumber {
+			return fields[i].number < fields[j].number
+		}
+
+		return fields[i].key < fields[j].key
+	})
+
+	parts := []string{}
+
+	for i, field := range fields {
+		if i < length && field.isNumber && field.number == float64(i+1) {
+			// The sequence part is listed without its indices
+			parts = append(parts, field.value)
+		} else {
+			parts = append(parts, field.key+" = "+field.value)
+		}
+	}
+
+	inline := "{ " + strings.Join(parts, ", ") + " }"
+
+	if len(indent)+len(inline) <= 80 && !strings.Contains(inline, "\n") {
+		return inline
+	}
+
+	return "{\n" + nested + strings.Join(parts, ",\n"+nested) + "\n" + indent + "}"
+}
@@ -17,8 +17,13 @@ import (
 
 var g *gin.Engine
 
+// The channel that routes log to, set by Init
+var logChannel chan error
+
 // Init the routes
 func Init(cfg config.Interface, errorChannel chan error) (bool, error) {
+	logChannel = errorChannel
+
 	authKey := cfg.AuthKey()
 
 	if len(authKey) == 0 {
@@ -100,6 +105,13 @@ func Init(cfg config.Interface, errorChannel chan error) (bool, error) {
 	return true, nil
 }
 
+// logError logs an error that can't be returned in the response
+func logError(format string, v ...interface{}) {
+	if logChannel != nil {
+		logChannel <- gotelemetry.NewError(http.StatusInternalServerError, fmt.Sprintf(format, v...))
+	}
+}
+
 func logFunc(errorChannel chan error) gin.HandlerFunc {
 	return func(g *gin.Context) {
 		start := time.Now()
@@ -181,6 +193,11 @@ func errorFunc(errorChannel chan error) gin.HandlerFunc {
 // because these routes may not be set at the time of execution for Init()
 func SetAdditionalRoutes(apiStreamChannel chan string, streamRunning *bool, logList *list.List) {
 	jobsRoute(g)
+	scriptsRoute(g)
+	seriesRoute(g)
+	countersRoute(g)
+	dataRoute(g)
+	databaseRoute(g)
 	statsRoute(g)
 	logsRoute(g, apiStreamChannel, streamRunning, logList)
 }
@@ -0,0 +1,114 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	"github.com/telemetryapp/gotelemetry_agent/agent/database"
+)
+
+type counterValue struct {
+	Value *int64 `json:"value"`
+}
+
+type counterDelta struct {
+	Delta *int64 `json:"delta"`
+}
+
+// countersRoute instantiates the endpoints used for reading and writing the counters of the database
+func countersRoute(g *gin.Engine) {
+
+	// returns the value of every counter, by name
+	g.GET("/counters", func(g *gin.Context) {
+		counters, err := database.ListCounters()
+
+		if err != nil {
+			g.Error(err)
+			return
+		}
+
+		g.JSON(http.StatusOK, counters)
+	})
+
+	// returns the value of a counter
+	g.GET("/counters/:name", func(g *gin.Context) {
+		name, _ := url.QueryUnescape(g.Param("name"))
+
+		counter, err := database.LookupCounter(name)
+		if err != nil {
+			g.Error(err)
+			return
+		}
+
+		if counter == nil {
+			g.JSON(http.StatusNotFound, gin.H{"code": http.StatusNotFound, "errors": fmt.Sprintf("Counter not found: %s", name)})
+			return
+		}
+
+		g.JSON(http.StatusOK, gin.H{"name": name, "value": counter.GetValue()})
+	})
+
+	// sets the value of a counter, creating it if needed
+	g.PUT("/counters/:name", func(g *gin.Context) {
+		name, _ := url.QueryUnescape(g.Param("name"))
+
+		var body counterValue
+		if err := g.BindJSON(&body); err != nil {
+			g.Error(err).SetType(gin.ErrorTypeBind)
+			return
+		}
+
+		if body.Value == nil {
+			g.Error(fmt.Errorf("Missing value")).SetType(gin.ErrorTypeBind)
+			return
+		}
+
+		counter, _, err := database.GetCounter(name)
+		if err != nil {
+			g.Error(err)
+			return
+		}
+
+		if err = counter.SetValue(*body.Value); err != nil {
+			g.Error(err)
+			return
+		}
+
+		g.JSON(http.StatusOK, gin.H{"name": name, "value": *body.Value})
+	})
+
+	// adds delta, or 1 if the request has no body, to a counter and returns the new value
+	g.POST("/counters/:name/increment", func(g *gin.Context) {
+		name, _ := url.QueryUnescape(g.Param("name"))
+
+		delta := int64(1)
+
+		if g.Request.ContentLength != 0 {
+			var body counterDelta
+			if err := g.BindJSON(&body); err != nil {
+				g.Error(err).SetType(gin.ErrorTypeBind)
+				return
+			}
+
+			if body.Delta != nil {
+				delta = *body.Delta
+			}
+		}
+
+		counter, _, err := database.GetCounter(name)
+		if err != nil {
+			g.Error(err)
+			return
+		}
+
+		value, err := counter.Increment(delta)
+		if err != nil {
+			g.Error(err)
+			return
+		}
+
+		g.JSON(http.StatusOK, gin.H{"name": name, "value": value})
+	})
+}
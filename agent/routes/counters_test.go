@@ -0,0 +1,74 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestCountersRoutes(t *testing.T) {
+	engine, done := testEngine(t, countersRoute)
+	defer done()
+
+	value := func(method, path, body string) int64 {
+		w := serve(engine, method, path, body)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s: expected 200, got %d: %s", method, path, w.Code, w.Body.String())
+		}
+
+		result := struct {
+			Name  string `json:"name"`
+			Value int64  `json:"value"`
+		}{}
+
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+
+		if result.Name != "visits" {
+			t.Errorf("%s %s: expected the counter `visits`, got `%s`", method, path, result.Name)
+		}
+
+		return result.Value
+	}
+
+	if w := serve(engine, "GET", "/counters/visits", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Reading a missing counter should return 404, got %d", w.Code)
+	}
+
+	if v := value("POST", "/counters/visits/increment", ""); v != 1 {
+		t.Errorf("Incrementing without a body should add 1, got %d", v)
+	}
+
+	if v := value("POST", "/counters/visits/increment", `{"delta": 5}`); v != 6 {
+		t.Errorf("Incrementing by 5 should return 6, got %d", v)
+	}
+
+	if v := value("POST", "/counters/visits/increment", `{}`); v != 7 {
+		t.Errorf("Incrementing without a delta should add 1, got %d", v)
+	}
+
+	if w := serve(engine, "POST", "/counters/visits/increment", `{"delta": "a"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("An invalid delta should return 400, got %d", w.Code)
+	}
+
+	if w := serve(engine, "PUT", "/counters/visits", `{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Setting a counter without a value should return 400, got %d", w.Code)
+	}
+
+	if v := value("PUT", "/counters/visits", `{"value": -2}`); v != -2 {
+		t.Errorf("Setting the counter should return -2, got %d", v)
+	}
+
+	if v := value("GET", "/counters/visits", ""); v != -2 {
+		t.Errorf("Expected the counter to be -2, got %d", v)
+	}
+
+	w := serve(engine, "GET", "/counters", "")
+	counters := map[string]int64{}
+
+	if err := json.Unmarshal(w.Body.Bytes(), &counters); err != nil || counters["visits"] != -2 {
+		t.Errorf("Expected the list of counters to have visits = -2, got %s (%v)", w.Body.String(), err)
+	}
+}
@@ -0,0 +1,100 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/telemetryapp/gotelemetry_agent/agent/database"
+)
+
+var dataContentTypes = map[string]string{
+	database.FormatCSV:    "text/csv",
+	database.FormatNDJSON: "application/x-ndjson",
+}
+
+// dataFormat returns the format of the `format` query parameter or, failing that,
+// of the content type of the request. It defaults to NDJSON
+func dataFormat(g *gin.Context) string {
+	if format := g.Query("format"); len(format) > 0 {
+		return format
+	}
+
+	if strings.HasPrefix(g.ContentType(), dataContentTypes[database.FormatCSV]) {
+		return database.FormatCSV
+	}
+
+	return database.FormatNDJSON
+}
+
+// dataRoute instantiates the endpoints used for exporting and importing series and counters
+func dataRoute(g *gin.Engine) {
+
+	// streams the series and counters that match the filters of the query as CSV or NDJSON
+	g.GET("/data/export", func(g *gin.Context) {
+		format := dataFormat(g)
+
+		if err := database.ValidateFormat(format); err != nil {
+			g.Error(err).SetType(gin.ErrorTypeBind)
+			return
+		}
+
+		options := database.ExportOptions{
+			Pattern:  g.Query("pattern"),
+			Series:   g.Query("only") != "counters",
+			Counters: g.Query("only") != "series",
+		}
+
+		if only := g.Query("only"); len(only) > 0 && only != "series" && only != "counters" {
+			g.Error(fmt.Errorf("Invalid value `%s` for only. Use `series` or `counters`", only)).SetType(gin.ErrorTypeBind)
+			return
+		}
+
+		if _, err := path.Match(options.Pattern, ""); err != nil {
+			g.Error(fmt.Errorf("Invalid pattern `%s`: %s", options.Pattern, err)).SetType(gin.ErrorTypeBind)
+			return
+		}
+
+		var err error
+
+		if options.Since, err = database.ParseTime(g.Query("since")); err != nil {
+			g.Error(err).SetType(gin.ErrorTypeBind)
+			return
+		}
+
+		if options.Until, err = database.ParseTime(g.Query("until")); err != nil {
+			g.Error(err).SetType(gin.ErrorTypeBind)
+			return
+		}
+
+		g.Header("Content-Type", dataContentTypes[format])
+		g.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="agent.%s"`, format))
+		g.Status(http.StatusOK)
+
+		// The response has already started, so an error can only be logged
+		if _, err = database.Export(g.Writer, format, options); err != nil {
+			logError("The export stopped with an error: %s", err)
+		}
+	})
+
+	// reads series and counters from the body of the request, as written by the export
+	g.POST("/data/import", func(g *gin.Context) {
+		format := dataFormat(g)
+
+		if err := database.ValidateFormat(format); err != nil {
+			g.Error(err).SetType(gin.ErrorTypeBind)
+			return
+		}
+
+		stats, err := database.Import(g.Request.Body, format)
+
+		if err != nil {
+			g.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "errors": err.Error(), "imported": stats})
+			return
+		}
+
+		g.JSON(http.StatusOK, stats)
+	})
+}
@@ -0,0 +1,47 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/telemetryapp/gotelemetry_agent/agent/database"
+)
+
+// databaseRoute instantiates the endpoints used for maintaining the database file
+func databaseRoute(g *gin.Engine) {
+
+	// streams a consistent copy of the database, which can be taken while the Agent runs
+	g.GET("/database/backup", func(g *gin.Context) {
+		_, err := database.Backup(g.Writer, func(size int64) {
+			g.Header("Content-Type", "application/octet-stream")
+			g.Header("Content-Disposition", `attachment; filename="agent.db"`)
+			g.Header("Content-Length", strconv.FormatInt(size, 10))
+			g.Status(http.StatusOK)
+		})
+
+		// Once the snapshot has started, an error can only be logged
+		if err != nil && g.Writer.Written() {
+			logError("The backup stopped with an error: %s", err)
+		} else if err != nil {
+			g.Error(err)
+		}
+	})
+
+	// rewrites the database into a fresh file and returns how much space was reclaimed
+	g.POST("/database/compact", func(g *gin.Context) {
+		result, err := database.Compact()
+
+		if err == database.ErrBackupInProgress {
+			g.JSON(http.StatusConflict, gin.H{"code": http.StatusConflict, "errors": err.Error()})
+			return
+		}
+
+		if err != nil {
+			g.Error(err)
+			return
+		}
+
+		g.JSON(http.StatusOK, result)
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/telemetryapp/gotelemetry_agent/agent/config"
 	"github.com/telemetryapp/gotelemetry_agent/agent/job"
+	"github.com/telemetryapp/gotelemetry_agent/agent/lua"
 )
 
 type script struct {
@@ -140,6 +141,12 @@ func jobsRoute(g *gin.Engine) {
 		id, _ := url.QueryUnescape(g.Param("id"))
 		res, err := job.RunScriptDebug(id)
 
+		// Scripts that fail are reported with their traceback and source
+		if scriptErr, ok := err.(*lua.ScriptError); ok {
+			g.JSON(http.StatusUnprocessableEntity, gin.H{"code": http.StatusUnprocessableEntity, "errors": err.Error(), "script_error": scriptErr})
+			return
+		}
+
 		if err != nil {
 			g.JSON(http.StatusNotFound, gin.H{"code": http.StatusNotFound, "errors": err.Error()})
 			return
@@ -0,0 +1,38 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/telemetryapp/gotelemetry_agent/agent/job"
+)
+
+// scriptsRoute instantiates the endpoints used for running scripts that aren't stored
+func scriptsRoute(g *gin.Engine) {
+
+	// runs a script without saving it or publishing any data, and returns what it
+	// would have done. Scripts that fail still respond with a 200 and their error
+	g.POST("/scripts/eval", func(g *gin.Context) {
+		var request job.EvalRequest
+		if err := g.BindJSON(&request); err != nil {
+			g.Error(err).SetType(gin.ErrorTypeBind)
+			return
+		}
+
+		if strings.TrimSpace(request.Source) == "" {
+			g.Error(errors.New("A source is required")).SetType(gin.ErrorTypeBind)
+			return
+		}
+
+		result, err := job.EvalScript(request)
+
+		if err != nil {
+			g.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "errors": err.Error()})
+			return
+		}
+
+		g.JSON(http.StatusOK, result)
+	})
+}
@@ -0,0 +1,429 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"github.com/telemetryapp/gotelemetry_agent/agent/database"
+)
+
+// The number of items returned by GET /series/:name when neither since nor count is given
+const defaultSeriesItems = 100
+
+// seriesItem is a value pushed to a series. The timestamp is optional and accepts
+// the same formats as the since and until parameters
+type seriesItem struct {
+	Value *float64        `json:"value"`
+	TS    json.RawMessage `json:"ts"`
+}
+
+// lookupSeries returns the series named in the path, or responds with a 404 and
+// returns nil if it doesn't exist
+func lookupSeries(g *gin.Context) *database.Series {
+	name, _ := url.QueryUnescape(g.Param("name"))
+
+	series, err := database.LookupSeries(name)
+
+	if err != nil {
+		g.Error(err)
+		return nil
+	}
+
+	if series == nil {
+		g.JSON(http.StatusNotFound, gin.H{"code": http.StatusNotFound, "errors": fmt.Sprintf("Series not found: %s", name)})
+	}
+
+	return series
+}
+
+// queryInt reads a positive integer from the query, or returns def if it is missing
+func queryInt(g *gin.Context, key string, def int) (int, error) {
+	value := g.Query(key)
+
+	if len(value) == 0 {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil || i <= 0 {
+		return 0, fmt.Errorf("Invalid %s `%s`. It must be a positive integer", key, value)
+	}
+
+	return i, nil
+}
+
+// queryInterval reads an interval from the query, either in seconds or as a duration
+// such as `5m`, and returns it in seconds
+func queryInterval(g *gin.Context, key string) (int, error) {
+	value := g.Query(key)
+
+	if len(value) == 0 {
+		return 0, fmt.Errorf("Missing %s", key)
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return seconds, nil
+	}
+
+	duration, err := config.ParseTimeInterval(value)
+	if err != nil || duration < time.Second {
+		return 0, fmt.Errorf("Invalid %s `%s`. Use a number of seconds or a duration such as `5m`", key, value)
+	}
+
+	return int(duration.Seconds()), nil
+}
+
+// queryFunction reads the function parameter of the query
+func queryFunction(g *gin.Context) (database.FunctionType, error) {
+	name := g.Query("function")
+
+	if len(name) == 0 {
+		return database.None, fmt.Errorf("Missing function")
+	}
+
+	return database.ParseFunction(name)
+}
+
+// parseSeriesItems reads a single item or an array of items
+func parseSeriesItems(body []byte) ([]seriesItem, error) {
+	var items []seriesItem
+
+	body = bytes.TrimSpace(body)
+
+	if bytes.HasPrefix(body, []byte("[")) {
+		if err := json.Unmarshal(body, &items); err != nil {
+			return nil, err
+		}
+	} else {
+		item := seriesItem{}
+
+		if err := json.Unmarshal(body, &item); err != nil {
+			return nil, err
+		}
+
+		items = append(items, item)
+	}
+
+	for index, item := range items {
+		if item.Value == nil {
+			return nil, fmt.Errorf("Item %d has no value", index+1)
+		}
+	}
+
+	return items, nil
+}
+
+// seriesItemTime returns the timestamp of an item, or nil if it has none
+func seriesItemTime(item seriesItem) (*time.Time, error) {
+	if len(item.TS) == 0 || string(item.TS) == "null" {
+		return nil, nil
+	}
+
+	value := string(item.TS)
+
+	// Timestamps can be numbers or strings
+	var s string
+	if err := json.Unmarshal(item.TS, &s); err == nil {
+		value = s
+	}
+
+	ts, err := database.ParseTime(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ts, nil
+}
+
+// seriesRoute instantiates the endpoints used for reading and writing the series of the database
+func seriesRoute(g *gin.Engine) {
+
+	// returns a list of all series with their labels and retention, optionally
+	// limited to the names that match a search as understood by FindSeries
+	g.GET("/series", func(g *gin.Context) {
+		seriesList, err := database.ListSeries()
+
+		if err != nil {
+			g.Error(err)
+			return
+		}
+
+		if search := g.Query("search"); len(search) > 0 {
+			names, err := database.FindSeries(search)
+
+			if err != nil {
+				g.Error(err)
+				return
+			}
+
+			found := map[string]bool{}
+			for _, name := range names {
+				found[name] = true
+			}
+
+			matches := []database.SeriesInfo{}
+			for _, series := range seriesList {
+				if found[series.Name] {
+					matches = append(matches, series)
+				}
+			}
+
+			seriesList = matches
+		}
+
+		g.JSON(http.StatusOK, seriesList)
+	})
+
+	// returns the items of a series between since and until, oldest first. With a
+	// count, only the most recent items of the range are returned
+	g.GET("/series/:name", func(g *gin.Context) {
+		series := lookupSeries(g)
+		if series == nil {
+			return
+		}
+
+		since, err := database.ParseTime(g.Query("since"))
+		if err != nil {
+			g.Error(err).SetType(gin.ErrorTypeBind)
+			return
+		}
+
+		until, err := database.ParseTime(g.Query("until"))
+		if err != nil {
+			g.Error(err).SetType(gin.ErrorTypeBind)
+			return
+		}
+
+		def := 0
+		if since.IsZero() {
+			def = defaultSeriesItems
+		}
+
+		count, err := queryInt(g, "count", def)
+		if err != nil {
+			g.Error(err).SetType(gin.ErrorTypeBind)
+			return
+		}
+
+		items, err := series.ItemsBetween(since, until, count)
+		if err != nil {
+			g.Error(err)
+			return
+		}
+
+		g.JSON(http.StatusOK, items)
+	})
+
+	// pushes an item, or an array of items, to a series, creating it if needed
+	g.POST("/series/:name", func(g *gin.Context) {
+		name, _ := url.QueryUnescape(g.Param("name"))
+
+		body, err := ioutil.ReadAll(g.Request.Body)
+		if err != nil {
+			g.Error(err)
+			return
+		}
+
+		items, err := parseSeriesItems(body)
+		if err != nil {
+			g.Error(err).SetType(gin.ErrorTypeBind)
+			return
+		}
+
+		timestamps := make([]*time.Time, len(items))
+		values := make([]float64, len(items))
+
+		for index, item := range items {
+			if timestamps[index], err = seriesItemTime(item); err != nil {
+				g.Error(err).SetType(gin.ErrorTypeBind)
+				return
+			}
+
+			values[index] = *item.Value
+		}
+
+		series, _, err := database.GetSeries(name)
+		if err != nil {
+			g.Error(err).SetType(gin.ErrorTypeBind)
+			return
+		}
+
+		if err = series.PushMany(timestamps, values); err != nil {
+			g.Error(err)
+			return
+		}
+
+		g.Status(http.StatusNoContent)
+	})
+
+	// trims a series with trim_since or trim_count, or drops it along with its
+	// labels, retention and rollups if neither is given
+	g.DELETE("/series/:name", func(g *gin.Context) {
+		series := lookupSeries(g)
+		if series == nil {
+			return
+		}
+
+		trimSince := g.Query("trim_since")
+		trimCount := g.Query("trim_count")
+
+		var err error
+
+		switch {
+		case len(trimSince) > 0 && len(trimCount) > 0:
+			g.Error(fmt.Errorf("Use either trim_since or trim_count")).SetType(gin.ErrorTypeBind)
+			return
+
+		case len(trimSince) > 0:
+			var since time.Time
+
+			if since, err = database.ParseTime(trimSince); err != nil {
+				g.Error(err).SetType(gin.ErrorTypeBind)
+				return
+			}
+
+			err = series.TrimSince(since)
+
+		case len(trimCount) > 0:
+			count, parseErr := strconv.Atoi(trimCount)
+
+			if parseErr != nil || count < 0 {
+				g.Error(fmt.Errorf("Invalid trim_count `%s`. It must be a non-negative integer", trimCount)).SetType(gin.ErrorTypeBind)
+				return
+			}
+
+			err = series.TrimCount(count)
+
+		default:
+			err = series.Drop()
+		}
+
+		if err != nil {
+			g.Error(err)
+			return
+		}
+
+		g.Status(http.StatusNoContent)
+	})
+
+	// aggregates the series into count periods of interval seconds, ending at end or now
+	g.GET("/series/:name/aggregate", func(g *gin.Context) {
+		series := lookupSeries(g)
+		if series == nil {
+			return
+		}
+
+		functionType, err := queryFunction(g)
+		if err != nil {
+			g.Error(err).SetType(gin.ErrorTypeBind)
+			return
+		}
+
+		interval, err := queryInterval(g, "interval")
+		if err != nil {
+			g.Error(err).SetType(gin.ErrorTypeBind)
+			return
+		}
+
+		count, err := queryInt(g, "count", 1)
+		if err != nil {
+			g.Error(err).SetType(gin.ErrorTypeBind)
+			return
+		}
+
+		var endTime *time.Time
+
+		if end := g.Query("end"); len(end) > 0 {
+			t, err := database.ParseTime(end)
+			if err != nil {
+				g.Error(err).SetType(gin.ErrorTypeBind)
+				return
+			}
+
+			endTime = &t
+		}
+
+		output, err := series.Aggregate(functionType, interval, count, endTime)
+		if err != nil {
+			g.Error(err)
+			return
+		}
+
+		g.JSON(http.StatusOK, output)
+	})
+
+	// computes a single value over the items between since and until, or over
+	// the last interval before until
+	g.GET("/series/:name/compute", func(g *gin.Context) {
+		series := lookupSeries(g)
+		if series == nil {
+			return
+		}
+
+		functionType, err := queryFunction(g)
+		if err != nil {
+			g.Error(err).SetType(gin.ErrorTypeBind)
+			return
+		}
+
+		end, err := database.ParseTime(g.Query("until"))
+		if err != nil {
+			g.Error(err).SetType(gin.ErrorTypeBind)
+			return
+		}
+
+		if end.IsZero() {
+			end = time.Now()
+		}
+
+		var start time.Time
+
+		if len(g.Query("interval")) > 0 {
+			interval, err := queryInterval(g, "interval")
+			if err != nil {
+				g.Error(err).SetType(gin.ErrorTypeBind)
+				return
+			}
+
+			start = end.Add(-time.Duration(interval) * time.Second)
+		} else if start, err = database.ParseTime(g.Query("since")); err != nil {
+			g.Error(err).SetType(gin.ErrorTypeBind)
+			return
+		} else if start.IsZero() {
+			g.Error(fmt.Errorf("Missing since or interval")).SetType(gin.ErrorTypeBind)
+			return
+		}
+
+		value, err := series.Compute(functionType, &start, &end)
+		if err != nil {
+			g.Error(err)
+			return
+		}
+
+		g.JSON(http.StatusOK, gin.H{"value": value})
+	})
+
+	// returns how long the samples of a series are kept, and why
+	g.GET("/series/:name/retention", func(g *gin.Context) {
+		series := lookupSeries(g)
+		if series == nil {
+			return
+		}
+
+		retention, err := series.Retention()
+		if err != nil {
+			g.Error(err)
+			return
+		}
+
+		g.JSON(http.StatusOK, retention)
+	})
+}
@@ -0,0 +1,259 @@
+package routes
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"github.com/telemetryapp/gotelemetry_agent/agent/database"
+)
+
+// testEngine opens a database in a temporary directory and returns an engine with
+// the given routes, along with a function that closes and removes the database
+func testEngine(t *testing.T, routes ...func(*gin.Engine)) (*gin.Engine, func()) {
+	directory, err := ioutil.TempDir("", "agent-routes-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errorChannel := make(chan error, 99999)
+
+	if err := database.Init(&config.File{Data: config.DataConfig{DataLocation: filepath.Join(directory, "agent.db")}}, errorChannel); err != nil {
+		os.RemoveAll(directory)
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	engine := gin.New()
+	engine.Use(errorFunc(errorChannel))
+
+	for _, route := range routes {
+		route(engine)
+	}
+
+	return engine, func() {
+		database.Close()
+		os.RemoveAll(directory)
+	}
+}
+
+// serve performs a request against an engine and returns the recorded response
+func serve(engine *gin.Engine, method, path, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+
+	if len(body) == 0 {
+		req.Body = http.NoBody
+		req.ContentLength = 0
+	}
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestParseSeriesItems(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		values []float64
+		fails  bool
+	}{
+		{"Single item", `{"value": 1}`, []float64{1}, false},
+		{"Array of items", ` [{"value": 1}, {"value": 2.5, "ts": 100}]`, []float64{1, 2.5}, false},
+		{"Empty array", `[]`, []float64{}, false},
+		{"Missing value", `[{"value": 1}, {"ts": 100}]`, nil, true},
+		{"Invalid JSON", `{"value":`, nil, true},
+	}
+
+	for _, test := range tests {
+		items, err := parseSeriesItems([]byte(test.body))
+
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error `%s`", test.name, err)
+			continue
+		}
+
+		if len(items) != len(test.values) {
+			t.Errorf("%s: expected %d items, got %d", test.name, len(test.values), len(items))
+			continue
+		}
+
+		for index, item := range items {
+			if *item.Value != test.values[index] {
+				t.Errorf("%s: expected item %d to be %v, got %v", test.name, index+1, test.values[index], *item.Value)
+			}
+		}
+	}
+}
+
+func TestSeriesItemTime(t *testing.T) {
+	tests := []struct {
+		name string
+		ts   string
+		unix int64
+	}{
+		{"Number", `100`, 100},
+		{"String", `"100"`, 100},
+		{"RFC 3339", `"1970-01-01T00:02:00Z"`, 120},
+	}
+
+	for _, test := range tests {
+		ts, err := seriesItemTime(seriesItem{TS: json.RawMessage(test.ts)})
+
+		if err != nil || ts == nil || ts.Unix() != test.unix {
+			t.Errorf("%s: expected %d, got %v (%v)", test.name, test.unix, ts, err)
+		}
+	}
+
+	if ts, err := seriesItemTime(seriesItem{TS: json.RawMessage(`null`)}); ts != nil || err != nil {
+		t.Errorf("A null timestamp should return nil, got %v (%v)", ts, err)
+	}
+
+	if _, err := seriesItemTime(seriesItem{TS: json.RawMessage(`"yesterday"`)}); err == nil {
+		t.Errorf("An invalid timestamp should return an error")
+	}
+}
+
+func TestSeriesRoutes(t *testing.T) {
+	engine, done := testEngine(t, seriesRoute)
+	defer done()
+
+	items := func(path string) []map[string]float64 {
+		w := serve(engine, "GET", path, "")
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: expected 200, got %d: %s", path, w.Code, w.Body.String())
+		}
+
+		result := []map[string]float64{}
+
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+
+		return result
+	}
+
+	if w := serve(engine, "GET", "/series/sales", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Reading a missing series should return 404, got %d", w.Code)
+	}
+
+	if w := serve(engine, "DELETE", "/series/sales", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Deleting a missing series should return 404, got %d", w.Code)
+	}
+
+	if w := serve(engine, "POST", "/series/sales", `[{"value": 1, "ts": 100}, {"ts": 200}]`); w.Code != http.StatusBadRequest {
+		t.Errorf("Pushing an item without a value should return 400, got %d", w.Code)
+	}
+
+	if w := serve(engine, "POST", "/series/sales", `{"value": 1, "ts": "yesterday"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Pushing an item with an invalid timestamp should return 400, got %d", w.Code)
+	}
+
+	if w := serve(engine, "GET", "/series/sales", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Invalid items should not create the series, got %d", w.Code)
+	}
+
+	if w := serve(engine, "POST", "/series/sales", `[{"value": 1, "ts": 100}, {"value": 2, "ts": 200}, {"value": 3, "ts": "1970-01-01T00:05:00Z"}]`); w.Code != http.StatusNoContent {
+		t.Fatalf("Pushing items should return 204, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := serve(engine, "POST", "/series/sales", `{"value": 4}`); w.Code != http.StatusNoContent {
+		t.Fatalf("Pushing an item should return 204, got %d: %s", w.Code, w.Body.String())
+	}
+
+	result := items("/series/sales")
+
+	if len(result) != 4 || result[0]["ts"] != 100 || result[0]["value"] != 1 || result[2]["ts"] != 300 || result[3]["value"] != 4 {
+		t.Errorf("Unexpected items %v", result)
+	}
+
+	if last := result[3]["ts"]; time.Since(time.Unix(int64(last), 0)) > time.Minute {
+		t.Errorf("An item without a timestamp should be pushed at the current time, got %v", last)
+	}
+
+	if result = items("/series/sales?since=150&until=300"); len(result) != 2 || result[0]["value"] != 2 || result[1]["value"] != 3 {
+		t.Errorf("Expected the items between 150 and 300, got %v", result)
+	}
+
+	if result = items("/series/sales?count=1"); len(result) != 1 || result[0]["value"] != 4 {
+		t.Errorf("Expected the last item, got %v", result)
+	}
+
+	if w := serve(engine, "GET", "/series/sales?since=yesterday", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("An invalid since should return 400, got %d", w.Code)
+	}
+
+	if w := serve(engine, "DELETE", "/series/sales?trim_since=100&trim_count=1", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Trimming by time and count at once should return 400, got %d", w.Code)
+	}
+
+	if w := serve(engine, "DELETE", "/series/sales?trim_count=-1", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("A negative trim_count should return 400, got %d", w.Code)
+	}
+
+	if w := serve(engine, "DELETE", "/series/sales?trim_since=200", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Trimming by time should return 204, got %d", w.Code)
+	}
+
+	if result = items("/series/sales"); len(result) != 3 || result[0]["ts"] != 200 {
+		t.Errorf("Expected the items since 200, got %v", result)
+	}
+
+	if w := serve(engine, "DELETE", "/series/sales?trim_count=1", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Trimming by count should return 204, got %d", w.Code)
+	}
+
+	if result = items("/series/sales"); len(result) != 1 || result[0]["value"] != 4 {
+		t.Errorf("Expected only the last item, got %v", result)
+	}
+
+	if w := serve(engine, "DELETE", "/series/sales", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Dropping a series should return 204, got %d", w.Code)
+	}
+
+	if w := serve(engine, "GET", "/series/sales", ""); w.Code != http.StatusNotFound {
+		t.Errorf("A dropped series should return 404, got %d", w.Code)
+	}
+}
+
+func TestSeriesRetentionRoute(t *testing.T) {
+	engine, done := testEngine(t, seriesRoute)
+	defer done()
+
+	if w := serve(engine, "GET", "/series/sales/retention", ""); w.Code != http.StatusNotFound {
+		t.Errorf("The retention of a missing series should return 404, got %d", w.Code)
+	}
+
+	series, _, err := database.GetSeries("sales")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := series.SetRetention("30d"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(engine, "GET", "/series/sales/retention", "")
+	retention := database.Retention{}
+
+	if err := json.Unmarshal(w.Body.Bytes(), &retention); err != nil || retention.Source != database.RetentionSeries || retention.TTL != "30d" {
+		t.Errorf("Expected the retention of the series, got %s (%v)", w.Body.String(), err)
+	}
+}
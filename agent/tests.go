@@ -0,0 +1,440 @@
+package agent
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/telemetryapp/gotelemetry"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"github.com/telemetryapp/gotelemetry_agent/agent/database"
+	"github.com/telemetryapp/gotelemetry_agent/agent/lua"
+)
+
+// scriptTest is the content of a `.test.json` fixture file. Unless a script is
+// named, `name.test.json` runs `name.lua` from the same directory
+type scriptTest struct {
+	lua.Fixtures
+
+	Script   string                 `json:"script"`
+	Args     map[string]interface{} `json:"args"`
+	Flows    map[string]interface{} `json:"flows"`
+	Series   map[string][][]float64 `json:"series"`
+	Counters map[string]int64       `json:"counters"`
+	Output   map[string]interface{} `json:"output"`
+	Error    string                 `json:"error"`
+}
+
+// scriptTestResult is the outcome of a single fixture file
+type scriptTestResult struct {
+	name     string
+	failure  string
+	log      []string
+	duration time.Duration
+}
+
+// testProvider stands in for the job that runs a script. Flows are read from the
+// fixture and updates, errors and notifications are discarded
+type testProvider struct {
+	flows map[string]interface{}
+	log   []string
+}
+
+func (p *testProvider) SendNotification(n gotelemetry.Notification, channelTag string, flowTag string) bool {
+	return false
+}
+
+func (p *testProvider) ReadFlow(tag string) (interface{}, error) {
+	if data, ok := p.flows[tag]; ok {
+		return data, nil
+	}
+
+	return nil, fmt.Errorf("No fixture found for the flow `%s`", tag)
+}
+
+func (p *testProvider) UpdateFlow(tag string, data interface{}, updateType gotelemetry.BatchType) error {
+	return nil
+}
+
+func (p *testProvider) SetFlowError(tag string, message string) error {
+	return nil
+}
+
+func (p *testProvider) CreateFlow(tag string, variant string, template interface{}) (*gotelemetry.Flow, error) {
+	return &gotelemetry.Flow{Tag: tag, Variant: variant}, nil
+}
+
+func (p *testProvider) Log(level string, message string, fields map[string]interface{}) {
+	keys := make([]string, 0, len(fields))
+
+	for key := range fields {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	entry := level + ": " + message
+
+	for _, key := range keys {
+		entry += fmt.Sprintf(" %s=%v", key, fields[key])
+	}
+
+	p.log = append(p.log, entry)
+}
+
+// RunScriptTests runs every `.test.json` fixture file found in a directory against
+// its script, and reports the results in TAP format on stdout. If junitPath is set,
+// a JUnit XML report is written there as well. Returns false if any test failed,
+// or if there are no tests to run
+func RunScriptTests(directory string, junitPath string, errorChannel chan error) bool {
+	// Tests never touch the Agent's own database
+	config.CLIConfig.DatabasePath = ""
+	config.CLIConfig.DatabaseTTL = ""
+
+	paths, err := filepath.Glob(filepath.Join(directory, "*.test.json"))
+
+	if err != nil {
+		errorChannel <- err
+		return false
+	}
+
+	sort.Strings(paths)
+
+	fmt.Println("TAP version 13")
+
+	// A mistyped directory must not pass as an empty test suite
+	if len(paths) == 0 {
+		fmt.Printf("Bail out! No test fixtures found in %s\n", directory)
+		return false
+	}
+
+	fmt.Printf("1..%d\n", len(paths))
+
+	results := []scriptTestResult{}
+	passed := true
+
+	for index, path := range paths {
+		start := time.Now()
+
+		result := runScriptTest(path)
+		result.duration = time.Since(start)
+
+		if result.failure == "" {
+			fmt.Printf("ok %d - %s\n", index+1, result.name)
+		} else {
+			passed = false
+
+			fmt.Printf("not ok %d - %s\n", index+1, result.name)
+			fmt.Println("  ---")
+			fmt.Printf("  message: %s\n", strconv.Quote(result.failure))
+
+			if len(result.log) > 0 {
+				fmt.Println("  log:")
+
+				for _, entry := range result.log {
+					fmt.Printf("    - %s\n", strconv.Quote(entry))
+				}
+			}
+
+			fmt.Println("  ...")
+		}
+
+		results = append(results, result)
+	}
+
+	if junitPath != "" {
+		if err := writeJUnitReport(junitPath, results); err != nil {
+			errorChannel <- err
+			return false
+		}
+	}
+
+	return passed
+}
+
+func runScriptTest(path string) scriptTestResult {
+	name := strings.TrimSuffix(filepath.Base(path), ".test.json")
+	result := scriptTestResult{name: name}
+
+	source, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		result.failure = err.Error()
+		return result
+	}
+
+	test := scriptTest{}
+
+	if err := json.Unmarshal(source, &test); err != nil {
+		result.failure = fmt.Sprintf("Unable to parse the fixture file: %s", err)
+		return result
+	}
+
+	scriptPath := test.Script
+
+	if scriptPath == "" {
+		scriptPath = name + ".lua"
+	}
+
+	scriptPath = filepath.Join(filepath.Dir(path), scriptPath)
+
+	script, err := ioutil.ReadFile(scriptPath)
+
+	if err != nil {
+		result.failure = err.Error()
+		return result
+	}
+
+	// Every test gets its own temporary database, seeded from the fixture
+	dbFile, err := ioutil.TempFile("", "agent-test-")
+
+	if err != nil {
+		result.failure = err.Error()
+		return result
+	}
+
+	dbFile.Close()
+	defer os.Remove(dbFile.Name())
+
+	if err := database.Init(&config.File{Data: config.DataConfig{DataLocation: dbFile.Name()}}, nil); err != nil {
+		result.failure = err.Error()
+		return result
+	}
+
+	defer database.Close()
+
+	if err := seedScriptTest(&test); err != nil {
+		result.failure = err.Error()
+		return result
+	}
+
+	p := &testProvider{flows: test.Flows}
+
+	// Arguments are checked against the schema in the script's header, as for jobs
+	schema, err := lua.ScriptArgsSchema(string(script))
+
+	var args map[string]interface{}
+	var output map[string]interface{}
+
+	if err == nil {
+		args, err = schema.Apply(test.Args)
+	}
+
+	if err == nil {
+		output, err = lua.ExecWithFixtures(string(script), filepath.Dir(scriptPath), p, args, &test.Fixtures)
+	}
+
+	result.log = p.log
+
+	if test.Error != "" {
+		if err == nil {
+			result.failure = fmt.Sprintf("Expected an error containing `%s`, but the script succeeded", test.Error)
+		} else if !strings.Contains(err.Error(), test.Error) {
+			result.failure = fmt.Sprintf("Expected an error containing `%s`, got `%s`", test.Error, err)
+		}
+
+		return result
+	}
+
+	if err != nil {
+		result.failure = err.Error()
+		return result
+	}
+
+	if err := compareTestOutput("output", test.Output, output); err != nil {
+		result.failure = err.Error()
+	}
+
+	return result
+}
+
+func seedScriptTest(test *scriptTest) error {
+	for name, points := range test.Series {
+		series, _, err := database.GetSeries(name)
+
+		if err != nil {
+			return err
+		}
+
+		for _, point := range points {
+			if len(point) != 2 {
+				return fmt.Errorf("Points of the series `%s` must be [timestamp, value] pairs", name)
+			}
+
+			seconds := math.Floor(point[0])
+			timestamp := time.Unix(int64(seconds), int64((point[0]-seconds)*1e9))
+
+			if err := series.Push(&timestamp, point[1]); err != nil {
+				return err
+			}
+		}
+	}
+
+	for name, value := range test.Counters {
+		counter, _, err := database.GetCounter(name)
+
+		if err != nil {
+			return err
+		}
+
+		if err := counter.SetValue(value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// compareTestOutput checks that every value in expected is present in actual.
+// Tables are compared as subsets, while lists must match item by item
+func compareTestOutput(path string, expected, actual interface{}) error {
+	switch e := expected.(type) {
+	case map[string]interface{}:
+		a, ok := actual.(map[string]interface{})
+
+		if !ok {
+			return fmt.Errorf("Expected `%s` to be a table, got %s", path, formatTestValue(actual))
+		}
+
+		keys := make([]string, 0, len(e))
+
+		for key := range e {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			value, ok := a[key]
+
+			if !ok {
+				return fmt.Errorf("Expected `%s.%s` to be set", path, key)
+			}
+
+			if err := compareTestOutput(path+"."+key, e[key], value); err != nil {
+				return err
+			}
+		}
+
+		return nil
+
+	case []interface{}:
+		a, ok := testOutputList(actual)
+
+		if !ok {
+			return fmt.Errorf("Expected `%s` to be a list, got %s", path, formatTestValue(actual))
+		}
+
+		if len(a) != len(e) {
+			return fmt.Errorf("Expected `%s` to have %d items, got %d", path, len(e), len(a))
+		}
+
+		for index := range e {
+			if err := compareTestOutput(fmt.Sprintf("%s[%d]", path, index+1), e[index], a[index]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+
+	default:
+		if !reflect.DeepEqual(expected, actual) {
+			return fmt.Errorf("Expected `%s` to be %s, got %s", path, formatTestValue(expected), formatTestValue(actual))
+		}
+
+		return nil
+	}
+}
+
+// testOutputList returns the items of a list, which Lua sequences that weren't
+// created as arrays produce as tables keyed by index
+func testOutputList(value interface{}) ([]interface{}, bool) {
+	switch v := value.(type) {
+	case []interface{}:
+		return v, true
+
+	case map[string]interface{}:
+		list := make([]interface{}, len(v))
+
+		for key, item := range v {
+			index, err := strconv.Atoi(key)
+
+			if err != nil || index < 1 || index > len(v) {
+				return nil, false
+			}
+
+			list[index-1] = item
+		}
+
+		return list, true
+	}
+
+	return nil, false
+}
+
+func formatTestValue(value interface{}) string {
+	b, err := json.Marshal(value)
+
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+
+	return string(b)
+}
+
+type junitTestSuite struct {
+	XMLName  xml.Name        `xml:"testsuite"`
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+}
+
+func writeJUnitReport(path string, results []scriptTestResult) error {
+	suite := junitTestSuite{Name: "telemetry_agent", Tests: len(results)}
+
+	for _, result := range results {
+		testCase := junitTestCase{
+			Name:      result.name,
+			ClassName: "scripts",
+			Time:      fmt.Sprintf("%.3f", result.duration.Seconds()),
+			SystemOut: strings.Join(result.log, "\n"),
+		}
+
+		if result.failure != "" {
+			suite.Failures++
+			testCase.Failure = &junitFailure{Message: result.failure}
+		}
+
+		suite.Cases = append(suite.Cases, testCase)
+	}
+
+	b, err := xml.MarshalIndent(suite, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append([]byte(xml.Header), b...), 0644)
+}
@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompareTestOutput(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected interface{}
+		actual   interface{}
+		failure  string
+	}{
+		{"Equal values", 1.0, 1.0, ""},
+		{"Different values", 1.0, 2.0, "Expected `output` to be 1, got 2"},
+		{"Different types", "1", 1.0, "Expected `output` to be \"1\", got 1"},
+		{"Tables are subsets", map[string]interface{}{"a": 1.0}, map[string]interface{}{"a": 1.0, "b": 2.0}, ""},
+		{"Missing keys", map[string]interface{}{"a": 1.0, "c": 3.0}, map[string]interface{}{"a": 1.0}, "Expected `output.c` to be set"},
+		{"Nested tables", map[string]interface{}{"a": map[string]interface{}{"b": true}}, map[string]interface{}{"a": map[string]interface{}{"b": false}}, "Expected `output.a.b` to be true, got false"},
+		{"Not a table", map[string]interface{}{"a": 1.0}, "a", "Expected `output` to be a table, got \"a\""},
+		{"Lists", []interface{}{1.0, "x"}, []interface{}{1.0, "x"}, ""},
+		{"Lists from Lua tables", []interface{}{1.0, 2.0}, map[string]interface{}{"2": 2.0, "1": 1.0}, ""},
+		{"Lists of different lengths", []interface{}{1.0}, []interface{}{1.0, 2.0}, "Expected `output` to have 1 items, got 2"},
+		{"List items", []interface{}{1.0, map[string]interface{}{"a": 1.0}}, []interface{}{1.0, map[string]interface{}{"a": 2.0}}, "Expected `output[2].a` to be 1, got 2"},
+		{"Not a list", []interface{}{1.0}, map[string]interface{}{"a": 1.0}, "Expected `output` to be a list, got {\"a\":1}"},
+	}
+
+	for _, test := range tests {
+		err := compareTestOutput("output", test.expected, test.actual)
+
+		if test.failure == "" && err != nil {
+			t.Errorf("%s: unexpected failure `%s`", test.name, err)
+		}
+
+		if test.failure != "" && (err == nil || err.Error() != test.failure) {
+			t.Errorf("%s: expected the failure `%s`, got `%v`", test.name, test.failure, err)
+		}
+	}
+}
+
+func TestWriteJUnitReport(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "agent-junit-test.xml")
+	defer os.Remove(path)
+
+	results := []scriptTestResult{
+		{name: "passing", duration: 1500 * time.Millisecond, log: []string{"info: one", "warn: two"}},
+		{name: "failing", failure: "Expected `output.total` to be 3, got 2"},
+	}
+
+	if err := writeJUnitReport(path, results); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(string(b), xml.Header) {
+		t.Errorf("The report should start with the XML header")
+	}
+
+	suite := junitTestSuite{}
+
+	if err := xml.Unmarshal(b, &suite); err != nil {
+		t.Fatal(err)
+	}
+
+	if suite.Tests != 2 || suite.Failures != 1 || len(suite.Cases) != 2 {
+		t.Fatalf("Expected 2 tests and 1 failure, got %d tests, %d failures and %d cases", suite.Tests, suite.Failures, len(suite.Cases))
+	}
+
+	passing, failing := suite.Cases[0], suite.Cases[1]
+
+	if passing.Name != "passing" || passing.Time != "1.500" || passing.Failure != nil || passing.SystemOut != "info: one\nwarn: two" {
+		t.Errorf("Unexpected passing test case %+v", passing)
+	}
+
+	if failing.Name != "failing" || failing.Failure == nil || failing.Failure.Message != results[1].failure {
+		t.Errorf("Unexpected failing test case %+v", failing)
+	}
+}
+
+func TestRunScriptTestsWithoutFixtures(t *testing.T) {
+	directory, err := ioutil.TempDir("", "agent-script-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(directory)
+
+	if RunScriptTests(directory, "", make(chan error, 10)) {
+		t.Error("A directory without test fixtures should not pass")
+	}
+}
+
+func TestRunScriptTest(t *testing.T) {
+	directory, err := ioutil.TempDir("", "agent-script-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(directory)
+
+	files := map[string]string{
+		"sales.lua": `local http = require("telemetry/http"); local json = require("telemetry/json"); ` +
+			`local st = require("telemetry/storage"); ` +
+			`output.total = json.decode(http.get("https://example.com/sales")).total + st.series("orders").last().value`,
+		"sales.test.json": `{"http": [{"url": "https://example.com/sales", "json": {"total": 2}}], ` +
+			`"series": {"orders": [[1000000000, 1]]}, "output": {"total": 3}}`,
+		"wrong.test.json": `{"script": "sales.lua", "http": [{"url": "https://example.com/sales", "json": {"total": 2}}], ` +
+			`"series": {"orders": [[1000000000, 1]]}, "output": {"total": 4}}`,
+	}
+
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(directory, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	goroutines := runtime.NumGoroutine()
+
+	if result := runScriptTest(filepath.Join(directory, "sales.test.json")); result.failure != "" {
+		t.Errorf("The test should pass, but failed with `%s`", result.failure)
+	}
+
+	if result := runScriptTest(filepath.Join(directory, "wrong.test.json")); result.failure != "Expected `output.total` to be 4, got 3" {
+		t.Errorf("The test should fail on the total, but got `%s`", result.failure)
+	}
+
+	// The background jobs of each test database stop when it is closed
+	for i := 0; i < 100 && runtime.NumGoroutine() > goroutines; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if runtime.NumGoroutine() > goroutines {
+		t.Errorf("Expected at most %d goroutines after the tests, got %d", goroutines, runtime.NumGoroutine())
+	}
+}